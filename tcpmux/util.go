@@ -6,6 +6,8 @@ import (
 	"log"
 	"net"
 	"sync"
+
+	"github.com/MoZhonghua/mytools/util/relay"
 )
 
 func ReadHeader(c io.Reader) (string, error) {
@@ -45,24 +47,13 @@ func WriteHeader(code string, c io.Writer) error {
 	return nil
 }
 
+// Pipeline copies r to w until r ends, then shuts down the writing side of
+// w. The normal end of r isn't an error.
 func Pipeline(r, w *net.TCPConn, wg *sync.WaitGroup) error {
 	defer wg.Done()
-	buf := make([]byte, 1024)
-	for {
-		n, err := r.Read(buf)
-		// log.Printf("read: %d - %v\n", n, err)
-		if n > 0 {
-			n2, err := w.Write(buf[:n])
-			// log.Printf("write: %d - %v\n", n2, err)
-			if n2 != n {
-				log.Printf("failed to pipeline data: %v", err)
-				return err
-			}
-		}
-
-		if err != nil {
-			w.CloseWrite()
-			return err
-		}
+	_, err := relay.Copy(w, r, nil)
+	if err != nil {
+		log.Printf("failed to pipeline data: %v", err)
 	}
+	return err
 }
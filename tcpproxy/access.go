@@ -0,0 +1,184 @@
+package tcpproxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// rate limit buckets of client IPs are swept once there are this many
+const maxRateBuckets = 4096
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip: %s", s)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+func matchCIDRs(list []*net.IPNet, ip net.IP) bool {
+	for _, n := range list {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// accessControl enforces the PortMappingLimits of a port mapping. It's
+// replaced as a whole when the limits change.
+type accessControl struct {
+	allow       []*net.IPNet
+	deny        []*net.IPNet
+	maxConns    int64
+	rate        float64
+	burst       float64
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+func newAccessControl(l *PortMappingLimits) (*accessControl, error) {
+	if l.MaxConns < 0 || l.RateLimit < 0 || l.IdleTimeout < 0 {
+		return nil, fmt.Errorf("invalid limits")
+	}
+
+	allow, err := parseCIDRs(l.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(l.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessControl{
+		allow:       allow,
+		deny:        deny,
+		maxConns:    int64(l.MaxConns),
+		rate:        l.RateLimit,
+		burst:       math.Max(1, math.Ceil(l.RateLimit)),
+		idleTimeout: time.Duration(l.IdleTimeout) * time.Second,
+		buckets:     make(map[string]*rateBucket),
+	}, nil
+}
+
+func (a *accessControl) allowed(ip net.IP) bool {
+	if matchCIDRs(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || matchCIDRs(a.allow, ip)
+}
+
+// takeToken reports whether ip may open a new connection at now, with a
+// token bucket per ip that holds at most one second worth of connections.
+func (a *accessControl) takeToken(ip net.IP, now time.Time) bool {
+	if a.rate <= 0 {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := ip.String()
+	b, found := a.buckets[key]
+	if !found {
+		if len(a.buckets) >= maxRateBuckets {
+			a.sweep(now)
+		}
+		b = &rateBucket{tokens: a.burst, last: now}
+		a.buckets[key] = b
+	}
+
+	b.tokens = math.Min(a.burst, b.tokens+now.Sub(b.last).Seconds()*a.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets buckets that are full again, they behave like new ones.
+func (a *accessControl) sweep(now time.Time) {
+	for key, b := range a.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*a.rate >= a.burst {
+			delete(a.buckets, key)
+		}
+	}
+}
+
+func (m *portMapping) getAccess() *accessControl {
+	return m.access.Load().(*accessControl)
+}
+
+func clientIP(c net.Conn) net.IP {
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return a.IP
+	}
+	return nil
+}
+
+// admit checks a connection right after accept against the access lists
+// and limits. An admitted connection must be released once closed.
+func (m *portMapping) admit(c net.Conn) bool {
+	a := m.getAccess()
+	ip := clientIP(c)
+
+	reason := ""
+	if !a.allowed(ip) {
+		reason = "denied"
+	} else if !a.takeToken(ip, time.Now()) {
+		reason = "rate limited"
+	} else if n := m.acquire(); a.maxConns > 0 && n > a.maxConns {
+		m.release()
+		reason = "too many connections"
+	} else {
+		return true
+	}
+
+	m.stats.connRejected()
+	log.Debugf("reject connection from %v to :%d: %s", c.RemoteAddr(), m.localPort, reason)
+	return false
+}
+
+// acquire counts an admitted connection and returns the connections of
+// the mapping and those it replaced.
+func (m *portMapping) acquire() int64 {
+	atomic.AddInt64(&m.numConns, 1)
+	return atomic.AddInt64(m.liveConns, 1)
+}
+
+func (m *portMapping) release() {
+	atomic.AddInt64(&m.numConns, -1)
+	atomic.AddInt64(m.liveConns, -1)
+}
@@ -0,0 +1,164 @@
+package tcpproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessControlAllowDeny(t *testing.T) {
+	a, err := newAccessControl(&PortMappingLimits{
+		Allow: []string{"10.0.0.0/8", "192.168.1.1"},
+		Deny:  []string{"10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"10.1.0.1", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+	}
+	for _, c := range cases {
+		if got := a.allowed(net.ParseIP(c.ip)); got != c.allowed {
+			t.Errorf("allowed(%s) = %v", c.ip, got)
+		}
+	}
+
+	_, err = newAccessControl(&PortMappingLimits{Deny: []string{"bad"}})
+	if err == nil {
+		t.Error("invalid cidr accepted")
+	}
+}
+
+func TestAccessControlRateLimit(t *testing.T) {
+	a, err := newAccessControl(&PortMappingLimits{RateLimit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("10.0.0.1")
+	now := time.Now()
+	if !a.takeToken(ip, now) || !a.takeToken(ip, now) {
+		t.Fatal("burst rejected")
+	}
+	if a.takeToken(ip, now) {
+		t.Fatal("third connection accepted")
+	}
+	if !a.takeToken(net.ParseIP("10.0.0.2"), now) {
+		t.Fatal("other ip rejected")
+	}
+	if !a.takeToken(ip, now.Add(500*time.Millisecond)) {
+		t.Fatal("token not refilled")
+	}
+}
+
+func TestPortMappingLimits(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTestPortMapping(t, p, echo)
+
+	_, err := p.SetPortMappingLimits(port, &PortMappingLimits{MaxConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialAndEcho(t, port)
+	c2 := dialAndEchoNoCheck(t, port)
+	waitClosed(t, c2)
+	c2.Close()
+	c.Close()
+
+	info, err := p.SetPortMappingLimits(port, &PortMappingLimits{
+		Deny: []string{"127.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MaxConns != 0 || len(info.Deny) != 1 {
+		t.Errorf("limits not replaced: %+v", info.PortMappingLimits)
+	}
+
+	c = dialAndEchoNoCheck(t, port)
+	waitClosed(t, c)
+	c.Close()
+
+	if n := p.ListPortMapping()[0].Stats.Rejected; n != 2 {
+		t.Errorf("rejected: %d", n)
+	}
+}
+
+func TestMaxConnsAfterUpdate(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+
+	port := freePort(t)
+	info := &PortMappingInfo{LocalPort: port, RemoteAddr: echo.Addr().String()}
+	info.MaxConns = 1
+	err := p.AddPortMapping(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dialAndEcho(t, port)
+
+	// the connection stays on the replaced mapping and still counts
+	update := *info
+	update.RemoteAddr = fmt.Sprintf("localhost:%d", echo.Addr().(*net.TCPAddr).Port)
+	_, err = p.UpdatePortMapping(&update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := dialAndEchoNoCheck(t, port)
+	waitClosed(t, c2)
+	c2.Close()
+
+	c.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for p.ListPortMapping()[0].Stats.ActiveConns > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection still open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dialAndEcho(t, port).Close()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+
+	port := freePort(t)
+	info := &PortMappingInfo{
+		LocalPort:  port,
+		RemoteAddr: echo.Addr().String(),
+	}
+	info.IdleTimeout = 1
+	err := p.AddPortMapping(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialAndEcho(t, port)
+	defer c.Close()
+
+	start := time.Now()
+	waitClosed(t, c)
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Errorf("closed after %v", d)
+	}
+}
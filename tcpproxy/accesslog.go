@@ -0,0 +1,313 @@
+package tcpproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// Close reasons of access log entries. The reason is taken from whichever
+// direction of the connection ends first.
+const (
+	CloseReasonClientEOF = "client_eof"
+	CloseReasonRemoteEOF = "remote_eof"
+	CloseReasonDialError = "dial_error"
+	CloseReasonReset     = "reset"
+	CloseReasonTimeout   = "timeout"
+	// CloseReasonClosed means the proxy closed the connection, e.g. the
+	// port mapping was deleted or a toxic ended it.
+	CloseReasonClosed = "closed"
+	// CloseReasonError covers failed tls handshakes, routing and other
+	// errors, see AccessLogEntry.Error.
+	CloseReasonError = "error"
+)
+
+// AccessLogEntry is written once per proxied connection when it's closed.
+// Duration is in seconds. RemoteAddr is empty for http port mappings whose
+// requests may go to different remotes.
+type AccessLogEntry struct {
+	LocalPort  int       `json:"localPort"`
+	ClientAddr string    `json:"clientAddr"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	StartTime  time.Time `json:"startTime"`
+	Duration   float64   `json:"duration"`
+	BytesUp    int64     `json:"bytesUp"`
+	BytesDown  int64     `json:"bytesDown"`
+	Reason     string    `json:"reason"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// AccessLogSink receives access log entries, it's called concurrently.
+type AccessLogSink interface {
+	WriteEntry(e *AccessLogEntry) error
+	Close() error
+}
+
+// AccessLogFormat formats an entry as one line, JSON if it has no
+// template.
+type AccessLogFormat struct {
+	tmpl *template.Template
+}
+
+// NewAccessLogFormat parses a text/template executed with an
+// AccessLogEntry, e.g. "{{.ClientAddr}} {{.BytesUp}} {{.Reason}}". An
+// empty template means JSON lines.
+func NewAccessLogFormat(tmpl string) (*AccessLogFormat, error) {
+	if tmpl == "" {
+		return &AccessLogFormat{}, nil
+	}
+
+	t, err := template.New("accesslog").Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLogFormat{tmpl: t}, nil
+}
+
+func (f *AccessLogFormat) Format(e *AccessLogEntry) ([]byte, error) {
+	if f == nil || f.tmpl == nil {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	}
+
+	var buf bytes.Buffer
+	err := f.tmpl.Execute(&buf, e)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+type writerSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format *AccessLogFormat
+}
+
+// NewWriterSink writes each entry formatted by format with a single Write
+// call. Close closes w if it's an io.Closer.
+func NewWriterSink(w io.Writer, format *AccessLogFormat) AccessLogSink {
+	return &writerSink{w: w, format: format}
+}
+
+func (s *writerSink) WriteEntry(e *AccessLogEntry) error {
+	b, err := s.format.Format(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(b)
+	return err
+}
+
+func (s *writerSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// RotatingFile is a log file renamed to path.<time> and reopened once it
+// exceeds MaxSize bytes or was opened MaxAge ago, zero means no limit. Only
+// the newest MaxBackups renamed files are kept, zero means keep all.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = fi.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if r.size > 0 && ((r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize) ||
+		(r.maxAge > 0 && time.Since(r.opened) >= r.maxAge)) {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+
+	backup := r.path + "." + time.Now().Format("20060102-150405.000")
+	err := os.Rename(r.path, backup)
+	if err != nil {
+		// keep logging to path, which may have been moved away by another
+		// rotation
+		if err := r.open(); err != nil {
+			return err
+		}
+		return err
+	}
+
+	if r.maxBackups > 0 {
+		r.removeBackups()
+	}
+	return r.open()
+}
+
+// removeBackups removes all but the newest maxBackups backups, their names
+// sort by time.
+func (r *RotatingFile) removeBackups() {
+	list, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	sort.Strings(list)
+	for len(list) > r.maxBackups {
+		os.Remove(list[0])
+		list = list[1:]
+	}
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// accessLog is shared by the proxy and its port mappings so the sink can
+// be replaced at any time. Its methods accept a nil receiver.
+type accessLog struct {
+	sink atomic.Value
+}
+
+type accessLogSinkBox struct {
+	sink AccessLogSink
+}
+
+func (a *accessLog) set(sink AccessLogSink) {
+	a.sink.Store(accessLogSinkBox{sink: sink})
+}
+
+func (a *accessLog) write(e *AccessLogEntry) {
+	if a == nil {
+		return
+	}
+	box, _ := a.sink.Load().(accessLogSinkBox)
+	if box.sink == nil {
+		return
+	}
+	box.sink.WriteEntry(e)
+}
+
+// closeReason classifies the error that ended one direction of a
+// connection, up is from the client to the remote.
+func closeReason(up bool, err error) string {
+	if err == io.EOF {
+		if up {
+			return CloseReasonClientEOF
+		}
+		return CloseReasonRemoteEOF
+	}
+	if isTimeout(err) {
+		return CloseReasonTimeout
+	}
+	if err == errToxicClosed || isClosedError(err) {
+		return CloseReasonClosed
+	}
+
+	msg := err.Error()
+	if strings.Contains(msg, syscall.ECONNRESET.Error()) ||
+		strings.Contains(msg, syscall.EPIPE.Error()) {
+		return CloseReasonReset
+	}
+	return CloseReasonError
+}
+
+func isClosedError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// newAccessLogEntry starts the entry of a connection accepted on l, on the
+// port offset from the first port of the mapping.
+func (m *portMapping) newAccessLogEntry(l net.Conn, offset int) *AccessLogEntry {
+	return &AccessLogEntry{
+		LocalPort:  m.localPort + offset,
+		ClientAddr: l.RemoteAddr().String(),
+		StartTime:  time.Now(),
+	}
+}
+
+// writeAccessLog finishes e with the counters of cs, which may be nil.
+func (m *portMapping) writeAccessLog(e *AccessLogEntry, cs *connStats) {
+	e.Duration = time.Since(e.StartTime).Seconds()
+	if cs != nil {
+		e.BytesUp = atomic.LoadInt64(&cs.bytesUp)
+		e.BytesDown = atomic.LoadInt64(&cs.bytesDown)
+	}
+	m.accessLog.write(e)
+}
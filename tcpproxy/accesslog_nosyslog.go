@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package tcpproxy
+
+import (
+	"errors"
+)
+
+func NewSyslogSink(network, raddr, tag string, format *AccessLogFormat) (AccessLogSink, error) {
+	return nil, errors.New("syslog not supported on this platform")
+}
@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package tcpproxy
+
+import (
+	"log/syslog"
+)
+
+// NewSyslogSink sends entries to syslog with facility daemon and severity
+// info. network and raddr are passed to syslog.Dial, empty means the local
+// syslog daemon.
+func NewSyslogSink(network, raddr, tag string, format *AccessLogFormat) (AccessLogSink, error) {
+	w, err := syslog.Dial(network, raddr, syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterSink(w, format), nil
+}
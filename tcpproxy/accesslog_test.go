@@ -0,0 +1,155 @@
+package tcpproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memorySink struct {
+	mu      sync.Mutex
+	entries []*AccessLogEntry
+}
+
+func (s *memorySink) WriteEntry(e *AccessLogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+func (s *memorySink) Close() error { return nil }
+
+func (s *memorySink) wait(t *testing.T, n int) []*AccessLogEntry {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		s.mu.Lock()
+		entries := s.entries
+		s.mu.Unlock()
+		if len(entries) >= n {
+			return entries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d access log entries, want %d", len(entries), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	sink := &memorySink{}
+	p.SetAccessLog(sink)
+	port := addTestPortMapping(t, p, echo)
+
+	c := dialAndEcho(t, port)
+	c.Close()
+	e := sink.wait(t, 1)[0]
+	if e.LocalPort != port || e.RemoteAddr != echo.Addr().String() ||
+		e.BytesUp != 5 || e.BytesDown != 5 || e.Reason != CloseReasonClientEOF {
+		t.Errorf("entry: %+v", e)
+	}
+
+	dead := freePort(t)
+	deadPort := freePort(t)
+	err := p.AddPortMapping(&PortMappingInfo{
+		LocalPort:  deadPort,
+		RemoteAddr: "127.0.0.1:" + strconv.Itoa(dead),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = dialAndEchoNoCheck(t, deadPort)
+	waitClosed(t, c)
+	c.Close()
+	e = sink.wait(t, 2)[1]
+	if e.Reason != CloseReasonDialError || e.Error == "" {
+		t.Errorf("entry: %+v", e)
+	}
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	f, err := NewAccessLogFormat("{{.LocalPort}} {{.ClientAddr}} {{.Reason}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := f.Format(&AccessLogEntry{LocalPort: 80, ClientAddr: "1.2.3.4:5", Reason: CloseReasonReset})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "80 1.2.3.4:5 reset\n" {
+		t.Errorf("formatted: %q", b)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcpproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	f, err := NewRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := f.Write([]byte("12345678\n")); err != nil {
+			t.Fatal(err)
+		}
+		// backups are named by time in milliseconds
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("backups: %v", backups)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != "12345678\n" {
+		t.Errorf("current file: %q", data)
+	}
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcpproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	f, err := NewRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write([]byte("12345678\n")); err != nil {
+		t.Fatal(err)
+	}
+	// removed by an external logrotate, the rename of the rotation fails
+	os.Remove(path)
+	if _, err := f.Write([]byte("12345678\n")); !os.IsNotExist(err) {
+		t.Fatalf("rotating a removed file: %v", err)
+	}
+
+	if _, err := f.Write([]byte("after\n")); err != nil {
+		t.Fatalf("write after failed rotation: %v", err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != "after\n" {
+		t.Errorf("current file: %q", data)
+	}
+}
@@ -0,0 +1,259 @@
+package tcpproxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/MoZhonghua/mytools/util"
+	"github.com/gorilla/mux"
+)
+
+const apiV1Prefix = "/api/v1"
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// registerAPIV1 adds the versioned admin api, see openAPIV1 for its
+// description. The unversioned routes are kept for old clients.
+func (d *Httpd) registerAPIV1(m *mux.Router) {
+	api := m.PathPrefix(apiV1Prefix).Subrouter()
+	api.Methods("GET").Path("/openapi.json").HandlerFunc(handleOpenAPI)
+	api.Methods("GET").Path("/mappings").HandlerFunc(d.handleListPortMapping)
+	api.Methods("POST").Path("/mappings").HandlerFunc(d.handlePostPortMapping)
+	api.Methods("GET").Path("/mappings/{port:[0-9]+}").HandlerFunc(d.handleGetPortMapping)
+	api.Methods("PUT").Path("/mappings/{port:[0-9]+}").HandlerFunc(d.handlePutPortMapping)
+	api.Methods("DELETE").Path("/mappings/{port:[0-9]+}").HandlerFunc(d.handleDeletePortMappingV1)
+	api.Methods("GET").Path("/mappings/{port:[0-9]+}/connections").HandlerFunc(d.handleListConnections)
+	api.Methods("POST").Path("/mappings/{port:[0-9]+}/enable").HandlerFunc(d.handleEnablePortMapping)
+	api.Methods("POST").Path("/mappings/{port:[0-9]+}/disable").HandlerFunc(d.handleDisablePortMapping)
+	api.Methods("PUT").Path("/mappings/{port:[0-9]+}/limits").HandlerFunc(d.handleSetPortMappingLimits)
+	api.Methods("POST").Path("/apply").HandlerFunc(d.handleApplyConfig)
+	api.Methods("GET").Path("/errors").HandlerFunc(d.handleListErrors)
+}
+
+// SetAuthToken requires every admin request except the OpenAPI document
+// and the dashboard page to carry "Authorization: Bearer <token>". An
+// empty token disables auth.
+func (d *Httpd) SetAuthToken(token string) {
+	d.token = token
+}
+
+// SetErrorLog sets the log whose entries are served to the dashboard, it
+// should be added as a logrus hook.
+func (d *Httpd) SetErrorLog(e *ErrorLog) {
+	d.errLog = e
+}
+
+func isPublicPath(path string) bool {
+	return path == "/" || path == dashboardPath || path == apiV1Prefix+"/openapi.json"
+}
+
+func (d *Httpd) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.token == "" || isPublicPath(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tcpproxy"`)
+			util.WriteErrorResponse(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isAddrInUse(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.EADDRINUSE
+}
+
+// writeMappingError writes err with 404 for a missing port mapping, 409
+// for a local port used by another mapping or process, and status for
+// anything else.
+func writeMappingError(w http.ResponseWriter, status int, err error) {
+	if err == ErrPortMappingNotFound {
+		status = http.StatusNotFound
+	} else if err == ErrLocalPortUsed || isAddrInUse(err) {
+		status = http.StatusConflict
+	}
+	util.WriteErrorResponse(w, status, err)
+}
+
+func (d *Httpd) handleGetPortMapping(w http.ResponseWriter, r *http.Request) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	info, err := d.p.GetPortMapping(localPort)
+	if err != nil {
+		writeMappingError(w, 500, err)
+		return
+	}
+
+	util.WriteSuccessResponseWithData(w, info)
+}
+
+// parsePortMappingBody reads the port mapping of a request body, the
+// localPort of the body may be omitted if localPort isn't 0.
+func parsePortMappingBody(r *http.Request, localPort int) (*PortMappingInfo, error) {
+	pmInfo := &PortMappingInfo{}
+	err := util.ParseJsonRequest(r, pmInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	if pmInfo.LocalPort == 0 {
+		pmInfo.LocalPort = localPort
+	} else if localPort != 0 && pmInfo.LocalPort != localPort {
+		return nil, fmt.Errorf("local port %d doesn't match path", pmInfo.LocalPort)
+	}
+
+	err = validatePortMappingInfo(pmInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	pmInfo.Running = false
+	pmInfo.Stats = nil
+	pmInfo.RemoteStatus = nil
+	return pmInfo, nil
+}
+
+// handlePostPortMapping creates a port mapping, it fails with 409 if the
+// local port is used.
+func (d *Httpd) handlePostPortMapping(w http.ResponseWriter, r *http.Request) {
+	pmInfo, err := parsePortMappingBody(r, 0)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+	d.addPortMapping(w, pmInfo)
+}
+
+// handlePutPortMapping creates the port mapping of the port in the path,
+// or replaces its config without closing its listener, see
+// Proxy.UpdatePortMapping.
+func (d *Httpd) handlePutPortMapping(w http.ResponseWriter, r *http.Request) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	pmInfo, err := parsePortMappingBody(r, localPort)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	old, err := d.p.GetPortMapping(localPort)
+	if err == ErrPortMappingNotFound {
+		d.addPortMapping(w, pmInfo)
+		return
+	}
+
+	info, err := d.p.UpdatePortMapping(configOf(pmInfo))
+	if err != nil {
+		writeMappingError(w, 500, err)
+		return
+	}
+
+	err = d.s.AddPortMapping(pmInfo)
+	if err != nil {
+		d.p.UpdatePortMapping(configOf(old))
+		util.WriteErrorResponse(w, 500, err)
+		return
+	}
+	util.WriteSuccessResponseWithData(w, info)
+}
+
+// addPortMapping adds a copy of pmInfo to the proxy, which owns it and may
+// change it later, then saves pmInfo. Every handler adds to the proxy
+// first so a failure leaves the store as it was.
+func (d *Httpd) addPortMapping(w http.ResponseWriter, pmInfo *PortMappingInfo) {
+	err := d.p.AddPortMapping(configOf(pmInfo))
+	if err != nil {
+		writeMappingError(w, 500, err)
+		return
+	}
+
+	err = d.s.AddPortMapping(pmInfo)
+	if err != nil {
+		d.p.DeletePortMapping(pmInfo.LocalPort, nil)
+		util.WriteErrorResponse(w, 500, err)
+		return
+	}
+
+	info, err := d.p.GetPortMapping(pmInfo.LocalPort)
+	if err != nil {
+		writeMappingError(w, 500, err)
+		return
+	}
+	util.WriteSuccessResponseWithData(w, info)
+}
+
+func (d *Httpd) handleDeletePortMappingV1(w http.ResponseWriter, r *http.Request) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	opts, err := parseStopOptions(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	_, err = d.p.GetPortMapping(localPort)
+	if err != nil {
+		writeMappingError(w, 500, err)
+		return
+	}
+
+	// deleted from the store first as the proxy may drain for long, and
+	// can't be undone
+	err = d.s.DeletePortMapping(localPort)
+	if err != nil {
+		util.WriteErrorResponse(w, 500, err)
+		return
+	}
+
+	err = d.p.DeletePortMapping(localPort, opts)
+	if err != nil {
+		writeMappingError(w, 500, err)
+		return
+	}
+
+	util.WriteSuccessResponse(w)
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPIV1))
+}
+
+func (d *Httpd) handleListErrors(w http.ResponseWriter, r *http.Request) {
+	list := make([]*ErrorLogEntry, 0)
+	if d.errLog != nil {
+		list = d.errLog.List()
+	}
+	util.WriteSuccessResponseWithData(w, list)
+}
@@ -0,0 +1,251 @@
+package tcpproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func startTestHttpd(t *testing.T, p *Proxy, token string) (string, func()) {
+	dir, err := ioutil.TempDir("", "tcpproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewHttpd(p, s)
+	d.SetAuthToken(token)
+	go d.Serv(l)
+
+	return "http://" + l.Addr().String(), func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAPIV1(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	server, stop := startTestHttpd(t, p, "secret")
+	defer stop()
+
+	anon, _ := NewClient(server)
+	_, err := anon.ListPortMapping()
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("request without token: %v", err)
+	}
+
+	c, err := NewClientWithConfig(server, &ClientConfig{Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+	pm := &PortMappingInfo{LocalPort: port, RemoteAddr: echo.Addr().String()}
+	err = c.AddPortMapping(pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialAndEcho(t, port).Close()
+
+	err = c.AddPortMapping(pm)
+	if err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("port mapping added twice: %v", err)
+	}
+
+	busy, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	err = c.AddPortMapping(&PortMappingInfo{
+		LocalPort:  busy.Addr().(*net.TCPAddr).Port,
+		RemoteAddr: echo.Addr().String(),
+	})
+	if err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("port used by another listener: %v", err)
+	}
+
+	info, err := c.GetPortMapping(port)
+	if err != nil || !info.Running {
+		t.Errorf("get port mapping: %+v %v", info, err)
+	}
+
+	pm.Remotes = []string{echo.Addr().String(), echo.Addr().String()}
+	pm.RemoteAddr = ""
+	info, err = c.UpdatePortMapping(pm)
+	if err != nil || !info.Running || len(info.Remotes) != 2 {
+		t.Errorf("update port mapping: %+v %v", info, err)
+	}
+	dialAndEcho(t, port).Close()
+
+	err = c.DeletePortMapping(port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.GetPortMapping(port)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("get deleted port mapping: %v", err)
+	}
+	err = c.DeletePortMapping(port, nil)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("delete missing port mapping: %v", err)
+	}
+
+	for _, path := range []string{apiV1Prefix + "/openapi.json", dashboardPath} {
+		resp, err := http.Get(server + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("%s without token: %s", path, resp.Status)
+		}
+	}
+}
+
+func TestOpenAPIDescribesAllRoutes(t *testing.T) {
+	doc := struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}{}
+	err := json.Unmarshal([]byte(openAPIV1), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := mux.NewRouter()
+	(&Httpd{}).registerAPIV1(m)
+	err = m.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, apiV1Prefix+"/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		path = strings.Replace(strings.TrimPrefix(path, apiV1Prefix), "{port:[0-9]+}", "{port}", -1)
+		for _, method := range methods {
+			if _, found := doc.Paths[path][strings.ToLower(method)]; !found {
+				t.Errorf("%s %s not described", method, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientDrainTimeout(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	server, stop := startTestHttpd(t, p, "")
+	defer stop()
+	c, _ := NewClient(server)
+
+	port := freePort(t)
+	err := c.AddPortMapping(&PortMappingInfo{LocalPort: port, RemoteAddr: echo.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dialAndEcho(t, port)
+	defer conn.Close()
+
+	// would be sent as 0, drain forever
+	err = c.DeletePortMapping(port, &StopOptions{Drain: true, DrainTimeout: 500 * time.Millisecond})
+	if err != ErrInvalidDrainTimeout {
+		t.Errorf("sub-second drain timeout: %v", err)
+	}
+	if _, err := p.GetPortMapping(port); err != nil {
+		t.Fatalf("mapping deleted: %v", err)
+	}
+	_, err = c.ApplyConfig(&Config{}, &StopOptions{Drain: true, DrainTimeout: 200 * time.Millisecond}, false)
+	if err != ErrInvalidDrainTimeout {
+		t.Errorf("sub-second drain timeout of apply: %v", err)
+	}
+	if _, err := p.GetPortMapping(port); err != nil {
+		t.Fatalf("mapping removed by apply: %v", err)
+	}
+
+	start := time.Now()
+	err = c.DeletePortMapping(port, &StopOptions{Drain: true, DrainTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("drained for %v", d)
+	}
+	waitClosed(t, conn)
+}
+
+func TestAPIV1StoreFailure(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	s, err := NewStore(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewHttpd(p, s).Serv(l)
+	c, _ := NewClient("http://" + l.Addr().String())
+
+	port := freePort(t)
+	pm := &PortMappingInfo{LocalPort: port, RemoteAddr: echo.Addr().String()}
+	pm.MaxConns = 5
+	err = c.AddPortMapping(pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every change of the proxy is undone when it can't be saved
+	s.db.Close()
+	if err := c.DisablePortMapping(port); err == nil {
+		t.Error("disabled without saving")
+	}
+	err = c.SetPortMappingLimits(port, &PortMappingLimits{MaxConns: 1})
+	if err == nil {
+		t.Error("limits set without saving")
+	}
+	if err := c.DeletePortMapping(port, nil); err == nil {
+		t.Error("deleted without saving")
+	}
+
+	info, err := p.GetPortMapping(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsEnabled() || !info.Running || info.MaxConns != 5 {
+		t.Errorf("mapping changed: %+v", info)
+	}
+	dialAndEcho(t, port).Close()
+}
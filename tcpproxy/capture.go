@@ -0,0 +1,492 @@
+package tcpproxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrCaptureRunning      = errors.New("capture already running")
+	ErrCaptureNotFound     = errors.New("capture not found")
+	ErrCaptureNotSupported = errors.New("capture not supported for http port mapping")
+	ErrInvalidCaptureFile  = errors.New("capture file must be a file name in the capture dir")
+)
+
+const (
+	pcapngLinkTypeRaw = 101
+	// payload of one synthesized segment, keeps the IPv4 total length valid
+	pcapngMaxSegment = 65000
+)
+
+// validateCapture fills the defaults of info and places its file in dir.
+// Only bare file names are accepted, so a capture can't overwrite files
+// elsewhere on the server.
+func validateCapture(info *CaptureInfo, dir string) error {
+	switch info.Format {
+	case "":
+		info.Format = CaptureFormatPcapng
+	case CaptureFormatPcapng, CaptureFormatHexdump:
+	default:
+		return fmt.Errorf("unknown capture format: %s", info.Format)
+	}
+
+	if info.MaxBytes < 0 || info.Duration < 0 {
+		return errors.New("invalid capture limit")
+	}
+
+	name := info.File
+	if name == "" {
+		name = fmt.Sprintf("tcpproxy-%d-%s.%s", info.LocalPort,
+			time.Now().Format("20060102-150405"), info.Format)
+	} else if filepath.Base(name) != name || name == "." || name == ".." {
+		return ErrInvalidCaptureFile
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	info.File = filepath.Join(dir, name)
+	return nil
+}
+
+// captureWriter encodes the traffic of captured connections. Calls are
+// serialized by capture.
+type captureWriter interface {
+	open(c *connCapture, t time.Time) error
+	data(c *connCapture, up bool, t time.Time, p []byte) error
+	fin(c *connCapture, up bool, t time.Time) error
+}
+
+// capture records the connections of one port mapping to a file until it's
+// stopped or reaches its limits.
+type capture struct {
+	info   CaptureInfo
+	onStop func(c *capture)
+
+	mu     sync.Mutex
+	f      *os.File
+	w      captureWriter
+	nextId uint64
+	bytes  int64
+	closed bool
+	timer  *time.Timer
+}
+
+// newCapture creates the capture file, which must not exist, onStop is
+// called once the capture stops by itself.
+func newCapture(info *CaptureInfo, onStop func(c *capture)) (*capture, error) {
+	f, err := os.OpenFile(info.File, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &capture{
+		info:   *info,
+		onStop: onStop,
+		f:      f,
+	}
+	c.info.StartTime = time.Now()
+
+	if info.Format == CaptureFormatHexdump {
+		c.w = &hexdumpWriter{w: f}
+	} else {
+		c.w, err = newPcapngWriter(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if info.Duration > 0 {
+		c.timer = time.AfterFunc(time.Duration(info.Duration)*time.Second, c.expire)
+	}
+
+	log.Infof("start capture :%d to %s", info.LocalPort, info.File)
+	return c, nil
+}
+
+func (c *capture) expire() {
+	if c.close() {
+		c.mu.Lock()
+		onStop := c.onStop
+		c.mu.Unlock()
+		onStop(c)
+	}
+}
+
+// setOnStop replaces onStop when the capture moves to another port mapping.
+func (c *capture) setOnStop(onStop func(c *capture)) {
+	c.mu.Lock()
+	c.onStop = onStop
+	c.mu.Unlock()
+}
+
+// close closes the capture file, it returns false if already closed.
+func (c *capture) close() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.f.Close()
+	log.Infof("stop capture :%d, %d bytes recorded to %s",
+		c.info.LocalPort, c.bytes, c.info.File)
+	return true
+}
+
+func (c *capture) snapshot() *CaptureInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := c.info
+	info.Bytes = c.bytes
+	return &info
+}
+
+// record runs fn on the writer unless the capture is closed, and stops the
+// capture on write errors or once MaxBytes is reached.
+func (c *capture) record(n int, fn func(w captureWriter, t time.Time) error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+
+	err := fn(c.w, time.Now())
+	c.bytes += int64(n)
+	full := c.info.MaxBytes > 0 && c.bytes >= c.info.MaxBytes
+	c.mu.Unlock()
+
+	if err != nil {
+		log.Errorf("capture :%d: %v", c.info.LocalPort, err)
+	}
+	if err != nil || full {
+		c.expire()
+	}
+}
+
+// newConn starts recording a connection between client and remote.
+func (c *capture) newConn(client, remote net.Addr) *connCapture {
+	c.mu.Lock()
+	c.nextId++
+	cc := &connCapture{
+		c:      c,
+		id:     c.nextId,
+		client: tcpAddrOf(client),
+		remote: tcpAddrOf(remote),
+	}
+	c.mu.Unlock()
+
+	c.record(0, func(w captureWriter, t time.Time) error {
+		return w.open(cc, t)
+	})
+	return cc
+}
+
+func tcpAddrOf(addr net.Addr) *net.TCPAddr {
+	if a, ok := addr.(*net.TCPAddr); ok && a.IP.To4() != nil {
+		return a
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// connCapture records one connection. Its methods accept a nil receiver,
+// which records nothing.
+type connCapture struct {
+	c      *capture
+	id     uint64
+	client *net.TCPAddr
+	remote *net.TCPAddr
+
+	// next sequence number of each direction, guarded by capture.mu
+	seqUp   uint32
+	seqDown uint32
+}
+
+// data records p read from the client (up) or from the remote.
+func (cc *connCapture) data(up bool, p []byte) {
+	if cc == nil || len(p) == 0 {
+		return
+	}
+	cc.c.record(len(p), func(w captureWriter, t time.Time) error {
+		return w.data(cc, up, t, p)
+	})
+}
+
+// fin records the end of one direction.
+func (cc *connCapture) fin(up bool) {
+	if cc == nil {
+		return
+	}
+	cc.c.record(0, func(w captureWriter, t time.Time) error {
+		return w.fin(cc, up, t)
+	})
+}
+
+func (cc *connCapture) direction(up bool) string {
+	if up {
+		return fmt.Sprintf("%v -> %v", cc.client, cc.remote)
+	}
+	return fmt.Sprintf("%v -> %v", cc.remote, cc.client)
+}
+
+// hexdumpWriter writes a timestamped hex dump of each read.
+type hexdumpWriter struct {
+	w io.Writer
+}
+
+const hexdumpTimeFormat = "2006-01-02 15:04:05.000000"
+
+func (h *hexdumpWriter) open(c *connCapture, t time.Time) error {
+	_, err := fmt.Fprintf(h.w, "%s #%d open %s\n\n",
+		t.Format(hexdumpTimeFormat), c.id, c.direction(true))
+	return err
+}
+
+func (h *hexdumpWriter) data(c *connCapture, up bool, t time.Time, p []byte) error {
+	_, err := fmt.Fprintf(h.w, "%s #%d %s (%d bytes)\n%s\n",
+		t.Format(hexdumpTimeFormat), c.id, c.direction(up), len(p), hex.Dump(p))
+	return err
+}
+
+func (h *hexdumpWriter) fin(c *connCapture, up bool, t time.Time) error {
+	_, err := fmt.Fprintf(h.w, "%s #%d %s closed\n\n",
+		t.Format(hexdumpTimeFormat), c.id, c.direction(up))
+	return err
+}
+
+// pcapngWriter writes raw IPv4 packets, synthesizing a TCP handshake, one
+// segment per read and a FIN per direction, so tools can follow the
+// streams. Addresses are those of the client and remote connections.
+type pcapngWriter struct {
+	w    io.Writer
+	ipId uint16
+}
+
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	// section header block, little endian, unknown section length
+	shb := make([]byte, 28)
+	le := binary.LittleEndian
+	le.PutUint32(shb[0:], 0x0A0D0D0A)
+	le.PutUint32(shb[4:], 28)
+	le.PutUint32(shb[8:], 0x1A2B3C4D)
+	le.PutUint16(shb[12:], 1)
+	le.PutUint16(shb[14:], 0)
+	le.PutUint64(shb[16:], 0xFFFFFFFFFFFFFFFF)
+	le.PutUint32(shb[24:], 28)
+
+	// interface description block, microsecond timestamps by default
+	idb := make([]byte, 20)
+	le.PutUint32(idb[0:], 1)
+	le.PutUint32(idb[4:], 20)
+	le.PutUint16(idb[8:], pcapngLinkTypeRaw)
+	le.PutUint32(idb[12:], 0)
+	le.PutUint32(idb[16:], 20)
+
+	_, err := w.Write(append(shb, idb...))
+	if err != nil {
+		return nil, err
+	}
+	return &pcapngWriter{w: w}, nil
+}
+
+const (
+	tcpFlagFin = 0x01
+	tcpFlagSyn = 0x02
+	tcpFlagPsh = 0x08
+	tcpFlagAck = 0x10
+)
+
+func (pw *pcapngWriter) open(c *connCapture, t time.Time) error {
+	err := pw.segment(c, true, tcpFlagSyn, nil, t)
+	if err != nil {
+		return err
+	}
+	err = pw.segment(c, false, tcpFlagSyn|tcpFlagAck, nil, t)
+	if err != nil {
+		return err
+	}
+	return pw.segment(c, true, tcpFlagAck, nil, t)
+}
+
+func (pw *pcapngWriter) data(c *connCapture, up bool, t time.Time, p []byte) error {
+	for len(p) > 0 {
+		n := len(p)
+		if n > pcapngMaxSegment {
+			n = pcapngMaxSegment
+		}
+		err := pw.segment(c, up, tcpFlagPsh|tcpFlagAck, p[:n], t)
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func (pw *pcapngWriter) fin(c *connCapture, up bool, t time.Time) error {
+	return pw.segment(c, up, tcpFlagFin|tcpFlagAck, nil, t)
+}
+
+// segment writes one TCP segment as an enhanced packet block and advances
+// the sequence number of its direction.
+func (pw *pcapngWriter) segment(c *connCapture, up bool, flags uint8,
+	payload []byte, t time.Time) error {
+	src, dst := c.client, c.remote
+	seq, ack := &c.seqUp, &c.seqDown
+	if !up {
+		src, dst = c.remote, c.client
+		seq, ack = &c.seqDown, &c.seqUp
+	}
+
+	be := binary.BigEndian
+	pkt := make([]byte, 40+len(payload))
+
+	ip := pkt[:20]
+	ip[0] = 0x45
+	be.PutUint16(ip[2:], uint16(len(pkt)))
+	pw.ipId++
+	be.PutUint16(ip[4:], pw.ipId)
+	be.PutUint16(ip[6:], 0x4000)
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:16], src.IP.To4())
+	copy(ip[16:20], dst.IP.To4())
+	be.PutUint16(ip[10:], checksum(ip, 0))
+
+	tcp := pkt[20:]
+	be.PutUint16(tcp[0:], uint16(src.Port))
+	be.PutUint16(tcp[2:], uint16(dst.Port))
+	be.PutUint32(tcp[4:], *seq)
+	if flags&tcpFlagAck != 0 {
+		be.PutUint32(tcp[8:], *ack)
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	be.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	// pseudo header: addresses, protocol and TCP length
+	var sum uint32
+	for i := 12; i < 20; i += 2 {
+		sum += uint32(be.Uint16(ip[i:]))
+	}
+	sum += 6 + uint32(len(tcp))
+	be.PutUint16(tcp[16:], checksum(tcp, sum))
+
+	*seq += uint32(len(payload))
+	if flags&(tcpFlagSyn|tcpFlagFin) != 0 {
+		*seq++
+	}
+
+	return pw.writePacket(pkt, t)
+}
+
+func (pw *pcapngWriter) writePacket(pkt []byte, t time.Time) error {
+	padded := (len(pkt) + 3) &^ 3
+	total := 32 + padded
+	block := make([]byte, total)
+
+	le := binary.LittleEndian
+	ts := uint64(t.UnixNano() / int64(time.Microsecond))
+	le.PutUint32(block[0:], 6)
+	le.PutUint32(block[4:], uint32(total))
+	le.PutUint32(block[8:], 0)
+	le.PutUint32(block[12:], uint32(ts>>32))
+	le.PutUint32(block[16:], uint32(ts))
+	le.PutUint32(block[20:], uint32(len(pkt)))
+	le.PutUint32(block[24:], uint32(len(pkt)))
+	copy(block[28:], pkt)
+	le.PutUint32(block[total-4:], uint32(total))
+
+	_, err := pw.w.Write(block)
+	return err
+}
+
+// checksum returns the internet checksum of b added to sum.
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// startCapture starts recording new connections of the port mapping.
+func (m *portMapping) startCapture(info *CaptureInfo) error {
+	if m.http != nil {
+		return ErrCaptureNotSupported
+	}
+
+	m.captureMu.Lock()
+	defer m.captureMu.Unlock()
+
+	if m.capture != nil {
+		return ErrCaptureRunning
+	}
+
+	c, err := newCapture(info, m.removeCapture)
+	if err != nil {
+		return err
+	}
+	m.capture = c
+	return nil
+}
+
+// removeCapture forgets c once it stopped by itself.
+func (m *portMapping) removeCapture(c *capture) {
+	m.captureMu.Lock()
+	defer m.captureMu.Unlock()
+
+	if m.capture == c {
+		m.capture = nil
+	}
+}
+
+func (m *portMapping) stopCapture() error {
+	m.captureMu.Lock()
+	c := m.capture
+	m.capture = nil
+	m.captureMu.Unlock()
+
+	if c == nil {
+		return ErrCaptureNotFound
+	}
+	c.close()
+	return nil
+}
+
+func (m *portMapping) getCapture() *capture {
+	m.captureMu.Lock()
+	defer m.captureMu.Unlock()
+	return m.capture
+}
+
+// captureConn returns the recorder of a new connection, nil if the port
+// mapping isn't being captured.
+func (m *portMapping) captureConn(client, remote net.Addr) *connCapture {
+	c := m.getCapture()
+	if c == nil {
+		return nil
+	}
+	return c.newConn(client, remote)
+}
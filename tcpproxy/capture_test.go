@@ -0,0 +1,164 @@
+package tcpproxy
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureHexdump(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTestPortMapping(t, p, echo)
+	dir := t.TempDir()
+	p.SetCaptureDir(dir)
+
+	file := filepath.Join(dir, "capture.txt")
+	err := p.StartCapture(&CaptureInfo{
+		LocalPort: port,
+		Format:    CaptureFormatHexdump,
+		File:      "capture.txt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.StartCapture(&CaptureInfo{LocalPort: port}); err != ErrCaptureRunning {
+		t.Fatalf("second capture: %v", err)
+	}
+
+	c := dialAndEcho(t, port)
+	c.Close()
+
+	list := p.ListCaptures()
+	if len(list) != 1 || list[0].Bytes != 10 {
+		t.Fatalf("unexpected captures: %+v", list)
+	}
+	if err := p.StopCapture(port); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "hello" in hex, once per direction
+	if n := strings.Count(string(data), "68 65 6c 6c 6f"); n != 2 {
+		t.Errorf("payload recorded %d times:\n%s", n, data)
+	}
+}
+
+func TestCapturePcapng(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTestPortMapping(t, p, echo)
+	dir := t.TempDir()
+	p.SetCaptureDir(dir)
+
+	file := filepath.Join(dir, "capture.pcapng")
+	err := p.StartCapture(&CaptureInfo{
+		LocalPort: port,
+		File:      "capture.pcapng",
+		MaxBytes:  5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialAndEcho(t, port)
+	c.Close()
+
+	// the capture stops by itself once MaxBytes is reached
+	deadline := time.Now().Add(2 * time.Second)
+	for len(p.ListCaptures()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("capture still running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	le := binary.LittleEndian
+	var packets [][]byte
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block")
+		}
+		typ, size := le.Uint32(data), le.Uint32(data[4:])
+		if le.Uint32(data[size-4:]) != size {
+			t.Fatalf("bad block length")
+		}
+		if typ == 6 {
+			packets = append(packets, data[28:28+le.Uint32(data[20:])])
+		}
+		data = data[size:]
+	}
+
+	// SYN, SYN-ACK, ACK and the data read from the client
+	if len(packets) != 4 {
+		t.Fatalf("%d packets recorded", len(packets))
+	}
+	if flags := packets[0][33]; flags != tcpFlagSyn {
+		t.Errorf("first packet flags: %#x", flags)
+	}
+	if payload := string(packets[3][40:]); payload != "hello" {
+		t.Errorf("payload: %q", payload)
+	}
+	if checksum(packets[3][:20], 0) != 0 {
+		t.Errorf("bad ip checksum")
+	}
+}
+
+func TestCaptureFile(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTestPortMapping(t, p, echo)
+	dir := t.TempDir()
+	p.SetCaptureDir(dir)
+
+	for _, file := range []string{"/etc/passwd", "../data.db", "sub/capture.txt", ".", ".."} {
+		err := p.StartCapture(&CaptureInfo{LocalPort: port, File: file})
+		if err != ErrInvalidCaptureFile {
+			t.Errorf("capture to %s: %v", file, err)
+		}
+	}
+
+	// an existing file is never overwritten
+	existing := filepath.Join(dir, "existing")
+	if err := ioutil.WriteFile(existing, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := p.StartCapture(&CaptureInfo{LocalPort: port, File: "existing"})
+	if !os.IsExist(err) {
+		t.Errorf("capture to existing file: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(existing); string(data) != "keep" {
+		t.Errorf("existing file overwritten: %q", data)
+	}
+
+	info := &CaptureInfo{LocalPort: port}
+	err = p.StartCapture(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.StopCapture(port)
+	if filepath.Dir(info.File) != dir {
+		t.Errorf("default file %s not in %s", info.File, dir)
+	}
+}
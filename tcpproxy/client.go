@@ -1,37 +1,143 @@
 package tcpproxy
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/MoZhonghua/mytools/util"
 )
 
+// the server counts drain timeouts in whole seconds, where 0 means forever
+var ErrInvalidDrainTimeout = errors.New("drain timeout must be whole seconds")
+
+// drainQuery returns the query of opts for the server, empty unless
+// draining.
+func drainQuery(opts *StopOptions) (string, error) {
+	if opts == nil || !opts.Drain {
+		return "", nil
+	}
+	if opts.DrainTimeout < 0 || opts.DrainTimeout%time.Second != 0 {
+		return "", ErrInvalidDrainTimeout
+	}
+	return fmt.Sprintf("mode=drain&timeout=%d", opts.DrainTimeout/time.Second), nil
+}
+
+type ClientConfig struct {
+	// Token is sent as a bearer token if not empty, see Httpd.SetAuthToken
+	Token string
+	HTTP  util.HttpClientConfig
+}
+
 type Client struct {
 	server string
+	http   *util.HttpClient
 }
 
 func NewClient(server string) (*Client, error) {
+	return NewClientWithConfig(server, &ClientConfig{})
+}
+
+func NewClientWithConfig(server string, cfg *ClientConfig) (*Client, error) {
+	httpCfg := cfg.HTTP
+	if cfg.Token != "" {
+		httpCfg.Header = http.Header{}
+		for k, v := range cfg.HTTP.Header {
+			httpCfg.Header[k] = v
+		}
+		httpCfg.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+
+	hc, err := util.NewHttpClient(&httpCfg)
+	if err != nil {
+		return nil, err
+	}
+
 	c := &Client{
 		server: server,
+		http:   hc,
 	}
 	return c, nil
 }
 
-func (c *Client) AddPortMapping(localPort int, remoteAddr string) error {
-	resp := &util.GenericJsonResp{}
-	req := &PortMappingInfo{
-		LocalPort:  localPort,
-		RemoteAddr: remoteAddr,
+func mappingPath(localPort int, action string) string {
+	return fmt.Sprintf("%s/mappings/%d%s", apiV1Prefix, localPort, action)
+}
+
+type portMappingResp struct {
+	util.GenericJsonResp
+	Data *PortMappingInfo `json:"data"`
+}
+
+// AddPortMapping creates a port mapping, it fails with 409 if the local
+// port is used.
+func (c *Client) AddPortMapping(pm *PortMappingInfo) error {
+	resp := &portMappingResp{}
+	url := util.JoinURL(c.server, apiV1Prefix+"/mappings")
+	return c.http.DoJsonRequestAndParseResult("POST", url, pm, resp)
+}
+
+// UpdatePortMapping replaces the config of a port mapping, or creates it,
+// and returns its updated config. The listener of a running mapping isn't
+// closed, established connections stay on their remote.
+func (c *Client) UpdatePortMapping(pm *PortMappingInfo) (*PortMappingInfo, error) {
+	resp := &portMappingResp{}
+	url := util.JoinURL(c.server, mappingPath(pm.LocalPort, ""))
+	err := c.http.DoJsonRequestAndParseResult("PUT", url, pm, resp)
+	if err != nil {
+		return nil, err
 	}
+	return resp.Data, nil
+}
+
+func (c *Client) GetPortMapping(localPort int) (*PortMappingInfo, error) {
+	resp := &portMappingResp{}
+	url := util.JoinURL(c.server, mappingPath(localPort, ""))
+	err := c.http.DoRequestParseResult("GET", url, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (c *Client) EnablePortMapping(localPort int) error {
+	resp := &util.GenericJsonResp{}
+	url := util.JoinURL(c.server, mappingPath(localPort, "/enable"))
+	return c.http.DoRequestParseResult("POST", url, resp)
+}
 
-	url := util.JoinURL(c.server, "/add")
-	return util.DefaultHttpClient.DoJsonPostAndParseResult(url, req, resp)
+func (c *Client) DisablePortMapping(localPort int) error {
+	resp := &util.GenericJsonResp{}
+	url := util.JoinURL(c.server, mappingPath(localPort, "/disable"))
+	return c.http.DoRequestParseResult("POST", url, resp)
 }
 
-func (c *Client) DeletePortMapping(localPort int) error {
+// SetPortMappingLimits replaces the access lists and limits of a port
+// mapping.
+func (c *Client) SetPortMappingLimits(localPort int, limits *PortMappingLimits) error {
 	resp := &util.GenericJsonResp{}
-	url := util.JoinURL(c.server, fmt.Sprintf("/delete?localPort=%d", localPort))
-	return util.DefaultHttpClient.DoRequestParseResult("DELETE", url, resp)
+	url := util.JoinURL(c.server, mappingPath(localPort, "/limits"))
+	return c.http.DoJsonRequestAndParseResult("PUT", url, limits, resp)
+}
+
+// DeletePortMapping deletes a port mapping, established connections are
+// closed immediately if opts is nil. It fails with ErrInvalidDrainTimeout
+// unless the drain timeout is whole seconds.
+func (c *Client) DeletePortMapping(localPort int, opts *StopOptions) error {
+	query, err := drainQuery(opts)
+	if err != nil {
+		return err
+	}
+
+	resp := &util.GenericJsonResp{}
+	path := mappingPath(localPort, "")
+	if query != "" {
+		path += "?" + query
+	}
+	url := util.JoinURL(c.server, path)
+	return c.http.DoRequestParseResult("DELETE", url, resp)
 }
 
 type portMappingListResp struct {
@@ -41,8 +147,185 @@ type portMappingListResp struct {
 
 func (c *Client) ListPortMapping() ([]*PortMappingInfo, error) {
 	resp := &portMappingListResp{}
-	url := util.JoinURL(c.server, "/list")
-	err := util.DefaultHttpClient.DoRequestParseResult("GET", url, resp)
+	url := util.JoinURL(c.server, apiV1Prefix+"/mappings")
+	err := c.http.DoRequestParseResult("GET", url, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+type connectionListResp struct {
+	util.GenericJsonResp
+	Data []*ConnectionInfo `json:"data"`
+}
+
+func (c *Client) ListConnections(localPort int) ([]*ConnectionInfo, error) {
+	resp := &connectionListResp{}
+	url := util.JoinURL(c.server, mappingPath(localPort, "/connections"))
+	err := c.http.DoRequestParseResult("GET", url, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (c *Client) AddSNIRoute(route *SNIRoute) error {
+	resp := &util.GenericJsonResp{}
+	url := util.JoinURL(c.server, "/sni/add")
+	return c.http.DoJsonPostAndParseResult(url, route, resp)
+}
+
+func (c *Client) DeleteSNIRoute(localPort int, hostname string) error {
+	resp := &util.GenericJsonResp{}
+	path := fmt.Sprintf("/sni/delete?localPort=%d&hostname=%s",
+		localPort, url.QueryEscape(hostname))
+	return c.http.DoRequestParseResult("DELETE",
+		util.JoinURL(c.server, path), resp)
+}
+
+type sniRouteListResp struct {
+	util.GenericJsonResp
+	Data []*SNIRoute `json:"data"`
+}
+
+func (c *Client) ListSNIRoute(localPort int) ([]*SNIRoute, error) {
+	resp := &sniRouteListResp{}
+	url := util.JoinURL(c.server, fmt.Sprintf("/sni/list?localPort=%d", localPort))
+	err := c.http.DoRequestParseResult("GET", url, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (c *Client) AddHTTPRoute(route *HTTPRoute) error {
+	resp := &util.GenericJsonResp{}
+	url := util.JoinURL(c.server, "/http/add")
+	return c.http.DoJsonPostAndParseResult(url, route, resp)
+}
+
+func (c *Client) DeleteHTTPRoute(localPort int, host string, pathPrefix string) error {
+	resp := &util.GenericJsonResp{}
+	path := fmt.Sprintf("/http/delete?localPort=%d&host=%s&pathPrefix=%s",
+		localPort, url.QueryEscape(host), url.QueryEscape(pathPrefix))
+	return c.http.DoRequestParseResult("DELETE",
+		util.JoinURL(c.server, path), resp)
+}
+
+type httpRouteListResp struct {
+	util.GenericJsonResp
+	Data []*HTTPRoute `json:"data"`
+}
+
+func (c *Client) ListHTTPRoute(localPort int) ([]*HTTPRoute, error) {
+	resp := &httpRouteListResp{}
+	url := util.JoinURL(c.server, fmt.Sprintf("/http/list?localPort=%d", localPort))
+	err := c.http.DoRequestParseResult("GET", url, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+type captureResp struct {
+	util.GenericJsonResp
+	Data *CaptureInfo `json:"data"`
+}
+
+// StartCapture starts a capture and returns it with the defaults filled,
+// e.g. the file written on the server.
+func (c *Client) StartCapture(info *CaptureInfo) (*CaptureInfo, error) {
+	resp := &captureResp{}
+	url := util.JoinURL(c.server, "/capture/start")
+	err := c.http.DoJsonPostAndParseResult(url, info, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (c *Client) StopCapture(localPort int) error {
+	resp := &util.GenericJsonResp{}
+	url := util.JoinURL(c.server, fmt.Sprintf("/capture/stop?localPort=%d", localPort))
+	return c.http.DoRequestParseResult("POST", url, resp)
+}
+
+type captureListResp struct {
+	util.GenericJsonResp
+	Data []*CaptureInfo `json:"data"`
+}
+
+func (c *Client) ListCaptures() ([]*CaptureInfo, error) {
+	resp := &captureListResp{}
+	url := util.JoinURL(c.server, "/capture/list")
+	err := c.http.DoRequestParseResult("GET", url, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+type toxicResp struct {
+	util.GenericJsonResp
+	Data *ToxicInfo `json:"data"`
+}
+
+// AddToxic adds a toxic and returns it with its default name filled.
+func (c *Client) AddToxic(toxic *ToxicInfo) (*ToxicInfo, error) {
+	resp := &toxicResp{}
+	url := util.JoinURL(c.server, "/toxic/add")
+	err := c.http.DoJsonPostAndParseResult(url, toxic, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (c *Client) DeleteToxic(localPort int, name string) error {
+	resp := &util.GenericJsonResp{}
+	path := fmt.Sprintf("/toxic/delete?localPort=%d&name=%s",
+		localPort, url.QueryEscape(name))
+	return c.http.DoRequestParseResult("DELETE",
+		util.JoinURL(c.server, path), resp)
+}
+
+type toxicListResp struct {
+	util.GenericJsonResp
+	Data []*ToxicInfo `json:"data"`
+}
+
+func (c *Client) ListToxics(localPort int) ([]*ToxicInfo, error) {
+	resp := &toxicListResp{}
+	url := util.JoinURL(c.server, fmt.Sprintf("/toxic/list?localPort=%d", localPort))
+	err := c.http.DoRequestParseResult("GET", url, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+type configDiffResp struct {
+	util.GenericJsonResp
+	Data *ConfigDiff `json:"data"`
+}
+
+// ApplyConfig makes the server run exactly the port mappings of cfg and
+// returns what changed. With dryRun nothing is changed. It fails with
+// ErrInvalidDrainTimeout unless the drain timeout is whole seconds.
+func (c *Client) ApplyConfig(cfg *Config, opts *StopOptions, dryRun bool) (*ConfigDiff, error) {
+	query, err := drainQuery(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &configDiffResp{}
+	path := fmt.Sprintf("%s/apply?dryRun=%v", apiV1Prefix, dryRun)
+	if query != "" {
+		path += "&" + query
+	}
+	url := util.JoinURL(c.server, path)
+	err = c.http.DoJsonPostAndParseResult(url, cfg, resp)
 	if err != nil {
 		return nil, err
 	}
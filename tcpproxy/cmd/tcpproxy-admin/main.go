@@ -6,7 +6,10 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/MoZhonghua/mytools/tcpproxy"
 	"github.com/MoZhonghua/mytools/util"
@@ -15,6 +18,7 @@ import (
 
 var debug bool
 var server string
+var token string
 
 func marshalData(v interface{}) string {
 	b, _ := json.MarshalIndent(v, "", "    ")
@@ -41,6 +45,136 @@ func showHelp(c *cli.Context) {
 
 var logger = log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)
 
+var limitFlags = []cli.Flag{
+	&cli.StringSliceFlag{
+		Name:  "allow",
+		Usage: "only accept clients in this CIDR or IP (repeatable)",
+	},
+	&cli.StringSliceFlag{
+		Name:  "deny",
+		Usage: "reject clients in this CIDR or IP (repeatable)",
+	},
+	&cli.IntFlag{
+		Name:  "max-conns",
+		Usage: "maximum concurrent connections, 0 means no limit",
+	},
+	&cli.Float64Flag{
+		Name:  "rate-limit",
+		Usage: "new connections per second from one client IP, 0 means no limit",
+	},
+	&cli.DurationFlag{
+		Name:  "idle-timeout",
+		Usage: "close connections without traffic for this long, in whole seconds, 0 means never",
+	},
+}
+
+// mappingFlags configure the port mapping of add and update.
+var mappingFlags = append([]cli.Flag{
+	&cli.StringFlag{
+		Name:  "type",
+		Usage: "tcp, sni to route by TLS server name, http to route by Host header (remoteAddr optional for sni and http) or transparent to forward iptables redirected connections (no remoteAddr)",
+		Value: tcpproxy.PortMappingTypeTCP,
+	},
+	&cli.StringFlag{
+		Name:  "balance",
+		Usage: "roundrobin, random, leastconn or failover when more than one remoteAddr is given",
+	},
+	&cli.IntFlag{
+		Name:  "health-interval",
+		Usage: "probe remotes every N seconds, 0 disables health checks",
+	},
+	&cli.IntFlag{
+		Name:  "health-timeout",
+		Usage: "health check connect timeout in seconds",
+	},
+	&cli.BoolFlag{
+		Name:  "tproxy",
+		Usage: "transparent port mapping receives connections from the TPROXY target instead of REDIRECT",
+	},
+	&cli.StringSliceFlag{
+		Name:  "destination",
+		Usage: "transparent port mapping only forwards to this CIDR or IP (repeatable)",
+	},
+	&cli.StringFlag{
+		Name:  "mirror",
+		Usage: "copy client data to this shadow remoteAddr(host:port), its responses are discarded",
+	},
+	&cli.IntFlag{
+		Name:  "mirror-buffer",
+		Usage: "bytes queued for a slow mirror before dropping, 0 means 1MB",
+	},
+	&cli.StringSliceFlag{
+		Name:  "upstream",
+		Usage: "connect to remotes through proxy socks5://[user:pass@]host:port or http://host:port (repeatable, in chain order)",
+	},
+	&cli.BoolFlag{
+		Name:  "disabled",
+		Usage: "add the port mapping without starting it",
+	},
+	&cli.StringSliceFlag{
+		Name:  "schedule",
+		Usage: "only enable the port mapping in time window hh:mm-hh:mm (repeatable)",
+	},
+	&cli.StringFlag{
+		Name:  "tls-cert",
+		Usage: "terminate TLS on local port with this certificate file",
+	},
+	&cli.StringFlag{
+		Name:  "tls-key",
+		Usage: "private key file of --tls-cert",
+	},
+	&cli.BoolFlag{
+		Name:  "remote-tls",
+		Usage: "connect to remote address with TLS",
+	},
+	&cli.StringFlag{
+		Name:  "remote-sni",
+		Usage: "server name sent to remote, default to host of remoteAddr",
+	},
+	&cli.StringFlag{
+		Name:  "remote-ca",
+		Usage: "CA bundle to verify remote certificate, default to system roots",
+	},
+	&cli.BoolFlag{
+		Name:  "remote-insecure",
+		Usage: "don't verify remote certificate",
+	},
+}, limitFlags...)
+
+func parseLimits(c *cli.Context) (tcpproxy.PortMappingLimits, error) {
+	limits := tcpproxy.PortMappingLimits{}
+	err := applyLimitFlags(c, &limits, true)
+	return limits, err
+}
+
+// applyLimitFlags sets limits from limitFlags, only those given on the
+// command line unless all is set.
+func applyLimitFlags(c *cli.Context, limits *tcpproxy.PortMappingLimits, all bool) error {
+	set := func(name string) bool { return all || c.IsSet(name) }
+
+	if set("idle-timeout") {
+		// the server counts the idle timeout in seconds, where 0 means never
+		idleTimeout := c.Duration("idle-timeout")
+		if idleTimeout%time.Second != 0 {
+			return fmt.Errorf("idle timeout must be whole seconds: %v", idleTimeout)
+		}
+		limits.IdleTimeout = int(idleTimeout / time.Second)
+	}
+	if set("allow") {
+		limits.Allow = c.StringSlice("allow")
+	}
+	if set("deny") {
+		limits.Deny = c.StringSlice("deny")
+	}
+	if set("max-conns") {
+		limits.MaxConns = c.Int("max-conns")
+	}
+	if set("rate-limit") {
+		limits.RateLimit = c.Float64("rate-limit")
+	}
+	return nil
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Version = "1.0"
@@ -64,6 +198,12 @@ func main() {
 			Value:       "http://127.0.0.1:3333",
 			Destination: &server,
 		},
+		&cli.StringFlag{
+			Name:        "token",
+			Usage:       "admin api token",
+			EnvVar:      "TCPPROXY_TOKEN",
+			Destination: &token,
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -72,6 +212,24 @@ func main() {
 			Usage:  "list port mapping",
 			Action: cmdList,
 		},
+		{
+			Name:   "watch",
+			Usage:  "refresh port mapping list periodically",
+			Action: cmdWatch,
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "interval",
+					Usage: "refresh interval",
+					Value: 2 * time.Second,
+				},
+			},
+		},
+		{
+			Name:      "connections",
+			Usage:     "list live connections of a port mapping",
+			ArgsUsage: "<localPort>",
+			Action:    cmdConnections,
+		},
 		{
 			Name:   "dump",
 			Usage:  "dump port mapping",
@@ -80,14 +238,211 @@ func main() {
 		{
 			Name:      "add",
 			Usage:     "add port mapping",
-			ArgsUsage: "<localPort> <remoteAddr(ip:port)>",
+			ArgsUsage: "<localPort>[-<lastPort>] <remoteAddr(host:port)>...",
 			Action:    cmdAdd,
+			Flags:     mappingFlags,
+		},
+		{
+			Name:      "update",
+			Usage:     "change remotes and the given options of port mapping without closing its listener, established connections stay on their remote",
+			ArgsUsage: "<localPort>[-<lastPort>] [<remoteAddr(host:port)>...]",
+			Action:    cmdUpdate,
+			Flags:     mappingFlags,
+		},
+		{
+			Name:      "limits",
+			Usage:     "replace access lists and limits of port mapping",
+			ArgsUsage: "<localPort>",
+			Action:    cmdLimits,
+			Flags:     limitFlags,
+		},
+		{
+			Name:      "enable",
+			Usage:     "enable port mapping",
+			ArgsUsage: "<localPort>",
+			Action:    cmdEnable,
+		},
+		{
+			Name:      "disable",
+			Usage:     "disable port mapping without deleting it",
+			ArgsUsage: "<localPort>",
+			Action:    cmdDisable,
 		},
 		{
 			Name:      "delete",
 			Usage:     "delete port mapping",
 			ArgsUsage: "<localPort>",
 			Action:    cmdDelete,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "drain",
+					Usage: "wait for established connections to finish",
+				},
+				&cli.DurationFlag{
+					Name:  "drain-timeout",
+					Usage: "close connections still open after this timeout, in whole seconds, 0 means wait forever",
+				},
+			},
+		},
+		{
+			Name:  "sni",
+			Usage: "manage routes of sni port mapping",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "add or replace sni route",
+					ArgsUsage: "<localPort> <hostname|*.domain|*> <remoteAddr(ip:port)>",
+					Action:    cmdSNIAdd,
+				},
+				{
+					Name:      "delete",
+					Usage:     "delete sni route",
+					ArgsUsage: "<localPort> <hostname>",
+					Action:    cmdSNIDelete,
+				},
+				{
+					Name:      "list",
+					Usage:     "list sni routes",
+					ArgsUsage: "<localPort>",
+					Action:    cmdSNIList,
+				},
+			},
+		},
+		{
+			Name:  "http",
+			Usage: "manage routes of http port mapping",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "add or replace http route",
+					ArgsUsage: "<localPort> <host|*.domain|*> <pathPrefix> <remoteAddr(ip:port)>",
+					Action:    cmdHTTPAdd,
+				},
+				{
+					Name:      "delete",
+					Usage:     "delete http route",
+					ArgsUsage: "<localPort> <host> <pathPrefix>",
+					Action:    cmdHTTPDelete,
+				},
+				{
+					Name:      "list",
+					Usage:     "list http routes",
+					ArgsUsage: "<localPort>",
+					Action:    cmdHTTPList,
+				},
+			},
+		},
+		{
+			Name:  "capture",
+			Usage: "record traffic of port mapping to a file on the server",
+			Subcommands: []cli.Command{
+				{
+					Name:      "start",
+					Usage:     "start capture",
+					ArgsUsage: "<localPort>",
+					Action:    cmdCaptureStart,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "format",
+							Usage: "pcapng or hexdump",
+							Value: tcpproxy.CaptureFormatPcapng,
+						},
+						&cli.StringFlag{
+							Name:  "file",
+							Usage: "name of a new file in the capture dir of the server, default to a generated name",
+						},
+						&cli.Int64Flag{
+							Name:  "max-bytes",
+							Usage: "stop after recording this many bytes, 0 means no limit",
+						},
+						&cli.DurationFlag{
+							Name:  "duration",
+							Usage: "stop after this long, in whole seconds, 0 means no limit",
+						},
+					},
+				},
+				{
+					Name:      "stop",
+					Usage:     "stop capture",
+					ArgsUsage: "<localPort>",
+					Action:    cmdCaptureStop,
+				},
+				{
+					Name:   "list",
+					Usage:  "list running captures",
+					Action: cmdCaptureList,
+				},
+			},
+		},
+		{
+			Name:  "toxic",
+			Usage: "inject network faults into port mapping",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "add toxic: latency, bandwidth, reset, stall, slicer or limitdata",
+					ArgsUsage: "<localPort> <type>",
+					Action:    cmdToxicAdd,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "default to type_stream",
+						},
+						&cli.StringFlag{
+							Name:  "stream",
+							Usage: "upstream (client to remote) or downstream, default to both",
+						},
+						&cli.Float64Flag{
+							Name:  "toxicity",
+							Usage: "probability that a connection is affected, 0 means always",
+						},
+						&cli.IntFlag{
+							Name:  "latency",
+							Usage: "latency: delay in ms",
+						},
+						&cli.IntFlag{
+							Name:  "jitter",
+							Usage: "latency: random variation of delay in ms",
+						},
+						&cli.IntFlag{
+							Name:  "rate",
+							Usage: "bandwidth: KB/s",
+						},
+						&cli.IntFlag{
+							Name:  "timeout",
+							Usage: "reset, stall: ms before the connection is reset or closed",
+						},
+						&cli.IntFlag{
+							Name:  "size",
+							Usage: "slicer: average slice size in bytes",
+						},
+						&cli.IntFlag{
+							Name:  "size-variation",
+							Usage: "slicer: random variation of slice size",
+						},
+						&cli.IntFlag{
+							Name:  "delay",
+							Usage: "slicer: delay between slices in microseconds",
+						},
+						&cli.Int64Flag{
+							Name:  "bytes",
+							Usage: "limitdata: close connection after this many bytes",
+						},
+					},
+				},
+				{
+					Name:      "delete",
+					Usage:     "delete toxic",
+					ArgsUsage: "<localPort> <name>",
+					Action:    cmdToxicDelete,
+				},
+				{
+					Name:      "list",
+					Usage:     "list toxics",
+					ArgsUsage: "<localPort>",
+					Action:    cmdToxicList,
+				},
+			},
 		},
 		{
 			Name:      "batch",
@@ -95,6 +450,26 @@ func main() {
 			ArgsUsage: "<file>",
 			Action:    cmdBatch,
 		},
+		{
+			Name:      "apply",
+			Usage:     "make the server run exactly the port mappings of a json, yaml or toml file",
+			ArgsUsage: "<file>",
+			Action:    cmdApply,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only print the changes",
+				},
+				&cli.BoolFlag{
+					Name:  "drain",
+					Usage: "wait for connections of removed and changed mappings to finish",
+				},
+				&cli.DurationFlag{
+					Name:  "drain-timeout",
+					Usage: "close connections still open after this timeout, in whole seconds, 0 means wait forever",
+				},
+			},
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -105,27 +480,211 @@ func main() {
 
 func createClient() *tcpproxy.Client {
 	util.SetHttpClientDebugMode(debug)
-	client, err := tcpproxy.NewClient(server)
+	client, err := tcpproxy.NewClientWithConfig(server, &tcpproxy.ClientConfig{
+		Token: token,
+	})
 	exitOnError(err)
 	return client
 }
 
 func cmdAdd(c *cli.Context) error {
-	if len(c.Args()) < 2 {
+	pm := parseMapping(c)
+	client := createClient()
+	err := client.AddPortMapping(pm)
+	exitOnError(err)
+
+	fmt.Println("OK!")
+	return nil
+}
+
+// cmdUpdate changes the remotes and the options given on the command line
+// of a port mapping, and keeps its other options.
+func cmdUpdate(c *cli.Context) error {
+	if len(c.Args()) < 1 {
 		showHelp(c)
 	}
-	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	localPort, lastPort, err := tcpproxy.ParsePortRange(c.Args()[0])
 	exitOnError(err)
-	remoteAddr := c.Args()[1]
 
 	client := createClient()
-	err = client.AddPortMapping(int(localPort), remoteAddr)
+	pm, err := client.GetPortMapping(localPort)
+	exitOnError(err)
+	if lastPort > localPort {
+		pm.LocalPortEnd = lastPort
+	}
+	setRemotes(c, pm)
+	applyMappingFlags(c, pm, false)
+
+	info, err := client.UpdatePortMapping(pm)
 	exitOnError(err)
 
-	fmt.Println("OK!")
+	printPortMappings([]*tcpproxy.PortMappingInfo{info})
 	return nil
 }
 
+// parseMapping reads the port mapping of add from the args and
+// mappingFlags.
+func parseMapping(c *cli.Context) *tcpproxy.PortMappingInfo {
+	typ := c.String("type")
+	if len(c.Args()) < 2 && !(typ != tcpproxy.PortMappingTypeTCP && len(c.Args()) == 1) {
+		showHelp(c)
+	}
+	// a range maps onto remote ports starting at the port of remoteAddr
+	localPort, lastPort, err := tcpproxy.ParsePortRange(c.Args()[0])
+	exitOnError(err)
+	pm := &tcpproxy.PortMappingInfo{
+		LocalPort: localPort,
+	}
+	if lastPort > localPort {
+		pm.LocalPortEnd = lastPort
+	}
+	setRemotes(c, pm)
+	applyMappingFlags(c, pm, true)
+	return pm
+}
+
+// setRemotes replaces the remotes of pm with the args after the local
+// port, if any.
+func setRemotes(c *cli.Context, pm *tcpproxy.PortMappingInfo) {
+	if len(c.Args()) == 2 {
+		pm.RemoteAddr = c.Args()[1]
+		pm.Remotes = nil
+	} else if len(c.Args()) > 2 {
+		pm.RemoteAddr = ""
+		pm.Remotes = c.Args()[1:]
+	}
+}
+
+// applyMappingFlags sets the options of pm from mappingFlags, only those
+// given on the command line unless all is set.
+func applyMappingFlags(c *cli.Context, pm *tcpproxy.PortMappingInfo, all bool) {
+	set := func(names ...string) bool {
+		for _, name := range names {
+			if all || c.IsSet(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if set("type") {
+		pm.Type = c.String("type")
+	}
+	if set("balance") {
+		pm.Balance = c.String("balance")
+	}
+	if set("health-interval", "health-timeout") {
+		hc := tcpproxy.HealthCheckConfig{}
+		if pm.HealthCheck != nil {
+			hc = *pm.HealthCheck
+		}
+		if set("health-interval") {
+			hc.Interval = c.Int("health-interval")
+		}
+		if set("health-timeout") {
+			hc.Timeout = c.Int("health-timeout")
+		}
+		pm.HealthCheck = nil
+		if hc.Interval > 0 {
+			pm.HealthCheck = &hc
+		}
+	}
+	if set("upstream") {
+		pm.Upstream = c.StringSlice("upstream")
+	}
+	if pm.GetType() != tcpproxy.PortMappingTypeTransparent {
+		pm.Transparent = nil
+	} else if set("type", "tproxy", "destination") {
+		tc := tcpproxy.TransparentConfig{}
+		if pm.Transparent != nil {
+			tc = *pm.Transparent
+		}
+		if set("tproxy") {
+			tc.TProxy = c.Bool("tproxy")
+		}
+		if set("destination") {
+			tc.Destinations = c.StringSlice("destination")
+		}
+		pm.Transparent = &tc
+	}
+	if set("mirror", "mirror-buffer") {
+		mc := tcpproxy.MirrorConfig{}
+		if pm.Mirror != nil {
+			mc = *pm.Mirror
+		}
+		if set("mirror") {
+			mc.RemoteAddr = c.String("mirror")
+		}
+		if set("mirror-buffer") {
+			mc.BufferSize = c.Int("mirror-buffer")
+		}
+		pm.Mirror = nil
+		if mc.RemoteAddr != "" {
+			pm.Mirror = &mc
+		}
+	}
+	if c.Bool("disabled") {
+		pm.SetEnabled(false)
+	}
+	if set("schedule") {
+		pm.Schedule = nil
+		for _, s := range c.StringSlice("schedule") {
+			w, err := parseTimeWindow(s)
+			exitOnError(err)
+			pm.Schedule = append(pm.Schedule, w)
+		}
+	}
+	if set("tls-cert", "tls-key") {
+		tc := tcpproxy.TLSServerConfig{}
+		if pm.TLS != nil {
+			tc = *pm.TLS
+		}
+		if set("tls-cert") {
+			tc.CertFile = c.String("tls-cert")
+		}
+		if set("tls-key") {
+			tc.KeyFile = c.String("tls-key")
+		}
+		pm.TLS = nil
+		if tc.CertFile != "" || tc.KeyFile != "" {
+			pm.TLS = &tc
+		}
+	}
+	if set("remote-tls", "remote-sni", "remote-ca", "remote-insecure") {
+		enabled := pm.RemoteTLS != nil
+		if set("remote-tls") {
+			enabled = c.Bool("remote-tls")
+		}
+		tc := tcpproxy.TLSClientConfig{}
+		if pm.RemoteTLS != nil {
+			tc = *pm.RemoteTLS
+		}
+		if set("remote-sni") {
+			tc.ServerName = c.String("remote-sni")
+		}
+		if set("remote-ca") {
+			tc.CAFile = c.String("remote-ca")
+		}
+		if set("remote-insecure") {
+			tc.InsecureSkipVerify = c.Bool("remote-insecure")
+		}
+		pm.RemoteTLS = nil
+		if enabled {
+			pm.RemoteTLS = &tc
+		}
+	}
+	exitOnError(applyLimitFlags(c, &pm.PortMappingLimits, all))
+}
+
+func parseTimeWindow(s string) (*tcpproxy.TimeWindow, error) {
+	f := strings.Split(s, "-")
+	if len(f) != 2 {
+		return nil, fmt.Errorf("invalid time window: %s", s)
+	}
+
+	return &tcpproxy.TimeWindow{Start: f[0], End: f[1]}, nil
+}
+
 func cmdBatch(c *cli.Context) error {
 	if len(c.Args()) < 1 {
 		showHelp(c)
@@ -141,17 +700,113 @@ func cmdBatch(c *cli.Context) error {
 
 	client := createClient()
 	for _, pm := range list {
-		err := client.AddPortMapping(pm.LocalPort, pm.RemoteAddr)
+		remotes := strings.Join(pm.GetRemotes(), ",")
+		err := client.AddPortMapping(pm)
 		if err != nil {
-			fmt.Printf("%5d -> %s: %v\n", pm.LocalPort, pm.RemoteAddr, err)
+			fmt.Printf("%5s -> %s: %v\n", pm.PortsString(), remotes, err)
 		} else {
-			fmt.Printf("%5d -> %s: OK!\n", pm.LocalPort, pm.RemoteAddr)
+			fmt.Printf("%5s -> %s: OK!\n", pm.PortsString(), remotes)
 		}
 	}
 
 	return nil
 }
 
+func cmdApply(c *cli.Context) error {
+	if len(c.Args()) < 1 {
+		showHelp(c)
+	}
+
+	cfg, err := tcpproxy.LoadConfig(c.Args()[0])
+	exitOnError(err)
+
+	var opts *tcpproxy.StopOptions
+	if c.Bool("drain") {
+		opts = &tcpproxy.StopOptions{
+			Drain:        true,
+			DrainTimeout: c.Duration("drain-timeout"),
+		}
+	}
+
+	client := createClient()
+	diff, err := client.ApplyConfig(cfg, opts, c.Bool("dry-run"))
+	exitOnError(err)
+
+	printConfigDiff(diff)
+	if !c.Bool("dry-run") {
+		fmt.Println("OK!")
+	}
+	return nil
+}
+
+func printConfigDiff(d *tcpproxy.ConfigDiff) {
+	if d.Empty() {
+		fmt.Println("no changes")
+		return
+	}
+
+	for _, pm := range d.Add {
+		fmt.Printf("+ %5s -> %s\n", pm.PortsString(), strings.Join(pm.GetRemotes(), ","))
+	}
+	for _, pm := range d.Remove {
+		fmt.Printf("- %5s -> %s\n", pm.PortsString(), strings.Join(pm.GetRemotes(), ","))
+	}
+	for _, change := range d.Change {
+		old, err := json.Marshal(change.Old)
+		exitOnError(err)
+		new, err := json.Marshal(change.New)
+		exitOnError(err)
+		fmt.Printf("~ %5s\n    old: %s\n    new: %s\n", change.New.PortsString(), old, new)
+	}
+}
+
+func cmdEnable(c *cli.Context) error {
+	if len(c.Args()) < 1 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	err = client.EnablePortMapping(int(localPort))
+	exitOnError(err)
+
+	fmt.Println("OK!")
+	return nil
+}
+
+func cmdDisable(c *cli.Context) error {
+	if len(c.Args()) < 1 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	err = client.DisablePortMapping(int(localPort))
+	exitOnError(err)
+
+	fmt.Println("OK!")
+	return nil
+}
+
+func cmdLimits(c *cli.Context) error {
+	if len(c.Args()) < 1 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	limits, err := parseLimits(c)
+	exitOnError(err)
+	client := createClient()
+	err = client.SetPortMappingLimits(int(localPort), &limits)
+	exitOnError(err)
+
+	fmt.Println("OK!")
+	return nil
+}
+
 func cmdDelete(c *cli.Context) error {
 	if len(c.Args()) < 1 {
 		showHelp(c)
@@ -159,21 +814,116 @@ func cmdDelete(c *cli.Context) error {
 	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
 	exitOnError(err)
 
+	var opts *tcpproxy.StopOptions
+	if c.Bool("drain") {
+		opts = &tcpproxy.StopOptions{
+			Drain:        true,
+			DrainTimeout: c.Duration("drain-timeout"),
+		}
+	}
+
 	client := createClient()
-	err = client.DeletePortMapping(int(localPort))
+	err = client.DeletePortMapping(int(localPort), opts)
 	exitOnError(err)
 
 	fmt.Println("OK!")
 	return nil
 }
 
+func printPortMappings(m []*tcpproxy.PortMappingInfo) {
+	sort.Slice(m, func(i, j int) bool { return m[i].LocalPort < m[j].LocalPort })
+
+	width := len("LOCAL")
+	for _, p := range m {
+		if n := len(p.PortsString()); n > width {
+			width = n
+		}
+	}
+
+	fmt.Printf("%-*s    %-21s %-8s %7s %9s %9s %12s %12s\n", width, "LOCAL", "REMOTE",
+		"STATE", "ACTIVE", "TOTAL", "DIALFAIL", "UP", "DOWN")
+	for _, p := range m {
+		s := p.Stats
+		if s == nil {
+			s = &tcpproxy.PortMappingStats{}
+		}
+		remote := ""
+		if remotes := p.GetRemotes(); len(remotes) > 0 {
+			remote = remotes[0]
+		}
+		fmt.Printf("%-*s -> %-21s %-8s %7d %9d %9d %12d %12d\n",
+			width, p.PortsString(), remote, portMappingState(p), s.ActiveConns,
+			s.TotalConns, s.DialFailures, s.BytesUp, s.BytesDown)
+
+		// show every remote once there is more than one or they are checked
+		if len(p.RemoteStatus) < 2 && p.HealthCheck == nil {
+			continue
+		}
+		for _, r := range p.RemoteStatus {
+			health := "up"
+			if !r.Healthy {
+				health = "down"
+			}
+			fmt.Printf("%*s    %-21s %-8s %7d  %s %s\n", width, "",
+				r.Addr, health, r.ActiveConns, r.ResolvedAddr, r.LastError)
+		}
+	}
+}
+
+func portMappingState(p *tcpproxy.PortMappingInfo) string {
+	if !p.IsEnabled() {
+		return "disabled"
+	} else if !p.Running {
+		return "stopped"
+	}
+	return "running"
+}
+
 func cmdList(c *cli.Context) error {
 	client := createClient()
 	m, err := client.ListPortMapping()
 	exitOnError(err)
 
-	for _, p := range m {
-		fmt.Printf("%-5d -> %s\n", p.LocalPort, p.RemoteAddr)
+	printPortMappings(m)
+	return nil
+}
+
+func cmdWatch(c *cli.Context) error {
+	interval := c.Duration("interval")
+	if interval <= 0 {
+		fail("invalid interval: %v", interval)
+	}
+
+	client := createClient()
+	for {
+		m, err := client.ListPortMapping()
+		exitOnError(err)
+
+		// clear screen and move cursor to top-left
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("%s    every %v\n\n", time.Now().Format("15:04:05"), interval)
+		printPortMappings(m)
+		time.Sleep(interval)
+	}
+}
+
+func cmdConnections(c *cli.Context) error {
+	if len(c.Args()) < 1 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	conns, err := client.ListConnections(int(localPort))
+	exitOnError(err)
+
+	fmt.Printf("%-21s    %-21s %8s %12s %12s\n", "CLIENT", "REMOTE",
+		"AGE", "UP", "DOWN")
+	for _, conn := range conns {
+		age := time.Duration(conn.Age) * time.Second
+		fmt.Printf("%-21s -> %-21s %8v %12d %12d\n",
+			conn.ClientAddr, conn.RemoteAddr, age, conn.BytesUp, conn.BytesDown)
 	}
 
 	return nil
@@ -187,3 +937,231 @@ func cmdDump(c *cli.Context) error {
 	fmt.Println(marshalData(m))
 	return nil
 }
+
+func cmdSNIAdd(c *cli.Context) error {
+	if len(c.Args()) < 3 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	err = client.AddSNIRoute(&tcpproxy.SNIRoute{
+		LocalPort:  int(localPort),
+		Hostname:   c.Args()[1],
+		RemoteAddr: c.Args()[2],
+	})
+	exitOnError(err)
+
+	fmt.Println("OK!")
+	return nil
+}
+
+func cmdSNIDelete(c *cli.Context) error {
+	if len(c.Args()) < 2 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	err = client.DeleteSNIRoute(int(localPort), c.Args()[1])
+	exitOnError(err)
+
+	fmt.Println("OK!")
+	return nil
+}
+
+func cmdSNIList(c *cli.Context) error {
+	if len(c.Args()) < 1 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	routes, err := client.ListSNIRoute(int(localPort))
+	exitOnError(err)
+
+	for _, r := range routes {
+		fmt.Printf("%-40s -> %s\n", r.Hostname, r.RemoteAddr)
+	}
+	return nil
+}
+
+func cmdHTTPAdd(c *cli.Context) error {
+	if len(c.Args()) < 4 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	err = client.AddHTTPRoute(&tcpproxy.HTTPRoute{
+		LocalPort:  int(localPort),
+		Host:       c.Args()[1],
+		PathPrefix: c.Args()[2],
+		RemoteAddr: c.Args()[3],
+	})
+	exitOnError(err)
+
+	fmt.Println("OK!")
+	return nil
+}
+
+func cmdHTTPDelete(c *cli.Context) error {
+	if len(c.Args()) < 3 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	err = client.DeleteHTTPRoute(int(localPort), c.Args()[1], c.Args()[2])
+	exitOnError(err)
+
+	fmt.Println("OK!")
+	return nil
+}
+
+func cmdHTTPList(c *cli.Context) error {
+	if len(c.Args()) < 1 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	routes, err := client.ListHTTPRoute(int(localPort))
+	exitOnError(err)
+
+	for _, r := range routes {
+		fmt.Printf("%-40s -> %s\n", r.Host+r.PathPrefix, r.RemoteAddr)
+	}
+	return nil
+}
+
+func cmdCaptureStart(c *cli.Context) error {
+	if len(c.Args()) < 1 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+	// 0 would mean no limit
+	duration := c.Duration("duration")
+	if duration%time.Second != 0 {
+		fail("duration must be whole seconds: %v", duration)
+	}
+
+	client := createClient()
+	info, err := client.StartCapture(&tcpproxy.CaptureInfo{
+		LocalPort: int(localPort),
+		Format:    c.String("format"),
+		File:      c.String("file"),
+		MaxBytes:  c.Int64("max-bytes"),
+		Duration:  int(duration / time.Second),
+	})
+	exitOnError(err)
+
+	fmt.Printf("capturing to %s\n", info.File)
+	return nil
+}
+
+func cmdCaptureStop(c *cli.Context) error {
+	if len(c.Args()) < 1 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	err = client.StopCapture(int(localPort))
+	exitOnError(err)
+
+	fmt.Println("OK!")
+	return nil
+}
+
+func cmdCaptureList(c *cli.Context) error {
+	client := createClient()
+	list, err := client.ListCaptures()
+	exitOnError(err)
+
+	fmt.Printf("%-5s %-8s %8s %12s  %s\n", "LOCAL", "FORMAT", "AGE", "BYTES", "FILE")
+	for _, info := range list {
+		age := time.Since(info.StartTime) / time.Second * time.Second
+		fmt.Printf("%-5d %-8s %8v %12d  %s\n",
+			info.LocalPort, info.Format, age, info.Bytes, info.File)
+	}
+	return nil
+}
+
+func cmdToxicAdd(c *cli.Context) error {
+	if len(c.Args()) < 2 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	toxic, err := client.AddToxic(&tcpproxy.ToxicInfo{
+		LocalPort:     int(localPort),
+		Type:          c.Args()[1],
+		Name:          c.String("name"),
+		Stream:        c.String("stream"),
+		Toxicity:      c.Float64("toxicity"),
+		Latency:       c.Int("latency"),
+		Jitter:        c.Int("jitter"),
+		Rate:          c.Int("rate"),
+		Timeout:       c.Int("timeout"),
+		Size:          c.Int("size"),
+		SizeVariation: c.Int("size-variation"),
+		Delay:         c.Int("delay"),
+		Bytes:         c.Int64("bytes"),
+	})
+	exitOnError(err)
+
+	fmt.Printf("added toxic %s\n", toxic.Name)
+	return nil
+}
+
+func cmdToxicDelete(c *cli.Context) error {
+	if len(c.Args()) < 2 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	err = client.DeleteToxic(int(localPort), c.Args()[1])
+	exitOnError(err)
+
+	fmt.Println("OK!")
+	return nil
+}
+
+func cmdToxicList(c *cli.Context) error {
+	if len(c.Args()) < 1 {
+		showHelp(c)
+	}
+	localPort, err := strconv.ParseInt(c.Args()[0], 10, 32)
+	exitOnError(err)
+
+	client := createClient()
+	list, err := client.ListToxics(int(localPort))
+	exitOnError(err)
+
+	for _, t := range list {
+		fmt.Printf("%-24s %s\n", t.Name, marshalToxic(t))
+	}
+	return nil
+}
+
+// marshalToxic prints the attributes of a toxic on one line.
+func marshalToxic(t *tcpproxy.ToxicInfo) string {
+	attrs := *t
+	attrs.LocalPort = 0
+	attrs.Name = ""
+	b, _ := json.Marshal(&attrs)
+	return string(b)
+}
@@ -3,9 +3,14 @@ package main
 import (
 	"flag"
 	"net"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/MoZhonghua/mytools/tcpproxy"
 	log "github.com/Sirupsen/logrus"
@@ -15,6 +20,17 @@ var (
 	adminAddr string
 	db        string
 	noLoad    bool
+	config    string
+	token     string
+
+	drainTimeout time.Duration
+	captureDir   string
+
+	accessLogPath       string
+	accessLogFormat     string
+	accessLogMaxSize    int64
+	accessLogMaxAge     time.Duration
+	accessLogMaxBackups int
 )
 
 func getDefaultDatabaseFile() string {
@@ -29,6 +45,24 @@ func main() {
 	flag.StringVar(&adminAddr, "m", "127.0.0.1:3333", "admin api address")
 	flag.StringVar(&db, "d", getDefaultDatabaseFile(), "database to save mappings")
 	flag.BoolVar(&noLoad, "n", false, "don't load targets from database when start")
+	flag.StringVar(&config, "c", "",
+		"json, yaml or toml file of all port mappings, reloaded on SIGHUP or change")
+	flag.StringVar(&token, "token", os.Getenv("TCPPROXY_TOKEN"),
+		"admin api token, defaults to $TCPPROXY_TOKEN, empty means no auth")
+	flag.DurationVar(&drainTimeout, "t", 30*time.Second,
+		"on SIGTERM, wait this long for connections to finish, 0 means forever")
+	flag.StringVar(&captureDir, "capture-dir", os.TempDir(),
+		"directory the admin api creates capture files in")
+	flag.StringVar(&accessLogPath, "access-log", "",
+		"access log file, \"-\" for stdout, \"syslog\" or syslog://host:port for syslog")
+	flag.StringVar(&accessLogFormat, "access-log-format", "",
+		"text/template of an access log line, e.g. {{.ClientAddr}} {{.Reason}}, default json")
+	flag.Int64Var(&accessLogMaxSize, "access-log-max-size", 100,
+		"rotate access log file at this size in MB, 0 means never")
+	flag.DurationVar(&accessLogMaxAge, "access-log-max-age", 24*time.Hour,
+		"rotate access log file at this age, 0 means never")
+	flag.IntVar(&accessLogMaxBackups, "access-log-max-backups", 7,
+		"rotated access log files to keep, 0 means keep all")
 	flag.Parse()
 
 	pdir := path.Dir(db)
@@ -43,6 +77,16 @@ func main() {
 	}
 
 	p := tcpproxy.NewProxy()
+	p.SetCaptureDir(captureDir)
+	if accessLogPath != "" {
+		sink, err := openAccessLog()
+		if err != nil {
+			log.Fatalf("failed to open access log: %v", err)
+		}
+		defer sink.Close()
+		p.SetAccessLog(sink)
+	}
+
 	if !noLoad {
 		list, err := s.GetAllPortMapping()
 		if err != nil {
@@ -50,32 +94,182 @@ func main() {
 		}
 
 		for _, pm := range list {
-			remoteAddr, err := net.ResolveTCPAddr("tcp4", pm.RemoteAddr)
-			if err != nil {
-				log.Printf("failed to resolve addr: %s - %v", pm.RemoteAddr, err)
-				continue
-			}
-
-			err = p.AddPortMapping(pm.LocalPort, remoteAddr)
+			remotes := strings.Join(pm.GetRemotes(), ",")
+			err = p.AddPortMapping(pm)
 			if err != nil {
 				log.Printf("failed to map :%d -> %s - %v",
-					pm.LocalPort, pm.RemoteAddr, err)
+					pm.LocalPort, remotes, err)
+				continue
+			} else if !pm.IsEnabled() {
+				log.Printf("map :%d -> %s disabled", pm.LocalPort, remotes)
 				continue
 			} else {
-				log.Printf("map :%d -> %s OK", pm.LocalPort, pm.RemoteAddr)
+				log.Printf("map :%d -> %s OK", pm.LocalPort, remotes)
 				continue
 			}
 		}
+
+		routes, err := s.GetAllSNIRoute()
+		if err != nil {
+			log.Fatalf("failed to load sni route list: %v", err)
+		}
+
+		for _, route := range routes {
+			err = p.AddSNIRoute(route)
+			if err != nil {
+				log.Printf("failed to add sni route :%d %s -> %s - %v",
+					route.LocalPort, route.Hostname, route.RemoteAddr, err)
+			}
+		}
+
+		httpRoutes, err := s.GetAllHTTPRoute()
+		if err != nil {
+			log.Fatalf("failed to load http route list: %v", err)
+		}
+
+		for _, route := range httpRoutes {
+			err = p.AddHTTPRoute(route)
+			if err != nil {
+				log.Printf("failed to add http route :%d %s%s -> %s - %v",
+					route.LocalPort, route.Host, route.PathPrefix, route.RemoteAddr, err)
+			}
+		}
 	}
 
 	d := tcpproxy.NewHttpd(p, s)
+	d.SetAuthToken(token)
+	errLog := tcpproxy.NewErrorLog(errorLogSize)
+	log.AddHook(errLog)
+	d.SetErrorLog(errLog)
+	if config != "" {
+		err = applyConfig(d)
+		if err != nil {
+			log.Fatalf("failed to apply config %s: %v", config, err)
+		}
+	}
+
 	l, err := net.Listen("tcp4", adminAddr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer l.Close()
-	err = d.Serv(l)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- d.Serv(l)
+	}()
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+
+	var changeCh <-chan int
+	if config != "" {
+		changeCh = watchFile(config, configCheckInterval)
+	}
+
+loop:
+	for {
+		select {
+		case err := <-errCh:
+			log.Fatal(err)
+		case <-hupCh:
+			reloadConfig(d)
+		case <-changeCh:
+			reloadConfig(d)
+		case sig := <-sigCh:
+			log.Infof("received %v, draining connections", sig)
+			break loop
+		}
+	}
+
+	l.Close()
+	p.Close(&tcpproxy.StopOptions{Drain: true, DrainTimeout: drainTimeout})
+	log.Infof("all port mappings stopped")
+}
+
+const (
+	configCheckInterval = 2 * time.Second
+	// warnings and errors kept for the dashboard
+	errorLogSize = 100
+)
+
+func applyConfig(d *tcpproxy.Httpd) error {
+	c, err := tcpproxy.LoadConfig(config)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	diff, err := d.ApplyConfig(c, nil, false)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("config %s applied: %d added, %d removed, %d changed",
+		config, len(diff.Add), len(diff.Remove), len(diff.Change))
+	return nil
+}
+
+// reloadConfig keeps the running port mappings if the config is invalid
+// or fails to apply.
+func reloadConfig(d *tcpproxy.Httpd) {
+	if config == "" {
+		log.Warnf("no config file to reload")
+		return
+	}
+
+	err := applyConfig(d)
+	if err != nil {
+		log.Errorf("failed to reload config %s: %v", config, err)
+	}
+}
+
+// watchFile polls path and sends to the returned channel when its size or
+// modification time changes.
+func watchFile(path string, interval time.Duration) <-chan int {
+	ch := make(chan int, 1)
+	go func() {
+		var last os.FileInfo
+		last, _ = os.Stat(path)
+		for range time.Tick(interval) {
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if last == nil || !fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size() {
+				last = fi
+				select {
+				case ch <- 1:
+				default:
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func openAccessLog() (tcpproxy.AccessLogSink, error) {
+	format, err := tcpproxy.NewAccessLogFormat(accessLogFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	if accessLogPath == "-" {
+		return tcpproxy.NewWriterSink(os.Stdout, format), nil
+	} else if accessLogPath == "syslog" {
+		return tcpproxy.NewSyslogSink("", "", "tcpproxy", format)
+	} else if strings.HasPrefix(accessLogPath, "syslog://") {
+		u, err := url.Parse(accessLogPath)
+		if err != nil {
+			return nil, err
+		}
+		return tcpproxy.NewSyslogSink("udp", u.Host, "tcpproxy", format)
+	}
+
+	f, err := tcpproxy.NewRotatingFile(accessLogPath, accessLogMaxSize*1024*1024,
+		accessLogMaxAge, accessLogMaxBackups)
+	if err != nil {
+		return nil, err
 	}
+	return tcpproxy.NewWriterSink(f, format), nil
 }
@@ -0,0 +1,369 @@
+package tcpproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ConfigFormatJSON = "json"
+	ConfigFormatYAML = "yaml"
+	ConfigFormatTOML = "toml"
+)
+
+// Config declares the complete set of port mappings a proxy should run.
+// YAML and TOML files use the same field names as JSON.
+type Config struct {
+	Mappings []*PortMappingInfo `json:"mappings"`
+}
+
+// PortMappingChange is a port mapping whose config differs between the
+// running proxy and a Config.
+type PortMappingChange struct {
+	Old *PortMappingInfo `json:"old"`
+	New *PortMappingInfo `json:"new"`
+}
+
+// ConfigDiff is what applying a Config does to the running proxy.
+type ConfigDiff struct {
+	Add    []*PortMappingInfo   `json:"add,omitempty"`
+	Remove []*PortMappingInfo   `json:"remove,omitempty"`
+	Change []*PortMappingChange `json:"change,omitempty"`
+}
+
+func (d *ConfigDiff) Empty() bool {
+	return len(d.Add) == 0 && len(d.Remove) == 0 && len(d.Change) == 0
+}
+
+// LoadConfig reads a config file, the format is chosen by its extension.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	format := ConfigFormatJSON
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = ConfigFormatYAML
+	case ".toml":
+		format = ConfigFormatTOML
+	}
+	return ParseConfig(data, format)
+}
+
+// ParseConfig parses and validates a config. YAML and TOML are converted
+// to JSON first so all formats share the json field tags.
+func ParseConfig(data []byte, format string) (*Config, error) {
+	var v interface{}
+	var err error
+	switch format {
+	case ConfigFormatJSON:
+	case ConfigFormatYAML:
+		err = yaml.Unmarshal(data, &v)
+		if err == nil {
+			data, err = json.Marshal(yamlToJSON(v))
+		}
+	case ConfigFormatTOML:
+		m := make(map[string]interface{})
+		err = toml.Unmarshal(data, &m)
+		if err == nil {
+			data, err = json.Marshal(m)
+		}
+	default:
+		return nil, fmt.Errorf("unknown config format: %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(c)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// yamlToJSON converts the map[interface{}]interface{} values yaml decodes
+// into something encoding/json accepts.
+func yamlToJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			m[fmt.Sprint(k)] = yamlToJSON(x)
+		}
+		return m
+	case []interface{}:
+		for i, x := range v {
+			v[i] = yamlToJSON(x)
+		}
+	}
+	return v
+}
+
+// Validate checks every port mapping of the config the same way a single
+// added port mapping is checked, and that no local port is used twice.
+func (c *Config) Validate() error {
+	for i, info := range c.Mappings {
+		if info == nil {
+			return fmt.Errorf("empty port mapping")
+		}
+		for _, other := range c.Mappings[:i] {
+			if info.overlaps(other) {
+				return fmt.Errorf("duplicated local port: %s overlaps %s",
+					info.PortsString(), other.PortsString())
+			}
+		}
+
+		err := validatePortMappingInfo(info)
+		if err != nil {
+			return fmt.Errorf("port mapping :%d: %v", info.LocalPort, err)
+		}
+	}
+	return nil
+}
+
+func validatePortMappingInfo(info *PortMappingInfo) error {
+	if info.LocalPort <= 0 || info.LocalPort > 65535 {
+		return fmt.Errorf("invalid local port: %d", info.LocalPort)
+	}
+
+	err := validateRemotes(info)
+	if err != nil {
+		return err
+	}
+
+	err = validatePortRange(info)
+	if err != nil {
+		return err
+	}
+
+	err = validateTransparent(info)
+	if err != nil {
+		return err
+	}
+
+	err = validateMirror(info)
+	if err != nil {
+		return err
+	}
+
+	err = validateSchedule(info.Schedule)
+	if err != nil {
+		return err
+	}
+
+	_, err = newAccessControl(&info.PortMappingLimits)
+	return err
+}
+
+// configOf returns a copy of info without runtime fields and with defaults
+// spelled out, so equal configs marshal to the same json.
+func configOf(info *PortMappingInfo) *PortMappingInfo {
+	c := *info
+	c.Type = c.GetType()
+	if c.IsEnabled() {
+		c.Enabled = nil
+	}
+	c.Running = false
+	c.Stats = nil
+	c.RemoteStatus = nil
+	return &c
+}
+
+func sameConfig(a, b *PortMappingInfo) bool {
+	x, _ := json.Marshal(configOf(a))
+	y, _ := json.Marshal(configOf(b))
+	return bytes.Equal(x, y)
+}
+
+// diff compares c with the running mappings, p.mu must be held.
+func (p *Proxy) diff(c *Config) *ConfigDiff {
+	d := &ConfigDiff{}
+	want := make(map[int]bool)
+	for _, info := range c.Mappings {
+		want[info.LocalPort] = true
+		m, found := p.mappings[info.LocalPort]
+		if !found {
+			d.Add = append(d.Add, configOf(info))
+		} else if !sameConfig(m.info, info) {
+			d.Change = append(d.Change, &PortMappingChange{
+				Old: configOf(m.info),
+				New: configOf(info),
+			})
+		}
+	}
+	for port, m := range p.mappings {
+		if !want[port] {
+			d.Remove = append(d.Remove, configOf(m.info))
+		}
+	}
+
+	sort.Slice(d.Add, func(i, j int) bool {
+		return d.Add[i].LocalPort < d.Add[j].LocalPort
+	})
+	sort.Slice(d.Remove, func(i, j int) bool {
+		return d.Remove[i].LocalPort < d.Remove[j].LocalPort
+	})
+	sort.Slice(d.Change, func(i, j int) bool {
+		return d.Change[i].New.LocalPort < d.Change[j].New.LocalPort
+	})
+	return d
+}
+
+// DiffConfig returns what ApplyConfig would do without doing it.
+func (p *Proxy) DiffConfig(c *Config) (*ConfigDiff, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.diff(c), nil
+}
+
+// inherit copies the runtime state that isn't part of the config, routes
+// and toxics, from the mapping m replaces.
+func (m *portMapping) inherit(old *portMapping) {
+	if m.sni != nil && old.sni != nil {
+		for _, route := range old.sni.list(old.localPort) {
+			m.sni.add(route.Hostname, route.RemoteAddr)
+		}
+	}
+	if m.http != nil && old.http != nil {
+		for _, route := range old.http.list() {
+			m.http.add(route)
+		}
+	}
+	if m.http == nil {
+		m.toxics.Store(old.getToxics())
+	}
+}
+
+// ApplyConfig makes the running mappings match c. Added and changed
+// mappings are all created and started before any is swapped in; if one
+// fails to start, or commit (may be nil) returns an error, the old
+// listeners are restarted and the proxy is left as it was. Connections of
+// removed and changed mappings are closed according to opts.
+func (p *Proxy) ApplyConfig(c *Config, opts *StopOptions, commit func() error) (*ConfigDiff, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	d := p.diff(c)
+	if d.Empty() {
+		defer p.mu.Unlock()
+		if commit != nil {
+			err = commit()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+	}
+
+	infos := append([]*PortMappingInfo{}, d.Add...)
+	for _, change := range d.Change {
+		infos = append(infos, change.New)
+	}
+
+	var added, removed []*portMapping
+	for _, info := range infos {
+		// the diff is returned to the caller, don't share it
+		info := *info
+		m, err := newPortMapping(&info, p.accessLog)
+		if err != nil {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("port mapping :%d: %v", info.LocalPort, err)
+		}
+		if old, found := p.mappings[info.LocalPort]; found {
+			m.inherit(old)
+			// drained connections of old still count
+			m.shareConns(old)
+		}
+		added = append(added, m)
+	}
+	for _, info := range d.Remove {
+		removed = append(removed, p.mappings[info.LocalPort])
+	}
+	for _, change := range d.Change {
+		removed = append(removed, p.mappings[change.Old.LocalPort])
+	}
+
+	for _, m := range removed {
+		m.stop()
+	}
+
+	now := time.Now()
+	rollback := func(n int) {
+		for _, m := range added[:n] {
+			m.stop()
+		}
+		for _, m := range removed {
+			p.updateRunning(m, now)
+		}
+		p.mu.Unlock()
+	}
+
+	for i, m := range added {
+		err = p.updateRunning(m, now)
+		if err != nil {
+			rollback(i)
+			return nil, fmt.Errorf("port mapping :%d: %v", m.localPort, err)
+		}
+	}
+
+	if commit != nil {
+		err = commit()
+		if err != nil {
+			rollback(len(added))
+			return nil, err
+		}
+	}
+
+	for _, m := range removed {
+		delete(p.mappings, m.localPort)
+	}
+	for _, m := range added {
+		p.mappings[m.localPort] = m
+	}
+	p.mu.Unlock()
+
+	for _, m := range removed {
+		log.Infof("port mapping :%d replaced or removed by config", m.localPort)
+	}
+	var wg sync.WaitGroup
+	for _, m := range removed {
+		wg.Add(1)
+		go func(m *portMapping) {
+			defer wg.Done()
+			m.closeConns(opts)
+			m.stopCapture()
+		}(m)
+	}
+	wg.Wait()
+	return d, nil
+}
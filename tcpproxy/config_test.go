@@ -0,0 +1,153 @@
+package tcpproxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	cases := []struct {
+		format string
+		data   string
+	}{
+		{ConfigFormatJSON, `{"mappings": [
+			{"localPort": 8080, "remotes": ["a:80", "b:80"], "balance": "failover", "maxConns": 10}
+		]}`},
+		{ConfigFormatYAML, `
+mappings:
+  - localPort: 8080
+    remotes: [a:80, b:80]
+    balance: failover
+    maxConns: 10
+`},
+		{ConfigFormatTOML, `
+[[mappings]]
+localPort = 8080
+remotes = ["a:80", "b:80"]
+balance = "failover"
+maxConns = 10
+`},
+	}
+
+	for _, c := range cases {
+		cfg, err := ParseConfig([]byte(c.data), c.format)
+		if err != nil {
+			t.Errorf("%s: %v", c.format, err)
+			continue
+		}
+		if len(cfg.Mappings) != 1 {
+			t.Errorf("%s: %d mappings", c.format, len(cfg.Mappings))
+			continue
+		}
+		pm := cfg.Mappings[0]
+		if pm.LocalPort != 8080 || len(pm.Remotes) != 2 ||
+			pm.Balance != BalanceFailover || pm.MaxConns != 10 {
+			t.Errorf("%s: %+v", c.format, pm)
+		}
+	}
+
+	_, err := ParseConfig([]byte(`{"mappings": [
+		{"localPort": 8080, "remoteAddr": "a:80"},
+		{"localPort": 8080, "remoteAddr": "b:80"}
+	]}`), ConfigFormatJSON)
+	if err == nil {
+		t.Error("duplicated port accepted")
+	}
+	_, err = ParseConfig([]byte(`{"mappings": [{"localPort": 8080, "remote": "a:80"}]}`),
+		ConfigFormatJSON)
+	if err == nil {
+		t.Error("unknown field accepted")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	echoAddr := echo.Addr().String()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	kept := addTestPortMapping(t, p, echo)
+	removed := addTestPortMapping(t, p, echo)
+	changed := addTestPortMapping(t, p, echo)
+	added := freePort(t)
+
+	err := p.AddToxic(&ToxicInfo{LocalPort: changed, Type: ToxicLatency, Latency: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dialAndEcho(t, removed)
+	defer c.Close()
+
+	cfg := &Config{Mappings: []*PortMappingInfo{
+		{LocalPort: kept, RemoteAddr: echoAddr},
+		{LocalPort: changed, RemoteAddr: echoAddr, Balance: BalanceRandom},
+		{LocalPort: added, RemoteAddr: echoAddr},
+	}}
+
+	d, err := p.DiffConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Add) != 1 || d.Add[0].LocalPort != added ||
+		len(d.Remove) != 1 || d.Remove[0].LocalPort != removed ||
+		len(d.Change) != 1 || d.Change[0].New.LocalPort != changed {
+		t.Fatalf("diff: %+v", d)
+	}
+
+	// a failed commit leaves the proxy as it was
+	_, err = p.ApplyConfig(cfg, nil, func() error { return errors.New("store failed") })
+	if err == nil {
+		t.Fatal("failed commit ignored")
+	}
+	dialAndEcho(t, removed).Close()
+	if _, err := net.Dial("tcp4", "127.0.0.1:"+strconv.Itoa(added)); err == nil {
+		t.Error("added port mapping still listening")
+	}
+
+	d, err = p.ApplyConfig(cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(t, c)
+	dialAndEcho(t, added).Close()
+	dialAndEcho(t, changed).Close()
+	if list, _ := p.ListToxics(changed); len(list) != 1 {
+		t.Errorf("toxics of changed mapping: %d", len(list))
+	}
+
+	d, err = p.DiffConfig(cfg)
+	if err != nil || !d.Empty() {
+		t.Errorf("config not applied: %+v %v", d, err)
+	}
+}
+
+func TestApplyConfigRollback(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTestPortMapping(t, p, echo)
+
+	busy, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	cfg := &Config{Mappings: []*PortMappingInfo{
+		{LocalPort: busy.Addr().(*net.TCPAddr).Port, RemoteAddr: echo.Addr().String()},
+	}}
+	_, err = p.ApplyConfig(cfg, nil, nil)
+	if err == nil {
+		t.Fatal("port in use accepted")
+	}
+
+	dialAndEcho(t, port).Close()
+	if list := p.ListPortMapping(); len(list) != 1 || !list[0].Running {
+		t.Errorf("port mapping not restored: %+v", list)
+	}
+}
@@ -0,0 +1,271 @@
+package tcpproxy
+
+import (
+	"net/http"
+)
+
+const dashboardPath = "/ui/"
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+// dashboardHTML is a self-contained page using only the api v1 routes. The
+// token, if the server requires one, is kept in the browser's local
+// storage.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tcpproxy</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 20px; color: #222; }
+h1 { font-size: 20px; }
+h2 { font-size: 16px; margin-top: 28px; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; white-space: nowrap; }
+th { background: #f4f4f4; }
+td.num, th.num { text-align: right; }
+.running { color: #080; }
+.stopped { color: #888; }
+.down { color: #c00; }
+.error { color: #c00; }
+form input, form select { margin-right: 8px; }
+#status { margin-left: 12px; color: #888; }
+#auth { display: none; margin-bottom: 16px; }
+</style>
+</head>
+<body>
+<h1>tcpproxy <span id="status"></span></h1>
+
+<form id="auth">
+  <input id="token" type="password" placeholder="admin token">
+  <button type="submit">Login</button>
+</form>
+
+<h2>Port mappings</h2>
+<table>
+  <thead>
+    <tr>
+      <th>Local</th><th>Type</th><th>Remotes</th><th>State</th>
+      <th class="num">Active</th><th class="num">Total</th>
+      <th class="num">Dial fail</th><th class="num">Rejected</th>
+      <th class="num">Up</th><th class="num">Down</th>
+      <th class="num">Up/s</th><th class="num">Down/s</th><th></th>
+    </tr>
+  </thead>
+  <tbody id="mappings"></tbody>
+</table>
+
+<h2>Add port mapping</h2>
+<form id="add">
+  <input id="add-port" size="12" pattern="[0-9]+(-[0-9]+)?" placeholder="port or first-last" required>
+  <input id="add-remotes" size="40" placeholder="remote addresses, comma separated">
+  <select id="add-type">
+    <option value="tcp">tcp</option>
+    <option value="sni">sni</option>
+    <option value="http">http</option>
+    <option value="transparent">transparent</option>
+  </select>
+  <select id="add-balance">
+    <option value="">roundrobin</option>
+    <option value="random">random</option>
+    <option value="leastconn">leastconn</option>
+    <option value="failover">failover</option>
+  </select>
+  <button type="submit">Add</button>
+  <span id="add-error" class="error"></span>
+</form>
+
+<h2>Recent errors</h2>
+<table>
+  <thead><tr><th>Time</th><th>Level</th><th>Message</th></tr></thead>
+  <tbody id="errors"></tbody>
+</table>
+
+<script>
+var api = "/api/v1";
+var last = {};
+
+function token() {
+  return localStorage.getItem("tcpproxy-token") || "";
+}
+
+function call(method, path, body) {
+  var opts = {method: method, headers: {}};
+  if (token()) {
+    opts.headers["Authorization"] = "Bearer " + token();
+  }
+  if (body !== undefined) {
+    opts.headers["Content-Type"] = "application/json";
+    opts.body = JSON.stringify(body);
+  }
+  return fetch(api + path, opts).then(function(resp) {
+    if (resp.status === 401) {
+      document.getElementById("auth").style.display = "block";
+    }
+    return resp.json().then(function(data) {
+      if (!data.success) {
+        throw new Error(data.error || resp.statusText);
+      }
+      return data.data;
+    });
+  });
+}
+
+function bytes(n) {
+  var units = ["B", "KB", "MB", "GB", "TB"];
+  var i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function cell(tr, text, cls) {
+  var td = document.createElement("td");
+  td.textContent = text;
+  if (cls) {
+    td.className = cls;
+  }
+  tr.appendChild(td);
+  return td;
+}
+
+function button(td, text, fn) {
+  var b = document.createElement("button");
+  b.textContent = text;
+  b.onclick = function() {
+    fn().then(refresh, function(err) { alert(err.message); });
+  };
+  td.appendChild(b);
+}
+
+function remotes(pm) {
+  var list = pm.remotes && pm.remotes.length ? pm.remotes : (pm.remoteAddr ? [pm.remoteAddr] : []);
+  var status = {};
+  (pm.remoteStatus || []).forEach(function(s) { status[s.addr] = s; });
+  return list.map(function(addr) {
+    var s = status[addr];
+    return s && !s.healthy ? addr + " (down)" : addr;
+  }).join(", ");
+}
+
+function renderMappings(list) {
+  var now = Date.now();
+  var tbody = document.getElementById("mappings");
+  tbody.innerHTML = "";
+  list.sort(function(a, b) { return a.localPort - b.localPort; });
+  list.forEach(function(pm) {
+    var s = pm.stats || {};
+    var prev = last[pm.localPort];
+    var upRate = "", downRate = "";
+    if (prev) {
+      var secs = (now - prev.time) / 1000;
+      upRate = bytes(Math.max(0, (s.bytesUp - prev.up) / secs)) + "/s";
+      downRate = bytes(Math.max(0, (s.bytesDown - prev.down) / secs)) + "/s";
+    }
+    last[pm.localPort] = {time: now, up: s.bytesUp || 0, down: s.bytesDown || 0};
+
+    var enabled = pm.enabled === undefined || pm.enabled;
+    var state = pm.running ? "running" : (enabled ? "stopped" : "disabled");
+    var tr = document.createElement("tr");
+    cell(tr, pm.localPortEnd > pm.localPort ? pm.localPort + "-" + pm.localPortEnd : pm.localPort);
+    cell(tr, pm.type || "tcp");
+    cell(tr, remotes(pm), remotes(pm).indexOf("(down)") >= 0 ? "down" : "");
+    cell(tr, state, pm.running ? "running" : "stopped");
+    cell(tr, s.activeConns || 0, "num");
+    cell(tr, s.totalConns || 0, "num");
+    cell(tr, s.dialFailures || 0, "num");
+    cell(tr, s.rejected || 0, "num");
+    cell(tr, bytes(s.bytesUp || 0), "num");
+    cell(tr, bytes(s.bytesDown || 0), "num");
+    cell(tr, upRate, "num");
+    cell(tr, downRate, "num");
+
+    var td = cell(tr, "");
+    var path = "/mappings/" + pm.localPort;
+    if (enabled) {
+      button(td, "Disable", function() { return call("POST", path + "/disable"); });
+    } else {
+      button(td, "Enable", function() { return call("POST", path + "/enable"); });
+    }
+    button(td, "Delete", function() {
+      if (!confirm("Delete port mapping :" + pm.localPort + "?")) {
+        return Promise.resolve();
+      }
+      return call("DELETE", path);
+    });
+    tbody.appendChild(tr);
+  });
+}
+
+function renderErrors(list) {
+  var tbody = document.getElementById("errors");
+  tbody.innerHTML = "";
+  list.forEach(function(e) {
+    var tr = document.createElement("tr");
+    cell(tr, new Date(e.time).toLocaleString());
+    cell(tr, e.level, "error");
+    cell(tr, e.message);
+    tbody.appendChild(tr);
+  });
+}
+
+function refresh() {
+  var status = document.getElementById("status");
+  return Promise.all([call("GET", "/mappings"), call("GET", "/errors")]).then(function(r) {
+    document.getElementById("auth").style.display = "none";
+    renderMappings(r[0] || []);
+    renderErrors(r[1] || []);
+    status.textContent = "updated " + new Date().toLocaleTimeString();
+  }, function(err) {
+    status.textContent = err.message;
+  });
+}
+
+document.getElementById("auth").onsubmit = function(ev) {
+  ev.preventDefault();
+  localStorage.setItem("tcpproxy-token", document.getElementById("token").value);
+  refresh();
+};
+
+document.getElementById("add").onsubmit = function(ev) {
+  ev.preventDefault();
+  var ports = document.getElementById("add-port").value.split("-");
+  var port = parseInt(ports[0], 10);
+  var list = document.getElementById("add-remotes").value.split(",").map(function(s) {
+    return s.trim();
+  }).filter(function(s) { return s; });
+  var pm = {
+    localPort: port,
+    type: document.getElementById("add-type").value,
+    balance: document.getElementById("add-balance").value
+  };
+  if (ports.length > 1) {
+    pm.localPortEnd = parseInt(ports[1], 10);
+  }
+  if (list.length === 1) {
+    pm.remoteAddr = list[0];
+  } else {
+    pm.remotes = list;
+  }
+
+  var errSpan = document.getElementById("add-error");
+  errSpan.textContent = "";
+  call("POST", "/mappings", pm).then(function() {
+    document.getElementById("add").reset();
+    refresh();
+  }, function(err) {
+    errSpan.textContent = err.message;
+  });
+};
+
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,66 @@
+package tcpproxy
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type ErrorLogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// ErrorLog is a logrus hook keeping the most recent warnings and errors,
+// served by the admin api for the dashboard.
+type ErrorLog struct {
+	mu      sync.Mutex
+	entries []*ErrorLogEntry
+	next    int
+	full    bool
+}
+
+func NewErrorLog(size int) *ErrorLog {
+	return &ErrorLog{
+		entries: make([]*ErrorLogEntry, size),
+	}
+}
+
+func (e *ErrorLog) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel}
+}
+
+func (e *ErrorLog) Fire(entry *log.Entry) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.entries[e.next] = &ErrorLogEntry{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+	}
+	e.next = (e.next + 1) % len(e.entries)
+	if e.next == 0 {
+		e.full = true
+	}
+	return nil
+}
+
+// List returns the kept entries, newest first.
+func (e *ErrorLog) List() []*ErrorLogEntry {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := e.next
+	if e.full {
+		n = len(e.entries)
+	}
+
+	result := make([]*ErrorLogEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		result = append(result, e.entries[(e.next-i+len(e.entries))%len(e.entries)])
+	}
+	return result
+}
@@ -0,0 +1,25 @@
+package tcpproxy
+
+import (
+	"fmt"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestErrorLog(t *testing.T) {
+	e := NewErrorLog(3)
+	for i := 0; i < 5; i++ {
+		e.Fire(&log.Entry{Level: log.ErrorLevel, Message: fmt.Sprint(i)})
+	}
+
+	list := e.List()
+	if len(list) != 3 {
+		t.Fatalf("%d entries", len(list))
+	}
+	for i, want := range []string{"4", "3", "2"} {
+		if list[i].Message != want {
+			t.Errorf("entry %d: %s", i, list[i].Message)
+		}
+	}
+}
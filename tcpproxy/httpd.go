@@ -1,17 +1,22 @@
 package tcpproxy
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/MoZhonghua/mytools/util"
 	"github.com/gorilla/mux"
 )
 
 type Httpd struct {
-	p *Proxy
-	s *Store
+	p      *Proxy
+	s      *Store
+	token  string
+	errLog *ErrorLog
 }
 
 func NewHttpd(p *Proxy, s *Store) *Httpd {
@@ -27,8 +32,28 @@ func (d *Httpd) Serv(l net.Listener) error {
 	m.Methods("POST").Path("/add").HandlerFunc(d.handleAddPortMapping)
 	m.Methods("DELETE").Path("/delete").HandlerFunc(d.handleDeletePortMapping)
 	m.Methods("GET").Path("/list").HandlerFunc(d.handleListPortMapping)
+	m.Methods("GET").Path("/connections").HandlerFunc(d.handleListConnections)
+	m.Methods("POST").Path("/enable").HandlerFunc(d.handleEnablePortMapping)
+	m.Methods("POST").Path("/disable").HandlerFunc(d.handleDisablePortMapping)
+	m.Methods("POST").Path("/limits").HandlerFunc(d.handleSetPortMappingLimits)
+	m.Methods("POST").Path("/sni/add").HandlerFunc(d.handleAddSNIRoute)
+	m.Methods("DELETE").Path("/sni/delete").HandlerFunc(d.handleDeleteSNIRoute)
+	m.Methods("GET").Path("/sni/list").HandlerFunc(d.handleListSNIRoute)
+	m.Methods("POST").Path("/http/add").HandlerFunc(d.handleAddHTTPRoute)
+	m.Methods("DELETE").Path("/http/delete").HandlerFunc(d.handleDeleteHTTPRoute)
+	m.Methods("GET").Path("/http/list").HandlerFunc(d.handleListHTTPRoute)
+	m.Methods("POST").Path("/capture/start").HandlerFunc(d.handleStartCapture)
+	m.Methods("POST").Path("/capture/stop").HandlerFunc(d.handleStopCapture)
+	m.Methods("GET").Path("/capture/list").HandlerFunc(d.handleListCapture)
+	m.Methods("POST").Path("/toxic/add").HandlerFunc(d.handleAddToxic)
+	m.Methods("DELETE").Path("/toxic/delete").HandlerFunc(d.handleDeleteToxic)
+	m.Methods("GET").Path("/toxic/list").HandlerFunc(d.handleListToxic)
+	m.Methods("POST").Path("/apply").HandlerFunc(d.handleApplyConfig)
+	d.registerAPIV1(m)
+	m.Methods("GET").Path(dashboardPath).HandlerFunc(handleDashboard)
+	m.Methods("GET").Path("/").Handler(http.RedirectHandler(dashboardPath, http.StatusFound))
 
-	return http.Serve(l, m)
+	return http.Serve(l, d.authorize(m))
 }
 
 func (d *Httpd) handleAddPortMapping(w http.ResponseWriter, r *http.Request) {
@@ -39,21 +64,24 @@ func (d *Httpd) handleAddPortMapping(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	remoteAddr, err := net.ResolveTCPAddr("tcp4", pmInfo.RemoteAddr)
+	err = validatePortMappingInfo(pmInfo)
 	if err != nil {
 		util.WriteErrorResponse(w, 400, err)
 		return
 	}
 
-	err = d.s.AddPortMapping(pmInfo)
+	pmInfo.Running = false
+	pmInfo.Stats = nil
+	pmInfo.RemoteStatus = nil
+	err = d.p.AddPortMapping(configOf(pmInfo))
 	if err != nil {
 		util.WriteErrorResponse(w, 500, err)
 		return
 	}
 
-	err = d.p.AddPortMapping(pmInfo.LocalPort, remoteAddr)
+	err = d.s.AddPortMapping(pmInfo)
 	if err != nil {
-		d.s.DeletePortMapping(pmInfo.LocalPort)
+		d.p.DeletePortMapping(pmInfo.LocalPort, nil)
 		util.WriteErrorResponse(w, 500, err)
 		return
 	}
@@ -61,6 +89,38 @@ func (d *Httpd) handleAddPortMapping(w http.ResponseWriter, r *http.Request) {
 	util.WriteSuccessResponse(w)
 }
 
+// parseStopOptions reads optional "mode" (close or drain) and "timeout"
+// (drain timeout in seconds) query params.
+func parseStopOptions(r *http.Request) (*StopOptions, error) {
+	opts := &StopOptions{}
+	mode, err := util.QueryParam(r, "mode")
+	if err != nil && err != util.ErrParamNotFound {
+		return nil, err
+	}
+
+	switch mode {
+	case "", "close":
+	case "drain":
+		opts.Drain = true
+	default:
+		return nil, fmt.Errorf("invalid mode: %s", mode)
+	}
+
+	timeoutStr, err := util.QueryParam(r, "timeout")
+	if err == util.ErrParamNotFound {
+		return opts, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	timeout, err := strconv.ParseInt(timeoutStr, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	opts.DrainTimeout = time.Duration(timeout) * time.Second
+	return opts, nil
+}
+
 func (d *Httpd) handleDeletePortMapping(w http.ResponseWriter, r *http.Request) {
 	localPortStr, err := util.QueryParam(r, "localPort")
 	if err != nil {
@@ -74,13 +134,19 @@ func (d *Httpd) handleDeletePortMapping(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	opts, err := parseStopOptions(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
 	err = d.s.DeletePortMapping(int(localPort))
 	if err != nil {
 		util.WriteErrorResponse(w, 500, err)
 		return
 	}
 
-	err = d.p.DeletePortMapping(int(localPort))
+	err = d.p.DeletePortMapping(int(localPort), opts)
 	if err != nil {
 		util.WriteErrorResponse(w, 500, err)
 		return
@@ -93,3 +159,485 @@ func (d *Httpd) handleListPortMapping(w http.ResponseWriter, r *http.Request) {
 	list := d.p.ListPortMapping()
 	util.WriteSuccessResponseWithData(w, list)
 }
+
+// parseLocalPort reads the port from the path of api v1 routes, or the
+// "localPort" query param.
+func parseLocalPort(r *http.Request) (int, error) {
+	localPortStr, found := mux.Vars(r)["port"]
+	if !found {
+		var err error
+		localPortStr, err = util.QueryParam(r, "localPort")
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	localPort, err := strconv.ParseInt(localPortStr, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return int(localPort), nil
+}
+
+func (d *Httpd) handleListConnections(w http.ResponseWriter, r *http.Request) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	list, err := d.p.ListConnections(localPort)
+	if err != nil {
+		util.WriteErrorResponse(w, 404, err)
+		return
+	}
+
+	util.WriteSuccessResponseWithData(w, list)
+}
+
+func (d *Httpd) handleEnablePortMapping(w http.ResponseWriter, r *http.Request) {
+	d.setPortMappingEnabled(w, r, true)
+}
+
+func (d *Httpd) handleDisablePortMapping(w http.ResponseWriter, r *http.Request) {
+	d.setPortMappingEnabled(w, r, false)
+}
+
+func (d *Httpd) setPortMappingEnabled(w http.ResponseWriter, r *http.Request,
+	enabled bool) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	old, err := d.p.GetPortMapping(localPort)
+	if err != nil {
+		writeMappingError(w, 500, err)
+		return
+	}
+
+	pmInfo, err := d.p.SetPortMappingEnabled(localPort, enabled)
+	if err == ErrPortMappingNotFound {
+		util.WriteErrorResponse(w, 404, err)
+		return
+	} else if err != nil {
+		util.WriteErrorResponse(w, 500, err)
+		return
+	}
+
+	err = d.s.AddPortMapping(pmInfo)
+	if err != nil {
+		d.p.SetPortMappingEnabled(localPort, old.IsEnabled())
+		util.WriteErrorResponse(w, 500, err)
+		return
+	}
+
+	util.WriteSuccessResponse(w)
+}
+
+func (d *Httpd) handleSetPortMappingLimits(w http.ResponseWriter, r *http.Request) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	limits := &PortMappingLimits{}
+	err = util.ParseJsonRequest(r, limits)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	old, err := d.p.GetPortMapping(localPort)
+	if err != nil {
+		writeMappingError(w, 500, err)
+		return
+	}
+
+	pmInfo, err := d.p.SetPortMappingLimits(localPort, limits)
+	if err == ErrPortMappingNotFound {
+		util.WriteErrorResponse(w, 404, err)
+		return
+	} else if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	err = d.s.AddPortMapping(pmInfo)
+	if err != nil {
+		d.p.SetPortMappingLimits(localPort, &old.PortMappingLimits)
+		util.WriteErrorResponse(w, 500, err)
+		return
+	}
+
+	util.WriteSuccessResponse(w)
+}
+
+func writeRouteError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrPortMappingNotFound, ErrSNIRouteNotFound, ErrHTTPRouteNotFound:
+		util.WriteErrorResponse(w, 404, err)
+	case ErrNotSNIPortMapping, ErrNotHTTPPortMapping:
+		util.WriteErrorResponse(w, 400, err)
+	default:
+		util.WriteErrorResponse(w, 500, err)
+	}
+}
+
+func (d *Httpd) handleAddSNIRoute(w http.ResponseWriter, r *http.Request) {
+	route := &SNIRoute{}
+	err := util.ParseJsonRequest(r, route)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	route.Hostname = normalizeHostname(route.Hostname)
+	err = validateSNIHostname(route.Hostname)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	_, _, err = net.SplitHostPort(route.RemoteAddr)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	old := d.findSNIRoute(route.LocalPort, route.Hostname)
+	err = d.p.AddSNIRoute(route)
+	if err != nil {
+		writeRouteError(w, err)
+		return
+	}
+
+	err = d.s.AddSNIRoute(route)
+	if err != nil {
+		if old != nil {
+			d.p.AddSNIRoute(old)
+		} else {
+			d.p.DeleteSNIRoute(route.LocalPort, route.Hostname)
+		}
+		util.WriteErrorResponse(w, 500, err)
+		return
+	}
+
+	util.WriteSuccessResponse(w)
+}
+
+// findSNIRoute returns the route of hostname on localPort, nil if none.
+func (d *Httpd) findSNIRoute(localPort int, hostname string) *SNIRoute {
+	routes, _ := d.p.ListSNIRoutes(localPort)
+	for _, route := range routes {
+		if route.Hostname == hostname {
+			return route
+		}
+	}
+	return nil
+}
+
+func (d *Httpd) handleDeleteSNIRoute(w http.ResponseWriter, r *http.Request) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	hostname, err := util.QueryParam(r, "hostname")
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+	hostname = normalizeHostname(hostname)
+
+	err = d.s.DeleteSNIRoute(localPort, hostname)
+	if err != nil {
+		util.WriteErrorResponse(w, 500, err)
+		return
+	}
+
+	err = d.p.DeleteSNIRoute(localPort, hostname)
+	if err != nil {
+		writeRouteError(w, err)
+		return
+	}
+
+	util.WriteSuccessResponse(w)
+}
+
+func (d *Httpd) handleListSNIRoute(w http.ResponseWriter, r *http.Request) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	list, err := d.p.ListSNIRoutes(localPort)
+	if err != nil {
+		writeRouteError(w, err)
+		return
+	}
+
+	util.WriteSuccessResponseWithData(w, list)
+}
+
+func (d *Httpd) handleAddHTTPRoute(w http.ResponseWriter, r *http.Request) {
+	route := &HTTPRoute{}
+	err := util.ParseJsonRequest(r, route)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	route.Host = normalizeHostname(route.Host)
+	route.PathPrefix = normalizePathPrefix(route.PathPrefix)
+	err = validateHTTPRoute(route)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	old := d.findHTTPRoute(route.LocalPort, route.Host, route.PathPrefix)
+	err = d.p.AddHTTPRoute(route)
+	if err != nil {
+		writeRouteError(w, err)
+		return
+	}
+
+	err = d.s.AddHTTPRoute(route)
+	if err != nil {
+		if old != nil {
+			d.p.AddHTTPRoute(old)
+		} else {
+			d.p.DeleteHTTPRoute(route.LocalPort, route.Host, route.PathPrefix)
+		}
+		util.WriteErrorResponse(w, 500, err)
+		return
+	}
+
+	util.WriteSuccessResponse(w)
+}
+
+// findHTTPRoute returns the route of host and pathPrefix on localPort, nil
+// if none.
+func (d *Httpd) findHTTPRoute(localPort int, host string, pathPrefix string) *HTTPRoute {
+	routes, _ := d.p.ListHTTPRoutes(localPort)
+	for _, route := range routes {
+		if route.Host == host && route.PathPrefix == pathPrefix {
+			return route
+		}
+	}
+	return nil
+}
+
+func (d *Httpd) handleDeleteHTTPRoute(w http.ResponseWriter, r *http.Request) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	host, err := util.QueryParam(r, "host")
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+	host = normalizeHostname(host)
+
+	pathPrefix, err := util.QueryParam(r, "pathPrefix")
+	if err != nil && err != util.ErrParamNotFound {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+	pathPrefix = normalizePathPrefix(pathPrefix)
+
+	err = d.s.DeleteHTTPRoute(localPort, host, pathPrefix)
+	if err != nil {
+		util.WriteErrorResponse(w, 500, err)
+		return
+	}
+
+	err = d.p.DeleteHTTPRoute(localPort, host, pathPrefix)
+	if err != nil {
+		writeRouteError(w, err)
+		return
+	}
+
+	util.WriteSuccessResponse(w)
+}
+
+func (d *Httpd) handleListHTTPRoute(w http.ResponseWriter, r *http.Request) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	list, err := d.p.ListHTTPRoutes(localPort)
+	if err != nil {
+		writeRouteError(w, err)
+		return
+	}
+
+	util.WriteSuccessResponseWithData(w, list)
+}
+
+func (d *Httpd) handleStartCapture(w http.ResponseWriter, r *http.Request) {
+	info := &CaptureInfo{}
+	err := util.ParseJsonRequest(r, info)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	err = d.p.StartCapture(info)
+	switch {
+	case err == nil:
+	case err == ErrPortMappingNotFound:
+		util.WriteErrorResponse(w, 404, err)
+		return
+	case err == ErrCaptureRunning || os.IsExist(err):
+		util.WriteErrorResponse(w, 409, err)
+		return
+	default:
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	util.WriteSuccessResponseWithData(w, info)
+}
+
+func (d *Httpd) handleStopCapture(w http.ResponseWriter, r *http.Request) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	err = d.p.StopCapture(localPort)
+	if err != nil {
+		util.WriteErrorResponse(w, 404, err)
+		return
+	}
+
+	util.WriteSuccessResponse(w)
+}
+
+func (d *Httpd) handleListCapture(w http.ResponseWriter, r *http.Request) {
+	list := d.p.ListCaptures()
+	util.WriteSuccessResponseWithData(w, list)
+}
+
+func (d *Httpd) handleAddToxic(w http.ResponseWriter, r *http.Request) {
+	toxic := &ToxicInfo{}
+	err := util.ParseJsonRequest(r, toxic)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	err = d.p.AddToxic(toxic)
+	switch err {
+	case nil:
+	case ErrPortMappingNotFound:
+		util.WriteErrorResponse(w, 404, err)
+		return
+	case ErrToxicExists:
+		util.WriteErrorResponse(w, 409, err)
+		return
+	default:
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	util.WriteSuccessResponseWithData(w, toxic)
+}
+
+func (d *Httpd) handleDeleteToxic(w http.ResponseWriter, r *http.Request) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	name, err := util.QueryParam(r, "name")
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	err = d.p.DeleteToxic(localPort, name)
+	if err != nil {
+		util.WriteErrorResponse(w, 404, err)
+		return
+	}
+
+	util.WriteSuccessResponse(w)
+}
+
+func (d *Httpd) handleListToxic(w http.ResponseWriter, r *http.Request) {
+	localPort, err := parseLocalPort(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	list, err := d.p.ListToxics(localPort)
+	if err != nil {
+		util.WriteErrorResponse(w, 404, err)
+		return
+	}
+
+	util.WriteSuccessResponseWithData(w, list)
+}
+
+// ApplyConfig makes the proxy and the store match c. The store is updated
+// before the new mappings are swapped in, so a failed update leaves both
+// unchanged. If dryRun is true only the diff is returned.
+func (d *Httpd) ApplyConfig(c *Config, opts *StopOptions, dryRun bool) (*ConfigDiff, error) {
+	if dryRun {
+		return d.p.DiffConfig(c)
+	}
+
+	return d.p.ApplyConfig(c, opts, func() error {
+		return d.s.CleanAndUpdate(c.Mappings)
+	})
+}
+
+func (d *Httpd) handleApplyConfig(w http.ResponseWriter, r *http.Request) {
+	c := &Config{}
+	err := util.ParseJsonRequest(r, c)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	err = c.Validate()
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	opts, err := parseStopOptions(r)
+	if err != nil {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	dryRun, err := util.QueryParam(r, "dryRun")
+	if err != nil && err != util.ErrParamNotFound {
+		util.WriteErrorResponse(w, 400, err)
+		return
+	}
+
+	diff, err := d.ApplyConfig(c, opts, dryRun == "true")
+	if err != nil {
+		util.WriteErrorResponse(w, 500, err)
+		return
+	}
+
+	util.WriteSuccessResponseWithData(w, diff)
+}
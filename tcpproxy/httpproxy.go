@@ -0,0 +1,337 @@
+package tcpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MoZhonghua/mytools/util/dialer"
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrNotHTTPPortMapping = errors.New("not a http port mapping")
+	ErrHTTPRouteNotFound  = errors.New("http route not found")
+)
+
+const (
+	httpDialTimeout         = 10 * time.Second
+	httpIdleConnTimeout     = 90 * time.Second
+	httpMaxIdleConnsPerHost = 32
+)
+
+type httpTargetKey struct{}
+
+func normalizePathPrefix(pathPrefix string) string {
+	if !strings.HasPrefix(pathPrefix, "/") {
+		pathPrefix = "/" + pathPrefix
+	}
+	return pathPrefix
+}
+
+// httpRouter reverse proxies requests of a http port mapping. Backend
+// connections are kept alive and reused across client connections.
+type httpRouter struct {
+	m         *portMapping
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+
+	mu sync.RWMutex
+	// routes of each host, sorted by path prefix from the longest
+	hosts map[string][]*HTTPRoute
+}
+
+func newHTTPRouter(m *portMapping) *httpRouter {
+	r := &httpRouter{
+		m:     m,
+		hosts: make(map[string][]*HTTPRoute),
+	}
+
+	var d dialer.Dialer = &net.Dialer{
+		Timeout:   httpDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if len(m.info.Upstream) > 0 {
+		d = m.upstream
+	}
+	r.transport = &http.Transport{
+		DialContext:         d.DialContext,
+		MaxIdleConnsPerHost: httpMaxIdleConnsPerHost,
+		IdleConnTimeout:     httpIdleConnTimeout,
+	}
+	r.proxy = &httputil.ReverseProxy{
+		Director:     r.direct,
+		Transport:    r.transport,
+		ErrorHandler: r.handleError,
+	}
+	return r
+}
+
+func (r *httpRouter) closeIdleConnections() {
+	r.transport.CloseIdleConnections()
+}
+
+func (r *httpRouter) add(route *HTTPRoute) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routes := r.hosts[route.Host]
+	replaced := false
+	for i, old := range routes {
+		if old.PathPrefix == route.PathPrefix {
+			routes[i] = route
+			replaced = true
+		}
+	}
+	if !replaced {
+		routes = append(routes, route)
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		return len(routes[i].PathPrefix) > len(routes[j].PathPrefix)
+	})
+	r.hosts[route.Host] = routes
+}
+
+func (r *httpRouter) delete(host string, pathPrefix string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routes := r.hosts[host]
+	for i, route := range routes {
+		if route.PathPrefix != pathPrefix {
+			continue
+		}
+
+		routes = append(routes[:i:i], routes[i+1:]...)
+		if len(routes) == 0 {
+			delete(r.hosts, host)
+		} else {
+			r.hosts[host] = routes
+		}
+		return nil
+	}
+	return ErrHTTPRouteNotFound
+}
+
+func (r *httpRouter) list() []*HTTPRoute {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make([]*HTTPRoute, 0)
+	for _, routes := range r.hosts {
+		result = append(result, routes...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Host != result[j].Host {
+			return result[i].Host < result[j].Host
+		}
+		return result[i].PathPrefix < result[j].PathPrefix
+	})
+	return result
+}
+
+func (r *httpRouter) lookup(host string, path string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, found := matchHostname(host, func(name string) bool {
+		_, found := r.hosts[name]
+		return found
+	})
+	if found {
+		for _, route := range r.hosts[key] {
+			if strings.HasPrefix(path, route.PathPrefix) {
+				return route.RemoteAddr, true
+			}
+		}
+	}
+
+	return r.m.remotes.pick()
+}
+
+func (r *httpRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	target, found := r.lookup(req.Host, req.URL.Path)
+	if !found {
+		http.Error(w, "no route for "+req.Host+req.URL.Path, http.StatusNotFound)
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), httpTargetKey{}, target)
+	r.proxy.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// direct rewrites the request to the backend chosen by ServeHTTP.
+// ReverseProxy itself appends the client to X-Forwarded-For.
+func (r *httpRouter) direct(req *http.Request) {
+	req.URL.Scheme = "http"
+	req.URL.Host = req.Context().Value(httpTargetKey{}).(string)
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+}
+
+func (r *httpRouter) handleError(w http.ResponseWriter, req *http.Request, err error) {
+	if req.Context().Err() != nil {
+		// the client went away, nobody reads a response
+		log.Debugf("client of %s%s gone: %v", req.Host, req.URL.Path, err)
+		return
+	}
+
+	r.m.stats.dialFailed()
+	log.Infof("failed to proxy %s%s to %v: %v", req.Host, req.URL.Path,
+		req.URL.Host, err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// servHTTP serves l with the http router until l is closed.
+func (m *portMapping) servHTTP(l net.Listener, stopCh chan int) {
+	defer m.waitStopped.Done()
+
+	var hl net.Listener = &trackedListener{Listener: l, m: m}
+	if m.tlsConfig != nil {
+		hl = tls.NewListener(hl, m.tlsConfig)
+	}
+
+	srv := &http.Server{
+		Handler:     m.http,
+		IdleTimeout: httpIdleConnTimeout,
+	}
+	if t := m.getAccess().idleTimeout; t > 0 {
+		srv.IdleTimeout = t
+	}
+	err := srv.Serve(hl)
+	select {
+	case <-stopCh:
+		// requests of a replaced mapping still in flight are the last
+		// ones on their connections
+		srv.SetKeepAlivesEnabled(false)
+	default:
+		log.Errorf("http port mapping :%d: %v", m.localPort, err)
+	}
+}
+
+// trackedListener registers accepted connections to the port mapping so
+// they are counted in stats and closed by closeConns.
+type trackedListener struct {
+	net.Listener
+	m *portMapping
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		m := l.m
+		if !m.admit(c) {
+			c.Close()
+			continue
+		}
+
+		m.stats.connAccepted()
+		if !m.trackConn(c) {
+			m.release()
+			c.Close()
+			continue
+		}
+
+		m.waitConns.Add(1)
+		return &trackedConn{
+			Conn:  c,
+			m:     m,
+			cs:    m.stats.addConn(c.RemoteAddr().String(), ""),
+			entry: m.newAccessLogEntry(c, 0),
+		}, nil
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	m     *portMapping
+	cs    *connStats
+	entry *AccessLogEntry
+	once  sync.Once
+
+	// the first read error, decides the close reason
+	mu      sync.Mutex
+	readErr error
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.cs.bytesUp, int64(n))
+	if err != nil {
+		c.mu.Lock()
+		if c.readErr == nil {
+			c.readErr = err
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.cs.bytesDown, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.m.untrackConn(c.Conn)
+		c.m.stats.removeConn(c.cs)
+
+		c.mu.Lock()
+		readErr := c.readErr
+		c.mu.Unlock()
+		c.entry.Reason = CloseReasonClosed
+		if readErr != nil {
+			c.entry.Reason = closeReason(true, readErr)
+		}
+		if readErr != nil && readErr != io.EOF && !isClosedError(readErr) {
+			c.entry.Error = readErr.Error()
+		}
+		c.m.writeAccessLog(c.entry, c.cs)
+
+		c.m.release()
+		c.m.waitConns.Done()
+	})
+	return err
+}
+
+func validateHTTPRoute(route *HTTPRoute) error {
+	err := validateSNIHostname(route.Host)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = net.SplitHostPort(route.RemoteAddr)
+	if err != nil {
+		return fmt.Errorf("invalid remote address: %v", err)
+	}
+	return nil
+}
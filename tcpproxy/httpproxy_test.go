@@ -0,0 +1,209 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newNamedHTTPServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			c, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+				"Upgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			rw.Flush()
+			io.Copy(c, rw)
+			return
+		}
+
+		fmt.Fprintf(w, "%s %s %s %s", name, r.URL.Path,
+			r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"))
+	}))
+}
+
+func httpGet(t *testing.T, port int, host string, path string) string {
+	req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%d %s", resp.StatusCode, body)
+}
+
+func TestHTTPPortMapping(t *testing.T) {
+	a := newNamedHTTPServer("a")
+	defer a.Close()
+	b := newNamedHTTPServer("b")
+	defer b.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+
+	port := freePort(t)
+	info := &PortMappingInfo{
+		LocalPort: port,
+		Type:      PortMappingTypeHTTP,
+	}
+	err := p.AddPortMapping(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := []*HTTPRoute{
+		{LocalPort: port, Host: "a.example.com", PathPrefix: "/", RemoteAddr: a.Listener.Addr().String()},
+		{LocalPort: port, Host: "a.example.com", PathPrefix: "/api", RemoteAddr: b.Listener.Addr().String()},
+		{LocalPort: port, Host: "*.example.com", RemoteAddr: b.Listener.Addr().String()},
+	}
+	for _, route := range routes {
+		if err := p.AddHTTPRoute(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		host string
+		path string
+		want string
+	}{
+		{"a.example.com", "/index.html", "200 a /index.html 127.0.0.1 http"},
+		{"a.example.com:80", "/api/v1", "200 b /api/v1 127.0.0.1 http"},
+		{"c.example.com", "/", "200 b / 127.0.0.1 http"},
+		{"other.org", "/", "404 no route for other.org/\n"},
+	}
+	for _, c := range cases {
+		got := httpGet(t, port, c.host, c.path)
+		if got != c.want {
+			t.Errorf("GET %s%s = %q, want %q", c.host, c.path, got, c.want)
+		}
+	}
+
+	stats := p.ListPortMapping()[0].Stats
+	if stats.TotalConns == 0 || stats.BytesUp == 0 || stats.BytesDown == 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestHTTPPortMappingWebSocket(t *testing.T) {
+	a := newNamedHTTPServer("a")
+	defer a.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+
+	port := freePort(t)
+	info := &PortMappingInfo{
+		LocalPort:  port,
+		RemoteAddr: a.Listener.Addr().String(),
+		Type:       PortMappingTypeHTTP,
+	}
+	err := p.AddPortMapping(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+
+	fmt.Fprintf(c, "GET /ws HTTP/1.1\r\nHost: a\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+
+	fmt.Fprintf(c, "ping\n")
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(line) != "ping" {
+		t.Fatalf("unexpected echo: %q", line)
+	}
+
+	// deleting the mapping closes the upgraded connection as well
+	err = p.DeletePortMapping(port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(t, c)
+}
+
+func TestHTTPPortMappingClientGone(t *testing.T) {
+	started := make(chan int, 1)
+	release := make(chan int)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- 1
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := freePort(t)
+	err := p.AddPortMapping(&PortMappingInfo{LocalPort: port, Type: PortMappingTypeHTTP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.AddHTTPRoute(&HTTPRoute{LocalPort: port, Host: "slow.example.com",
+		RemoteAddr: slow.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("tcp4", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: slow.example.com\r\n\r\n")
+	<-started
+	c.Close()
+
+	// the aborted request isn't a dial failure
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		stats := p.ListPortMapping()[0].Stats
+		if stats.ActiveConns == 0 {
+			if stats.DialFailures != 0 {
+				t.Errorf("dial failures: %d", stats.DialFailures)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection still open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
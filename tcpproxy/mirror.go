@@ -0,0 +1,234 @@
+package tcpproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MoZhonghua/mytools/util/dialer"
+	"github.com/MoZhonghua/mytools/util/relay"
+	log "github.com/Sirupsen/logrus"
+)
+
+var ErrMirrorNotSupported = errors.New("mirror not supported for http port mapping")
+
+const (
+	defaultMirrorBufferSize = 1 << 20
+	maxMirrorBufferSize     = 64 << 20
+
+	// how long the shadow may take to finish once the client connection
+	// is done
+	mirrorLinger = 2 * time.Second
+)
+
+func validateMirror(info *PortMappingInfo) error {
+	c := info.Mirror
+	if c == nil {
+		return nil
+	}
+	if info.GetType() == PortMappingTypeHTTP {
+		return ErrMirrorNotSupported
+	}
+
+	_, _, err := net.SplitHostPort(c.RemoteAddr)
+	if err != nil {
+		return fmt.Errorf("invalid mirror address: %v", err)
+	}
+	if c.BufferSize < 0 || c.BufferSize > maxMirrorBufferSize {
+		return fmt.Errorf("mirror buffer size must be between 0 and %d", maxMirrorBufferSize)
+	}
+	return nil
+}
+
+// connMirror sends the data of one client connection to the shadow remote.
+// The client side never waits for the shadow: data is queued, and dropped
+// once the queue is full or the shadow failed.
+type connMirror struct {
+	addr  string
+	size  int
+	stats *mappingStats
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	conn  net.Conn
+	queue [][]byte
+	// bytes queued or being written
+	queued   int
+	inflight int
+	// the client finished sending
+	eof bool
+	// mirroring stopped, later data is dropped
+	broken bool
+}
+
+// mirrorConn starts mirroring a connection accepted on the port at offset
+// from the first one, it returns nil if the mapping has no mirror.
+func (m *portMapping) mirrorConn(offset int) *connMirror {
+	c := m.info.Mirror
+	if c == nil {
+		return nil
+	}
+
+	mc := &connMirror{
+		addr:  offsetAddr(c.RemoteAddr, offset),
+		size:  c.BufferSize,
+		stats: m.stats,
+	}
+	if mc.size == 0 {
+		mc.size = defaultMirrorBufferSize
+	}
+	mc.cond = sync.NewCond(&mc.mu)
+	go mc.run(m.upstream)
+	return mc
+}
+
+// data queues a copy of p for the shadow.
+func (mc *connMirror) data(p []byte) {
+	if mc == nil {
+		return
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.broken {
+		atomic.AddInt64(&mc.stats.mirrorDropped, int64(len(p)))
+		return
+	}
+	if mc.queued+len(p) > mc.size {
+		log.Infof("mirror %s is more than %d bytes behind, stop mirroring", mc.addr, mc.size)
+		mc.stop(len(p))
+		return
+	}
+
+	mc.queue = append(mc.queue, append([]byte(nil), p...))
+	mc.queued += len(p)
+	mc.cond.Signal()
+}
+
+// fin tells the shadow the client is done once the queue is sent, which
+// may take up to mirrorLinger.
+func (mc *connMirror) fin() {
+	if mc == nil {
+		return
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.eof {
+		return
+	}
+	mc.eof = true
+	if mc.conn != nil {
+		mc.conn.SetDeadline(time.Now().Add(mirrorLinger))
+	}
+	mc.cond.Signal()
+}
+
+// stop drops the queue along with n bytes not queued, mc.mu must be held.
+// Data being written is accounted by sent.
+func (mc *connMirror) stop(n int) {
+	atomic.AddInt64(&mc.stats.mirrorDropped, int64(mc.queued-mc.inflight+n))
+	mc.broken = true
+	mc.queue = nil
+	mc.queued = 0
+	if mc.conn != nil {
+		mc.conn.Close()
+	}
+	mc.cond.Signal()
+}
+
+// next waits for data to send, it returns nil once there is no more.
+func (mc *connMirror) next() []byte {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for len(mc.queue) == 0 && !mc.eof && !mc.broken {
+		mc.cond.Wait()
+	}
+	if len(mc.queue) == 0 {
+		return nil
+	}
+	p := mc.queue[0]
+	mc.queue[0] = nil
+	mc.queue = mc.queue[1:]
+	mc.inflight = len(p)
+	return p
+}
+
+// sent accounts for p taken off the queue, err is the result of writing it.
+func (mc *connMirror) sent(p []byte, err error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.inflight = 0
+	if err != nil {
+		atomic.AddInt64(&mc.stats.mirrorDropped, int64(len(p)))
+		if !mc.broken {
+			log.Infof("mirror %s: %v", mc.addr, err)
+			mc.queued -= len(p)
+			mc.stop(0)
+		}
+		return
+	}
+	if !mc.broken {
+		mc.queued -= len(p)
+	}
+	atomic.AddInt64(&mc.stats.mirrorBytes, int64(len(p)))
+}
+
+func (mc *connMirror) run(d dialer.Dialer) {
+	c, err := dialer.DialTimeout(d, "tcp4", mc.addr, remoteDialTimeout)
+
+	mc.mu.Lock()
+	if err != nil {
+		log.Infof("failed to connect mirror %s: %v", mc.addr, err)
+		mc.stop(0)
+		mc.mu.Unlock()
+		return
+	}
+	if mc.broken {
+		mc.mu.Unlock()
+		c.Close()
+		return
+	}
+	mc.conn = c
+	if mc.eof {
+		c.SetDeadline(time.Now().Add(mirrorLinger))
+	}
+	mc.mu.Unlock()
+	defer c.Close()
+
+	discarded := make(chan int)
+	go func() {
+		io.Copy(ioutil.Discard, c)
+		close(discarded)
+	}()
+
+	for {
+		p := mc.next()
+		if p == nil {
+			break
+		}
+		_, err := c.Write(p)
+		mc.sent(p, err)
+		if err != nil {
+			return
+		}
+	}
+
+	mc.mu.Lock()
+	broken := mc.broken
+	mc.mu.Unlock()
+	if !broken {
+		// let the shadow respond until it closes or mirrorLinger passes
+		relay.CloseWrite(c)
+		<-discarded
+	}
+}
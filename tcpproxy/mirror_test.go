@@ -0,0 +1,170 @@
+package tcpproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func addMirrorPortMapping(t *testing.T, p *Proxy, remote net.Listener, mirror *MirrorConfig) int {
+	port := freePort(t)
+	err := p.AddPortMapping(&PortMappingInfo{
+		LocalPort:  port,
+		RemoteAddr: remote.Addr().String(),
+		Mirror:     mirror,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+// waitMirrorStats waits until the mirror has sent or dropped n bytes.
+func waitMirrorStats(t *testing.T, p *Proxy, port int, n int64) *PortMappingStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := p.GetPortMapping(port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := info.Stats
+		if s.MirrorBytes+s.MirrorDropped >= n {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mirror stats: %+v, want %d bytes", s, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	shadow, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shadow.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := shadow.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// responses of the shadow never reach the client
+		c.Write([]byte("shadow"))
+		data, _ := ioutil.ReadAll(c)
+		received <- data
+	}()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addMirrorPortMapping(t, p, echo, &MirrorConfig{RemoteAddr: shadow.Addr().String()})
+
+	c := dialAndEcho(t, port)
+	c.Write([]byte("world"))
+	buf := make([]byte, 5)
+	io.ReadFull(c, buf)
+	if string(buf) != "world" {
+		t.Errorf("echo: %q", buf)
+	}
+	c.Close()
+
+	select {
+	case data := <-received:
+		if string(data) != "helloworld" {
+			t.Errorf("shadow received %q", data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("shadow not closed")
+	}
+	s := waitMirrorStats(t, p, port, 10)
+	if s.MirrorBytes != 10 || s.MirrorDropped != 0 {
+		t.Errorf("stats: %+v", s)
+	}
+}
+
+// TestMirrorSlowShadow checks a shadow that never reads doesn't hold back
+// the primary connection.
+func TestMirrorSlowShadow(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	shadow, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shadow.Close()
+	done := make(chan int)
+	defer close(done)
+	go func() {
+		c, err := shadow.Accept()
+		if err != nil {
+			return
+		}
+		<-done
+		c.Close()
+	}()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addMirrorPortMapping(t, p, echo, &MirrorConfig{
+		RemoteAddr: shadow.Addr().String(),
+		BufferSize: 64 << 10,
+	})
+
+	c := dialAndEcho(t, port)
+	defer c.Close()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<20)
+	go c.Write(data)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(c, buf)
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("echo through slow mirror: %v", err)
+	}
+	c.Close()
+
+	total := int64(len(data) + 5)
+	s := waitMirrorStats(t, p, port, total)
+	if s.MirrorDropped == 0 || s.MirrorBytes+s.MirrorDropped != total {
+		t.Errorf("stats: %+v, want %d bytes", s, total)
+	}
+}
+
+func TestMirrorShadowDown(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addMirrorPortMapping(t, p, echo, &MirrorConfig{
+		RemoteAddr: net.JoinHostPort("127.0.0.1", "1"),
+	})
+
+	dialAndEcho(t, port).Close()
+	s := waitMirrorStats(t, p, port, 5)
+	if s.MirrorBytes != 0 || s.MirrorDropped != 5 {
+		t.Errorf("stats: %+v", s)
+	}
+}
+
+func TestValidateMirror(t *testing.T) {
+	for _, info := range []*PortMappingInfo{
+		{LocalPort: 1, RemoteAddr: "127.0.0.1:80", Mirror: &MirrorConfig{RemoteAddr: "bad"}},
+		{LocalPort: 1, RemoteAddr: "127.0.0.1:80",
+			Mirror: &MirrorConfig{RemoteAddr: "127.0.0.1:81", BufferSize: -1}},
+		{LocalPort: 1, Type: PortMappingTypeHTTP,
+			Mirror: &MirrorConfig{RemoteAddr: "127.0.0.1:81"}},
+	} {
+		if validateMirror(info) == nil {
+			t.Errorf("%+v accepted", info.Mirror)
+		}
+	}
+}
@@ -3,28 +3,161 @@ package tcpproxy
 import (
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MoZhonghua/mytools/util/relay"
+	log "github.com/Sirupsen/logrus"
 )
 
-func pipe(r net.Conn, w net.Conn, done *sync.WaitGroup) {
+func setKeepAlive(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+	}
+}
+
+// proxyConn is a client connection proxied to a remote. capture, toxics
+// and mirror may be nil.
+type proxyConn struct {
+	// unix nano time of the last read in either direction
+	lastActive int64
+
+	client  net.Conn
+	remote  net.Conn
+	stats   *connStats
+	capture *connCapture
+	toxics  *connToxics
+	mirror  *connMirror
+
+	// idleTimeout closes the connection after no traffic in either
+	// direction for that long, zero means never
+	idleTimeout time.Duration
+
+	// reason and err of the direction that ended first
+	endOnce sync.Once
+	reason  string
+	err     error
+}
+
+func (pc *proxyConn) end(reason string, err error) {
+	pc.endOnce.Do(func() {
+		pc.reason = reason
+		pc.err = err
+	})
+}
+
+// run pipes both directions until they are closed.
+func (pc *proxyConn) run() {
+	atomic.StoreInt64(&pc.lastActive, time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go pc.pipe(true, &wg)
+	go pc.pipe(false, &wg)
+	wg.Wait()
+	pc.toxics.finish()
+	pc.mirror.fin()
+}
+
+// direct reports whether data can be copied without looking at it, which
+// lets the kernel splice it between tcp connections.
+func (pc *proxyConn) direct() bool {
+	return pc.capture == nil && pc.mirror == nil && pc.idleTimeout == 0 &&
+		!pc.toxics.active()
+}
+
+// pipe copies one direction, up is from the client to the remote.
+func (pc *proxyConn) pipe(up bool, done *sync.WaitGroup) {
 	defer done.Done()
-	w.(*net.TCPConn).SetKeepAlive(true)
-	r.(*net.TCPConn).SetKeepAlive(true)
+	defer pc.capture.fin(up)
+	if up {
+		defer pc.mirror.fin()
+	}
 
-	buf := make([]byte, 4096)
+	r, w, counter := pc.client, pc.remote, &pc.stats.bytesUp
+	if !up {
+		r, w, counter = pc.remote, pc.client, &pc.stats.bytesDown
+	}
+	setKeepAlive(w)
+	setKeepAlive(r)
+
+	buf := relay.GetBuffer()
+	defer relay.PutBuffer(buf)
 	for {
+		if pc.direct() {
+			// counters lag behind by at most one chunk
+			n, err := relay.CopyChunk(w, r, relay.ChunkSize, buf)
+			atomic.AddInt64(counter, n)
+			if err == nil {
+				continue
+			}
+			if isTimeout(err) {
+				// interrupted to apply a new toxic, see interruptConns
+				r.SetReadDeadline(time.Time{})
+				continue
+			}
+			pc.end(closeReason(up, err), err)
+			relay.CloseWrite(w)
+			return
+		}
+
+		if pc.idleTimeout > 0 {
+			r.SetReadDeadline(time.Now().Add(pc.idleTimeout))
+		}
+
 		n, err := r.Read(buf)
-		remain := buf[:n]
-		for len(remain) > 0 {
-			n2, err := w.Write(remain)
-			if err != nil {
+		if n > 0 {
+			atomic.StoreInt64(&pc.lastActive, time.Now().UnixNano())
+			pc.capture.data(up, buf[:n])
+			if up {
+				pc.mirror.data(buf[:n])
+			}
+			if err := pc.toxics.write(up, w, buf[:n], counter); err != nil {
+				// a failed write is the fault of the other side
+				pc.end(closeReason(!up, err), err)
 				return
 			}
+		}
+		if isTimeout(err) {
+			if pc.idleTimeout == 0 {
+				// interrupted by interruptConns
+				r.SetReadDeadline(time.Time{})
+				continue
+			}
 
-			remain = remain[n2:]
+			// the other direction may still be busy
+			last := time.Unix(0, atomic.LoadInt64(&pc.lastActive))
+			if time.Since(last) < pc.idleTimeout {
+				continue
+			}
+			log.Infof("close idle connection %v", pc.client.RemoteAddr())
+			pc.end(CloseReasonTimeout, nil)
+			pc.client.Close()
+			pc.remote.Close()
+			return
 		}
 		if err != nil {
-			w.(*net.TCPConn).CloseWrite()
+			pc.end(closeReason(up, err), err)
+			relay.CloseWrite(w)
 			return
 		}
 	}
 }
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func writeAll(w net.Conn, p []byte, counter *int64) error {
+	for len(p) > 0 {
+		n, err := w.Write(p)
+		if err != nil {
+			return err
+		}
+
+		atomic.AddInt64(counter, int64(n))
+		p = p[n:]
+	}
+	return nil
+}
@@ -1,96 +1,613 @@
 package tcpproxy
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/MoZhonghua/mytools/util/dialer"
 	log "github.com/Sirupsen/logrus"
 )
 
+// StopOptions controls what happens to established connections when a port
+// mapping is deleted or the proxy is closed.
+type StopOptions struct {
+	// Drain waits for established connections to finish instead of closing
+	// them immediately.
+	Drain bool
+	// DrainTimeout bounds the wait, connections still open afterwards are
+	// closed. Zero means wait forever.
+	DrainTimeout time.Duration
+}
+
 type portMapping struct {
+	// connections admitted and not released yet, see admit
+	numConns int64
+	// numConns of this mapping and of the mappings it replaced whose
+	// connections are still open, which maxConns applies to
+	liveConns *int64
+
+	info        *PortMappingInfo
 	localPort   int
-	remoteAddr  *net.TCPAddr
+	remotes     *remotePool
+	upstream    dialer.Dialer
+	stats       *mappingStats
+	tlsConfig   *tls.Config
+	remoteTLS   *remoteTLS
+	sni         *sniRouter
+	http        *httpRouter
+	transparent *transparent
+	running     bool
+	listeners   []*portListener
 	stopCh      chan int
 	waitStopped sync.WaitGroup
+
+	connsMu   sync.Mutex
+	closing   bool
+	conns     map[net.Conn]struct{}
+	waitConns sync.WaitGroup
+
+	// mappings replaced by this one whose connections are still open,
+	// see Proxy.UpdatePortMapping
+	retired []*portMapping
+
+	captureMu sync.Mutex
+	capture   *capture
+
+	toxicsMu sync.Mutex
+	toxics   atomic.Value
+
+	access    atomic.Value
+	accessLog *accessLog
 }
 
-func newPortMapping(localPort int, remoteAddr *net.TCPAddr) *portMapping {
+// newPortMapping creates a stopped port mapping, connections are logged to
+// accessLog, which may be nil.
+func newPortMapping(info *PortMappingInfo, accessLog *accessLog) (*portMapping, error) {
+	err := validateRemotes(info)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validatePortRange(info)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateTransparent(info)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateMirror(info)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream, err := dialer.New(info.Upstream, dialer.Direct)
+	if err != nil {
+		return nil, err
+	}
+
+	remotes, err := newRemotePool(info, upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	access, err := newAccessControl(&info.PortMappingLimits)
+	if err != nil {
+		return nil, err
+	}
+
 	m := &portMapping{
-		localPort:  localPort,
-		remoteAddr: remoteAddr,
-		stopCh:     make(chan int),
+		info:      info,
+		localPort: info.LocalPort,
+		remotes:   remotes,
+		upstream:  upstream,
+		stats:     newMappingStats(),
+		liveConns: new(int64),
+		conns:     make(map[net.Conn]struct{}),
+		accessLog: accessLog,
+	}
+	m.access.Store(access)
+
+	switch info.GetType() {
+	case PortMappingTypeTCP:
+	case PortMappingTypeSNI:
+		if info.TLS != nil || info.RemoteTLS != nil {
+			return nil, fmt.Errorf("sni port mapping can't terminate or originate tls")
+		}
+		m.sni = newSNIRouter()
+	case PortMappingTypeHTTP:
+		if info.RemoteTLS != nil {
+			return nil, fmt.Errorf("http port mapping can't originate tls")
+		}
+		m.http = newHTTPRouter(m)
+	case PortMappingTypeTransparent:
+		m.transparent, err = newTransparent(info.Transparent)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown port mapping type: %s", info.Type)
+	}
+
+	if info.TLS != nil {
+		cfg, err := newServerTLSConfig(info.TLS)
+		if err != nil {
+			return nil, err
+		}
+		m.tlsConfig = cfg
+	}
+
+	if info.RemoteTLS != nil {
+		t, err := newRemoteTLS(info.RemoteTLS)
+		if err != nil {
+			return nil, err
+		}
+		m.remoteTLS = t
+	}
+	return m, nil
+}
+
+// shareConns counts the connections of old, which m is going to replace,
+// against the connection limit of m. It must be called before m starts.
+func (m *portMapping) shareConns(old *portMapping) {
+	m.liveConns = old.liveConns
+}
+
+// takeOver inherits the state of old, which m replaces without closing
+// its connections: stats, the running capture and the mappings whose
+// connections are still open, on top of what inherit copies.
+func (m *portMapping) takeOver(old *portMapping) {
+	m.inherit(old)
+	m.stats = old.stats
+
+	old.captureMu.Lock()
+	if m.http == nil {
+		m.capture = old.capture
+		if m.capture != nil {
+			m.capture.setOnStop(m.removeCapture)
+		}
+	} else if old.capture != nil {
+		defer old.capture.close()
+	}
+	old.capture = nil
+	old.captureMu.Unlock()
+
+	for _, r := range old.retired {
+		if r.hasConns() {
+			m.retired = append(m.retired, r)
+		}
+	}
+	if old.hasConns() {
+		m.retired = append(m.retired, old)
 	}
-	return m
 }
 
+// shouldRun reports whether the mapping should be listening at t.
+func (m *portMapping) shouldRun(t time.Time) bool {
+	return m.info.IsEnabled() && inSchedule(m.info.Schedule, t)
+}
+
+// stop closes the listener. Established connections are left alone, see
+// closeConns.
 func (m *portMapping) stop() {
+	if !m.running {
+		return
+	}
+
 	close(m.stopCh)
+	for _, l := range m.listeners {
+		l.Close()
+	}
 	m.waitStopped.Wait()
-	log.Infof("close port mapping :%d -> %v", m.localPort, m.remoteAddr)
+	m.running = false
+	m.listeners = nil
+	log.Infof("close port mapping :%s -> %v", m.info.PortsString(), m.remotes)
 }
 
-func (m *portMapping) servLoop(l net.Listener) {
-	defer l.Close()
+// closeConns closes all established connections, including those of
+// retired mappings, and waits for their goroutines to exit. If opts asks
+// to drain, connections are first given a chance to finish on their own.
+func (m *portMapping) closeConns(opts *StopOptions) {
+	var wg sync.WaitGroup
+	for _, r := range m.retired {
+		wg.Add(1)
+		go func(r *portMapping) {
+			defer wg.Done()
+			r.closeOwnConns(opts)
+		}(r)
+	}
+	m.closeOwnConns(opts)
+	wg.Wait()
+}
+
+func (m *portMapping) closeOwnConns(opts *StopOptions) {
+	if opts != nil && opts.Drain {
+		done := make(chan int)
+		go func() {
+			m.waitConns.Wait()
+			close(done)
+		}()
+
+		var timeout <-chan time.Time
+		if opts.DrainTimeout > 0 {
+			timer := time.NewTimer(opts.DrainTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-done:
+			if m.http != nil {
+				m.http.closeIdleConnections()
+			}
+			return
+		case <-timeout:
+			log.Infof("drain port mapping :%d timeout, close remaining connections",
+				m.localPort)
+		}
+	}
+
+	m.connsMu.Lock()
+	m.closing = true
+	for c := range m.conns {
+		c.Close()
+	}
+	m.connsMu.Unlock()
+
+	m.waitConns.Wait()
+	if m.http != nil {
+		m.http.closeIdleConnections()
+	}
+}
+
+// trackConn registers c so closeConns can close it, it returns false if
+// the mapping is already closing connections.
+func (m *portMapping) trackConn(c net.Conn) bool {
+	m.connsMu.Lock()
+	defer m.connsMu.Unlock()
+
+	if m.closing {
+		return false
+	}
+	m.conns[c] = struct{}{}
+	return true
+}
+
+func (m *portMapping) untrackConn(c net.Conn) {
+	m.connsMu.Lock()
+	defer m.connsMu.Unlock()
+	delete(m.conns, c)
+}
+
+// interruptConns makes pending reads of established connections time out,
+// their pipes clear the deadline and pick up changed settings.
+func (m *portMapping) interruptConns() {
+	m.connsMu.Lock()
+	defer m.connsMu.Unlock()
+	for c := range m.conns {
+		c.SetReadDeadline(time.Unix(1, 0))
+	}
+}
+
+func (m *portMapping) servLoop(l net.Listener, port int, stopCh chan int) {
 	defer m.waitStopped.Done()
-	connCh := make(chan net.Conn, 64)
-	go func() {
-		for {
+
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
 			select {
-			case <-m.stopCh:
+			case <-stopCh:
 				return
 			default:
 			}
-			conn, err := l.Accept()
-			if err != nil {
-				log.Infof("%v", err)
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				log.Infof("accept on :%d: %v, retrying in %v", port, err, tempDelay)
+				time.Sleep(tempDelay)
 				continue
 			}
-			log.Infof("new connection @ %v", conn.LocalAddr())
-			connCh <- conn
-		}
-	}()
 
-	for {
-		select {
-		case <-m.stopCh:
+			log.Errorf("accept on :%d: %v", port, err)
 			return
-		case conn := <-connCh:
-			if conn == nil {
-				return
-			}
-			go m.handleConn(conn)
 		}
+
+		tempDelay = 0
+		if !m.admit(conn) {
+			conn.Close()
+			continue
+		}
+
+		log.Debugf("new connection @ %v", conn.LocalAddr())
+		m.waitConns.Add(1)
+		go m.handleConn(conn, port-m.localPort)
 	}
 }
 
+// start listens on all ports of the mapping. If any port can't be bound
+// the ports already bound are released and the error names the port.
 func (m *portMapping) start() error {
-	m.waitStopped.Add(1)
-	l, err := net.Listen("tcp4", fmt.Sprintf(":%d", m.localPort))
-	if err != nil {
-		return err
+	if m.running {
+		return nil
 	}
 
-	log.Infof("new port mapping :%d -> %v", m.localPort, m.remoteAddr)
+	var listeners []*portListener
+	for port := m.localPort; port <= m.info.GetLastPort(); port++ {
+		l, err := m.listen(port)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			if m.info.IsRange() {
+				log.Infof("failed to listen on :%d, release ports of range %s",
+					port, m.info.PortsString())
+			}
+			return err
+		}
+		listeners = append(listeners, &portListener{Listener: l})
+	}
 
-	go m.servLoop(l)
+	log.Infof("new port mapping :%s -> %v", m.info.PortsString(), m.remotes)
+	m.serve(listeners)
 	return nil
 }
 
-func (m *portMapping) handleConn(l net.Conn) error {
+// serve accepts connections on listeners, one for each port in order.
+func (m *portMapping) serve(listeners []*portListener) {
+	m.stopCh = make(chan int)
+	m.listeners = listeners
+	m.running = true
+	for i, l := range listeners {
+		m.waitStopped.Add(1)
+		if m.http != nil {
+			go m.servHTTP(l, m.stopCh)
+		} else {
+			go m.servLoop(l, m.localPort+i, m.stopCh)
+		}
+	}
+
+	if !m.remotes.empty() {
+		m.waitStopped.Add(1)
+		go m.watchRemotes(m.stopCh)
+	}
+}
+
+// detach stops serving like stop, but returns the listeners open so
+// another mapping can serve them.
+func (m *portMapping) detach() []*portListener {
+	close(m.stopCh)
+	for _, l := range m.listeners {
+		l.detach()
+	}
+	m.waitStopped.Wait()
+
+	listeners := make([]*portListener, 0, len(m.listeners))
+	for _, l := range m.listeners {
+		listeners = append(listeners, l.handover())
+	}
+	m.running = false
+	m.listeners = nil
+	return listeners
+}
+
+// hasConns reports whether connections are admitted and not closed yet.
+func (m *portMapping) hasConns() bool {
+	return atomic.LoadInt64(&m.numConns) > 0
+}
+
+func (m *portMapping) listen(port int) (net.Listener, error) {
+	if m.transparent != nil {
+		return m.transparent.listen(port)
+	}
+	return net.Listen("tcp4", fmt.Sprintf(":%d", port))
+}
+
+var errListenerDetached = errors.New("listener detached")
+
+type deadlineListener interface {
+	SetDeadline(t time.Time) error
+}
+
+// portListener can be handed over from one port mapping to another without
+// closing the socket, connections arriving meanwhile wait in the backlog.
+type portListener struct {
+	net.Listener
+	detached int32
+}
+
+func (l *portListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil && atomic.LoadInt32(&l.detached) != 0 {
+		return nil, errListenerDetached
+	}
+	return c, err
+}
+
+// Close does nothing once detached, http.Server closes its listener when
+// Serve returns.
+func (l *portListener) Close() error {
+	if atomic.LoadInt32(&l.detached) != 0 {
+		return nil
+	}
+	return l.Listener.Close()
+}
+
+// detach makes pending and later calls of Accept fail.
+func (l *portListener) detach() {
+	atomic.StoreInt32(&l.detached, 1)
+	l.Listener.(deadlineListener).SetDeadline(time.Unix(1, 0))
+}
+
+// handover returns the socket for its next owner.
+func (l *portListener) handover() *portListener {
+	l.Listener.(deadlineListener).SetDeadline(time.Time{})
+	return &portListener{Listener: l.Listener}
+}
+
+func (m *portMapping) watchRemotes(stopCh chan int) {
+	defer m.waitStopped.Done()
+	m.remotes.run(stopCh)
+}
+
+// handleConn proxies a connection accepted on the port offset from the
+// first port of the mapping.
+func (m *portMapping) handleConn(l net.Conn, offset int) (err error) {
+	defer m.waitConns.Done()
+	defer m.release()
 	defer l.Close()
-	r, err := net.Dial("tcp4", m.remoteAddr.String())
+
+	entry := m.newAccessLogEntry(l, offset)
+	var cs *connStats
+	defer func() {
+		if entry.Reason == "" {
+			entry.Reason = CloseReasonError
+			if err == nil {
+				entry.Reason = CloseReasonClosed
+			}
+		}
+		if err != nil && entry.Error == "" {
+			entry.Error = err.Error()
+		}
+		m.writeAccessLog(entry, cs)
+	}()
+
+	if !m.trackConn(l) {
+		return nil
+	}
+	defer m.untrackConn(l)
+
+	m.stats.connAccepted()
+	if m.tlsConfig != nil {
+		tc := tls.Server(l, m.tlsConfig)
+		err := tlsHandshake(tc)
+		if err != nil {
+			log.Infof("tls handshake with client %v failed: %v", l.RemoteAddr(), err)
+			return err
+		}
+		l = tc
+	}
+
+	l, remoteAddr, err := m.route(l)
 	if err != nil {
+		log.Infof("failed to route connection from %v: %v", l.RemoteAddr(), err)
+		entry.RemoteAddr = remoteAddr
+		return err
+	}
+
+	r, rm, err := m.dial(remoteAddr, offset)
+	if err != nil {
+		entry.Reason = CloseReasonDialError
+		entry.RemoteAddr = remoteAddr
+		if remoteAddr == "" {
+			entry.RemoteAddr = m.remotes.String()
+		}
 		return err
 	}
 	defer r.Close()
+	if !m.trackConn(r) {
+		return nil
+	}
+	defer m.untrackConn(r)
 
-	log.Infof("pipe %v -> %v ", l.LocalAddr(), r.RemoteAddr())
+	if rm != nil {
+		remoteAddr = rm.addr
+		atomic.AddInt64(&rm.activeConns, 1)
+		defer atomic.AddInt64(&rm.activeConns, -1)
+	}
+	entry.RemoteAddr = r.RemoteAddr().String()
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go pipe(l, r, &wg)
-	go pipe(r, l, &wg)
-	wg.Wait()
+	if m.remoteTLS != nil {
+		tc := tls.Client(r, m.remoteTLS.clientConfig(remoteAddr))
+		err = tlsHandshake(tc)
+		if err != nil {
+			log.Infof("tls handshake with remote %v failed: %v", r.RemoteAddr(), err)
+			return err
+		}
+		r = tc
+	}
+
+	log.Debugf("pipe %v -> %v ", l.LocalAddr(), r.RemoteAddr())
+
+	cs = m.stats.addConn(l.RemoteAddr().String(), r.RemoteAddr().String())
+	defer m.stats.removeConn(cs)
+
+	pc := &proxyConn{
+		client:      l,
+		remote:      r,
+		stats:       cs,
+		capture:     m.captureConn(l.RemoteAddr(), r.RemoteAddr()),
+		toxics:      newConnToxics(m, l, r),
+		mirror:      m.mirrorConn(offset),
+		idleTimeout: m.getAccess().idleTimeout,
+	}
+	pc.run()
+
+	entry.Reason = pc.reason
+	if pc.err != nil && pc.err != io.EOF {
+		entry.Error = pc.err.Error()
+	}
 	return nil
 }
+
+// dial connects to remoteAddr, or to the remote pool with its ports moved
+// by offset if remoteAddr is empty. The remote is nil in the former case.
+func (m *portMapping) dial(remoteAddr string, offset int) (net.Conn, *remote, error) {
+	if remoteAddr == "" {
+		return m.remotes.dial(m.stats, offset)
+	}
+
+	c, err := dialer.DialTimeout(m.upstream, "tcp4", remoteAddr, remoteDialTimeout)
+	if err != nil {
+		m.stats.dialFailed()
+		log.Warnf("failed to connect %v: %v", remoteAddr, err)
+		return nil, nil, err
+	}
+	return c, nil, nil
+}
+
+// route returns the remote address for a new connection, empty means
+// dialing the remote pool. For sni port mappings, the returned conn
+// replays the peeked ClientHello. The address of a transparent connection
+// is also returned when its destination isn't allowed.
+func (m *portMapping) route(l net.Conn) (net.Conn, string, error) {
+	if m.transparent != nil {
+		dst, err := m.transparent.destination(l, m.localPort)
+		if err == ErrDestinationNotAllowed {
+			m.stats.connRejected()
+		}
+		return l, dst, err
+	}
+	if m.sni == nil {
+		return l, "", nil
+	}
+
+	serverName, peeked, err := peekServerName(l)
+	if err != nil {
+		return l, "", err
+	}
+
+	remoteAddr, found := m.sni.lookup(serverName)
+	if found {
+		return peeked, remoteAddr, nil
+	}
+	if !m.remotes.empty() {
+		return peeked, "", nil
+	}
+	return l, "", fmt.Errorf("%v: %q", ErrNoSNIRoute, serverName)
+}
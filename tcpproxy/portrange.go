@@ -0,0 +1,108 @@
+package tcpproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxPortRange bounds the listeners of one port mapping.
+const maxPortRange = 1024
+
+// GetLastPort returns LocalPortEnd, or LocalPort for a single port.
+func (pm *PortMappingInfo) GetLastPort() int {
+	if pm.LocalPortEnd == 0 {
+		return pm.LocalPort
+	}
+	return pm.LocalPortEnd
+}
+
+// IsRange reports whether the port mapping covers more than one port.
+func (pm *PortMappingInfo) IsRange() bool {
+	return pm.GetLastPort() > pm.LocalPort
+}
+
+// PortsString returns "first-last" for a range and the port otherwise.
+func (pm *PortMappingInfo) PortsString() string {
+	if pm.IsRange() {
+		return fmt.Sprintf("%d-%d", pm.LocalPort, pm.GetLastPort())
+	}
+	return strconv.Itoa(pm.LocalPort)
+}
+
+// overlaps reports whether pm and other share a local port.
+func (pm *PortMappingInfo) overlaps(other *PortMappingInfo) bool {
+	return pm.LocalPort <= other.GetLastPort() && other.LocalPort <= pm.GetLastPort()
+}
+
+// ParsePortRange parses "port" or "first-last".
+func ParsePortRange(s string) (int, int, error) {
+	first, last := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+
+	p1, err := strconv.Atoi(first)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range: %s", s)
+	}
+	p2, err := strconv.Atoi(last)
+	if err != nil || p2 < p1 {
+		return 0, 0, fmt.Errorf("invalid port range: %s", s)
+	}
+	return p1, p2, nil
+}
+
+// validatePortRange checks that a range maps onto remote ports with the
+// same offset. Only tcp port mappings may cover a range, routes of the
+// other types have no port to offset.
+func validatePortRange(info *PortMappingInfo) error {
+	if info.LocalPortEnd == 0 {
+		return nil
+	}
+	if info.LocalPortEnd < info.LocalPort || info.LocalPortEnd > 65535 {
+		return fmt.Errorf("invalid local port range: %s", info.PortsString())
+	}
+	if info.LocalPortEnd-info.LocalPort >= maxPortRange {
+		return fmt.Errorf("port range %s has more than %d ports",
+			info.PortsString(), maxPortRange)
+	}
+	if !info.IsRange() {
+		return nil
+	}
+
+	if info.GetType() != PortMappingTypeTCP {
+		return errors.New("only tcp port mappings can cover a port range")
+	}
+	span := info.LocalPortEnd - info.LocalPort
+	for _, addr := range info.GetRemotes() {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid remote address: %v", err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p+span > 65535 {
+			return fmt.Errorf("remote %s can't cover %d ports", addr, span+1)
+		}
+	}
+	return nil
+}
+
+// offsetAddr adds offset to the port of the host:port addr.
+func offsetAddr(addr string, offset int) string {
+	if offset == 0 {
+		return addr
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p+offset))
+}
@@ -0,0 +1,147 @@
+package tcpproxy
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+// freePortRange returns the first of n consecutive free ports.
+func freePortRange(t *testing.T, n int) int {
+	for i := 0; i < 20; i++ {
+		first := freePort(t)
+		var listeners []net.Listener
+		for port := first; port < first+n; port++ {
+			l, err := net.Listen("tcp4", "0.0.0.0:"+strconv.Itoa(port))
+			if err != nil {
+				break
+			}
+			listeners = append(listeners, l)
+		}
+		for _, l := range listeners {
+			l.Close()
+		}
+		if len(listeners) == n {
+			return first
+		}
+	}
+	t.Fatalf("no %d consecutive free ports", n)
+	return 0
+}
+
+// listenNamed is startNamedServer on a given port.
+func listenNamed(t *testing.T, port int, name string) net.Listener {
+	l, err := net.Listen("tcp4", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte(name))
+			c.Close()
+		}
+	}()
+	return l
+}
+
+func TestPortRange(t *testing.T) {
+	remote := freePortRange(t, 3)
+	defer listenNamed(t, remote, "first").Close()
+	defer listenNamed(t, remote+2, "last").Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+
+	local := freePortRange(t, 3)
+	info := &PortMappingInfo{
+		LocalPort:    local,
+		LocalPortEnd: local + 2,
+		RemoteAddr:   "127.0.0.1:" + strconv.Itoa(remote),
+	}
+	err := p.AddPortMapping(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := readFrom(t, local); s != "first" {
+		t.Errorf("first port read %q", s)
+	}
+	if s := readFrom(t, local+2); s != "last" {
+		t.Errorf("last port read %q", s)
+	}
+
+	err = p.AddPortMapping(&PortMappingInfo{
+		LocalPort:  local + 1,
+		RemoteAddr: info.RemoteAddr,
+	})
+	if err != ErrLocalPortUsed {
+		t.Errorf("port inside range added: %v", err)
+	}
+
+	err = p.DeletePortMapping(local, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for port := local; port <= local+2; port++ {
+		l, err := net.Listen("tcp4", "0.0.0.0:"+strconv.Itoa(port))
+		if err != nil {
+			t.Fatalf("port %d not released: %v", port, err)
+		}
+		l.Close()
+	}
+}
+
+func TestPortRangePartialBind(t *testing.T) {
+	local := freePortRange(t, 3)
+	busy, err := net.Listen("tcp4", "0.0.0.0:"+strconv.Itoa(local+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	err = p.AddPortMapping(&PortMappingInfo{
+		LocalPort:    local,
+		LocalPortEnd: local + 2,
+		RemoteAddr:   deadAddr(t),
+	})
+	if err == nil || !isAddrInUse(err) {
+		t.Fatalf("range with a busy port: %v", err)
+	}
+
+	// the port bound before the failure is released
+	l, err := net.Listen("tcp4", "0.0.0.0:"+strconv.Itoa(local))
+	if err != nil {
+		t.Fatalf("first port not released: %v", err)
+	}
+	l.Close()
+	if len(p.ListPortMapping()) != 0 {
+		t.Error("failed range registered")
+	}
+}
+
+func TestValidatePortRange(t *testing.T) {
+	for _, info := range []*PortMappingInfo{
+		{LocalPort: 100, LocalPortEnd: 99, RemoteAddr: "127.0.0.1:100"},
+		{LocalPort: 100, LocalPortEnd: 200, RemoteAddr: "127.0.0.1:65500"},
+		{LocalPort: 100, LocalPortEnd: 200, Type: PortMappingTypeSNI},
+		{LocalPort: 1, LocalPortEnd: 2000, RemoteAddr: "127.0.0.1:100"},
+	} {
+		if validatePortRange(info) == nil {
+			t.Errorf("%s -> %s accepted", info.PortsString(), info.RemoteAddr)
+		}
+	}
+
+	c := &Config{Mappings: []*PortMappingInfo{
+		{LocalPort: 100, LocalPortEnd: 200, RemoteAddr: "127.0.0.1:100"},
+		{LocalPort: 150, RemoteAddr: "127.0.0.1:100"},
+	}}
+	if c.Validate() == nil {
+		t.Error("overlapping ranges accepted")
+	}
+}
@@ -2,8 +2,11 @@ package tcpproxy
 
 import (
 	"errors"
-	"net"
+	"sort"
 	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 var (
@@ -11,61 +14,501 @@ var (
 	ErrPortMappingNotFound = errors.New("port mapping not found")
 )
 
+const scheduleCheckInterval = 30 * time.Second
+
 type Proxy struct {
-	mu       sync.Mutex
-	mappings map[int]*portMapping
+	mu          sync.Mutex
+	mappings    map[int]*portMapping
+	stopCh      chan int
+	waitStopped sync.WaitGroup
+	accessLog   *accessLog
+	captureDir  string
 }
 
 func NewProxy() *Proxy {
 	p := &Proxy{
-		mappings: make(map[int]*portMapping),
+		mappings:  make(map[int]*portMapping),
+		stopCh:    make(chan int),
+		accessLog: &accessLog{},
 	}
+
+	p.waitStopped.Add(1)
+	go p.scheduleLoop()
 	return p
 }
 
-func (p *Proxy) AddPortMapping(localPort int, remoteAddr *net.TCPAddr) error {
+// Close stops all port mappings and closes their connections according to
+// opts, nil means close them immediately.
+func (p *Proxy) Close(opts *StopOptions) {
+	close(p.stopCh)
+	p.waitStopped.Wait()
+
+	p.mu.Lock()
+	mappings := p.mappings
+	p.mappings = make(map[int]*portMapping)
+	for _, m := range mappings {
+		m.stop()
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, m := range mappings {
+		wg.Add(1)
+		go func(m *portMapping) {
+			defer wg.Done()
+			m.closeConns(opts)
+			m.stopCapture()
+		}(m)
+	}
+	wg.Wait()
+}
+
+// SetAccessLog sets the sink every proxied connection is logged to when
+// it's closed, nil disables the access log. The proxy doesn't close the
+// sink.
+func (p *Proxy) SetAccessLog(sink AccessLogSink) {
+	p.accessLog.set(sink)
+}
+
+// scheduleLoop starts and stops the listeners of mappings with a schedule
+// when their time windows open and close.
+func (p *Proxy) scheduleLoop() {
+	defer p.waitStopped.Done()
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case now := <-ticker.C:
+			p.applySchedule(now)
+		}
+	}
+}
+
+func (p *Proxy) applySchedule(now time.Time) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	_, found := p.mappings[localPort]
-	if found {
-		return ErrLocalPortUsed
+	for _, m := range p.mappings {
+		p.updateRunning(m, now)
+	}
+}
+
+func (p *Proxy) updateRunning(m *portMapping, now time.Time) error {
+	if !m.shouldRun(now) {
+		m.stop()
+		return nil
 	}
 
-	m := newPortMapping(localPort, remoteAddr)
 	err := m.start()
+	if err != nil {
+		log.Errorf("failed to start port mapping :%d -> %v: %v",
+			m.localPort, m.remotes, err)
+	}
+	return err
+}
+
+// AddPortMapping registers a port mapping and resolves its remotes. The
+// listeners are only started if the mapping is enabled and inside its
+// schedule. It fails with ErrLocalPortUsed if any of its ports belongs to
+// another mapping.
+func (p *Proxy) AddPortMapping(info *PortMappingInfo) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, m := range p.mappings {
+		if m.info.overlaps(info) {
+			return ErrLocalPortUsed
+		}
+	}
+
+	err := validateSchedule(info.Schedule)
+	if err != nil {
+		return err
+	}
+
+	m, err := newPortMapping(info, p.accessLog)
 	if err != nil {
 		return err
 	}
 
-	p.mappings[localPort] = m
+	err = p.updateRunning(m, time.Now())
+	if err != nil {
+		return err
+	}
+
+	p.mappings[info.LocalPort] = m
 	return err
 }
 
-func (p *Proxy) DeletePortMapping(localPort int) error {
+// UpdatePortMapping replaces the config of the port mapping on
+// info.LocalPort and returns its updated config. If the mapping keeps
+// running on the same ports its listeners are handed over without being
+// closed. New connections use the new config, established ones stay on
+// their remote until they close.
+func (p *Proxy) UpdatePortMapping(info *PortMappingInfo) (*PortMappingInfo, error) {
+	err := validateSchedule(info.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	old, found := p.mappings[info.LocalPort]
+	if !found {
+		return nil, ErrPortMappingNotFound
+	}
+	for _, m := range p.mappings {
+		if m != old && m.info.overlaps(info) {
+			return nil, ErrLocalPortUsed
+		}
+	}
+
+	m, err := newPortMapping(info, p.accessLog)
+	if err != nil {
+		return nil, err
+	}
+	m.shareConns(old)
+
+	now := time.Now()
+	if old.running && m.shouldRun(now) && sameListeners(old, m) {
+		listeners := old.detach()
+		m.takeOver(old)
+		m.serve(listeners)
+	} else {
+		old.stop()
+		err = p.updateRunning(m, now)
+		if err != nil {
+			p.updateRunning(old, now)
+			return nil, err
+		}
+		m.takeOver(old)
+	}
+
+	p.mappings[info.LocalPort] = m
+	log.Infof("update port mapping :%s -> %v", info.PortsString(), m.remotes)
+	return m.snapshot(), nil
+}
+
+// sameListeners reports whether the listeners of a can serve b.
+func sameListeners(a, b *portMapping) bool {
+	if a.info.GetLastPort() != b.info.GetLastPort() {
+		return false
+	}
+	if (a.transparent == nil) != (b.transparent == nil) {
+		return false
+	}
+	return a.transparent == nil || a.transparent.tproxy == b.transparent.tproxy
+}
+
+// DeletePortMapping closes the listener immediately, then closes established
+// connections according to opts, nil means close them immediately.
+func (p *Proxy) DeletePortMapping(localPort int, opts *StopOptions) error {
+	p.mu.Lock()
 	m, found := p.mappings[localPort]
 	if !found {
+		p.mu.Unlock()
 		return ErrPortMappingNotFound
 	}
 
 	m.stop()
 	delete(p.mappings, localPort)
+	p.mu.Unlock()
+
+	m.closeConns(opts)
+	m.stopCapture()
 	return nil
 }
 
+// SetPortMappingEnabled enables or disables a port mapping without removing
+// it, and returns its updated config.
+func (p *Proxy) SetPortMappingEnabled(localPort int, enabled bool) (*PortMappingInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, found := p.mappings[localPort]
+	if !found {
+		return nil, ErrPortMappingNotFound
+	}
+
+	old := m.info.Enabled
+	m.info.SetEnabled(enabled)
+	err := p.updateRunning(m, time.Now())
+	if err != nil {
+		m.info.Enabled = old
+		return nil, err
+	}
+
+	info := *m.info
+	return &info, nil
+}
+
+// SetPortMappingLimits replaces the access lists and limits of a port
+// mapping and returns its updated config. Connection counts and rate
+// limits apply to new connections right away, the idle timeout only to
+// connections established afterwards.
+func (p *Proxy) SetPortMappingLimits(localPort int, limits *PortMappingLimits) (*PortMappingInfo, error) {
+	access, err := newAccessControl(limits)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, found := p.mappings[localPort]
+	if !found {
+		return nil, ErrPortMappingNotFound
+	}
+
+	m.info.PortMappingLimits = *limits
+	m.access.Store(access)
+
+	info := *m.info
+	return &info, nil
+}
+
+// snapshot returns the config of m with its runtime state, p.mu must be
+// held.
+func (m *portMapping) snapshot() *PortMappingInfo {
+	info := *m.info
+	info.Running = m.running
+	info.Stats = m.stats.snapshot()
+	info.RemoteStatus = m.remotes.status()
+	return &info
+}
+
 func (p *Proxy) ListPortMapping() []*PortMappingInfo {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	result := make([]*PortMappingInfo, 0)
 	for _, m := range p.mappings {
-		result = append(result, &PortMappingInfo{
-			LocalPort:  m.localPort,
-			RemoteAddr: m.remoteAddr.String(),
-		})
+		result = append(result, m.snapshot())
 	}
 	return result
 }
+
+func (p *Proxy) GetPortMapping(localPort int) (*PortMappingInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, found := p.mappings[localPort]
+	if !found {
+		return nil, ErrPortMappingNotFound
+	}
+	return m.snapshot(), nil
+}
+
+func (p *Proxy) ListConnections(localPort int) ([]*ConnectionInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, found := p.mappings[localPort]
+	if !found {
+		return nil, ErrPortMappingNotFound
+	}
+
+	return m.stats.listConns(), nil
+}
+
+func (p *Proxy) getSNIRouter(localPort int) (*sniRouter, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, found := p.mappings[localPort]
+	if !found {
+		return nil, ErrPortMappingNotFound
+	}
+	if m.sni == nil {
+		return nil, ErrNotSNIPortMapping
+	}
+	return m.sni, nil
+}
+
+// AddSNIRoute adds or replaces a route of a sni port mapping.
+func (p *Proxy) AddSNIRoute(route *SNIRoute) error {
+	hostname := normalizeHostname(route.Hostname)
+	err := validateSNIHostname(hostname)
+	if err != nil {
+		return err
+	}
+
+	r, err := p.getSNIRouter(route.LocalPort)
+	if err != nil {
+		return err
+	}
+
+	route.Hostname = hostname
+	r.add(hostname, route.RemoteAddr)
+	return nil
+}
+
+func (p *Proxy) DeleteSNIRoute(localPort int, hostname string) error {
+	r, err := p.getSNIRouter(localPort)
+	if err != nil {
+		return err
+	}
+	return r.delete(normalizeHostname(hostname))
+}
+
+func (p *Proxy) ListSNIRoutes(localPort int) ([]*SNIRoute, error) {
+	r, err := p.getSNIRouter(localPort)
+	if err != nil {
+		return nil, err
+	}
+	return r.list(localPort), nil
+}
+
+func (p *Proxy) getHTTPRouter(localPort int) (*httpRouter, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, found := p.mappings[localPort]
+	if !found {
+		return nil, ErrPortMappingNotFound
+	}
+	if m.http == nil {
+		return nil, ErrNotHTTPPortMapping
+	}
+	return m.http, nil
+}
+
+// AddHTTPRoute adds or replaces a route of a http port mapping.
+func (p *Proxy) AddHTTPRoute(route *HTTPRoute) error {
+	route.Host = normalizeHostname(route.Host)
+	route.PathPrefix = normalizePathPrefix(route.PathPrefix)
+	err := validateHTTPRoute(route)
+	if err != nil {
+		return err
+	}
+
+	r, err := p.getHTTPRouter(route.LocalPort)
+	if err != nil {
+		return err
+	}
+
+	r.add(route)
+	return nil
+}
+
+func (p *Proxy) DeleteHTTPRoute(localPort int, host string, pathPrefix string) error {
+	r, err := p.getHTTPRouter(localPort)
+	if err != nil {
+		return err
+	}
+	return r.delete(normalizeHostname(host), normalizePathPrefix(pathPrefix))
+}
+
+func (p *Proxy) ListHTTPRoutes(localPort int) ([]*HTTPRoute, error) {
+	r, err := p.getHTTPRouter(localPort)
+	if err != nil {
+		return nil, err
+	}
+	return r.list(), nil
+}
+
+func (p *Proxy) getPortMapping(localPort int) (*portMapping, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, found := p.mappings[localPort]
+	if !found {
+		return nil, ErrPortMappingNotFound
+	}
+	return m, nil
+}
+
+// SetCaptureDir sets the directory capture files are created in, empty
+// means os.TempDir().
+func (p *Proxy) SetCaptureDir(dir string) {
+	p.mu.Lock()
+	p.captureDir = dir
+	p.mu.Unlock()
+}
+
+// StartCapture starts recording new connections of a port mapping, see
+// CaptureInfo. Format and File are filled with their defaults if empty,
+// File is a name in the capture dir and set to the path of the file.
+func (p *Proxy) StartCapture(info *CaptureInfo) error {
+	p.mu.Lock()
+	dir := p.captureDir
+	p.mu.Unlock()
+
+	err := validateCapture(info, dir)
+	if err != nil {
+		return err
+	}
+
+	m, err := p.getPortMapping(info.LocalPort)
+	if err != nil {
+		return err
+	}
+	return m.startCapture(info)
+}
+
+func (p *Proxy) StopCapture(localPort int) error {
+	m, err := p.getPortMapping(localPort)
+	if err != nil {
+		return err
+	}
+	return m.stopCapture()
+}
+
+// ListCaptures returns the running captures.
+func (p *Proxy) ListCaptures() []*CaptureInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result := make([]*CaptureInfo, 0)
+	for _, m := range p.mappings {
+		c := m.getCapture()
+		if c != nil {
+			result = append(result, c.snapshot())
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LocalPort < result[j].LocalPort
+	})
+	return result
+}
+
+// AddToxic adds a toxic to a port mapping, it applies to established
+// connections too.
+func (p *Proxy) AddToxic(t *ToxicInfo) error {
+	err := validateToxic(t)
+	if err != nil {
+		return err
+	}
+
+	m, err := p.getPortMapping(t.LocalPort)
+	if err != nil {
+		return err
+	}
+	return m.addToxic(t)
+}
+
+func (p *Proxy) DeleteToxic(localPort int, name string) error {
+	m, err := p.getPortMapping(localPort)
+	if err != nil {
+		return err
+	}
+	return m.deleteToxic(name)
+}
+
+func (p *Proxy) ListToxics(localPort int) ([]*ToxicInfo, error) {
+	m, err := p.getPortMapping(localPort)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*ToxicInfo, 0)
+	for _, t := range m.getToxics() {
+		info := *t
+		result = append(result, &info)
+	}
+	return result, nil
+}
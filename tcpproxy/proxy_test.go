@@ -0,0 +1,280 @@
+package tcpproxy
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func dialAndEcho(t *testing.T, port int) net.Conn {
+	c, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("hello")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Time{})
+	return c
+}
+
+func waitGoroutines(t *testing.T, want int) {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= want {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("goroutine leak: %d > %d\n%s", n, want, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitClosed(t *testing.T, c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err := c.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("connection still open")
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection still open")
+	}
+}
+
+func addTestPortMapping(t *testing.T, p *Proxy, remote net.Listener) int {
+	port := freePort(t)
+	info := &PortMappingInfo{
+		LocalPort:  port,
+		RemoteAddr: remote.Addr().String(),
+	}
+	err := p.AddPortMapping(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func TestDeletePortMappingNoGoroutineLeak(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	base := runtime.NumGoroutine()
+
+	port := addTestPortMapping(t, p, echo)
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		c := dialAndEcho(t, port)
+		defer c.Close()
+		conns = append(conns, c)
+	}
+
+	err := p.DeletePortMapping(port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range conns {
+		waitClosed(t, c)
+	}
+	waitGoroutines(t, base)
+
+	// the listener must be closed as well
+	l, err := net.Listen("tcp4", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("port still in use: %v", err)
+	}
+	l.Close()
+}
+
+func TestDeletePortMappingDrain(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	base := runtime.NumGoroutine()
+
+	port := addTestPortMapping(t, p, echo)
+	c := dialAndEcho(t, port)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		c.Close()
+	}()
+
+	start := time.Now()
+	err := p.DeletePortMapping(port, &StopOptions{Drain: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 150*time.Millisecond {
+		t.Fatal("delete returned before connection finished")
+	}
+	waitGoroutines(t, base)
+}
+
+func TestDeletePortMappingDrainTimeout(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	base := runtime.NumGoroutine()
+
+	port := addTestPortMapping(t, p, echo)
+	c := dialAndEcho(t, port)
+	defer c.Close()
+
+	err := p.DeletePortMapping(port, &StopOptions{
+		Drain:        true,
+		DrainTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitClosed(t, c)
+	waitGoroutines(t, base)
+}
+
+func TestDisablePortMappingStopsAcceptLoop(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	base := runtime.NumGoroutine()
+
+	port := addTestPortMapping(t, p, echo)
+	_, err := p.SetPortMappingEnabled(port, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitGoroutines(t, base)
+
+	_, err = p.SetPortMappingEnabled(port, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dialAndEcho(t, port)
+	c.Close()
+
+	err = p.DeletePortMapping(port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitGoroutines(t, base)
+}
+
+func TestUpdatePortMapping(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	echo2 := startEchoServer(t)
+	defer echo2.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	sink := &memorySink{}
+	p.SetAccessLog(sink)
+	base := runtime.NumGoroutine()
+
+	port := addTestPortMapping(t, p, echo)
+	old := dialAndEcho(t, port)
+	defer old.Close()
+	kept := dialAndEcho(t, port)
+	defer kept.Close()
+	socket := p.mappings[port].listeners[0].Listener
+
+	info, err := p.UpdatePortMapping(&PortMappingInfo{
+		LocalPort:  port,
+		RemoteAddr: echo2.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Running || info.Stats.TotalConns != 2 {
+		t.Errorf("updated port mapping: %+v %+v", info, info.Stats)
+	}
+	if p.mappings[port].listeners[0].Listener != socket {
+		t.Error("listener not handed over")
+	}
+
+	dialAndEcho(t, port).Close()
+	e := sink.wait(t, 1)[0]
+	if e.RemoteAddr != echo2.Addr().String() {
+		t.Errorf("new connection went to %s", e.RemoteAddr)
+	}
+
+	// established connections stay on the old remote
+	if _, err := old.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	old.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(old, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+	e = sink.wait(t, 2)[1]
+	if e.RemoteAddr != echo.Addr().String() {
+		t.Errorf("old connection went to %s", e.RemoteAddr)
+	}
+
+	_, err = p.UpdatePortMapping(&PortMappingInfo{LocalPort: freePort(t), RemoteAddr: "127.0.0.1:1"})
+	if err != ErrPortMappingNotFound {
+		t.Errorf("update missing port mapping: %v", err)
+	}
+
+	// connections of the replaced mapping are closed with the new one
+	err = p.DeletePortMapping(port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(t, kept)
+	waitGoroutines(t, base)
+}
@@ -0,0 +1,341 @@
+package tcpproxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MoZhonghua/mytools/util/dialer"
+	log "github.com/Sirupsen/logrus"
+)
+
+var ErrNoRemote = errors.New("no remote address")
+
+const (
+	remoteDialTimeout     = 10 * time.Second
+	remoteResolveInterval = time.Minute
+
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthCheckFall     = 3
+	defaultHealthCheckRise     = 2
+)
+
+func (c *HealthCheckConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return defaultHealthCheckInterval
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+func (c *HealthCheckConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultHealthCheckTimeout
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+func (c *HealthCheckConfig) fall() int {
+	if c.Fall <= 0 {
+		return defaultHealthCheckFall
+	}
+	return c.Fall
+}
+
+func (c *HealthCheckConfig) rise() int {
+	if c.Rise <= 0 {
+		return defaultHealthCheckRise
+	}
+	return c.Rise
+}
+
+// validateRemotes checks the remotes, balancing policy and health check of
+// a port mapping without resolving anything.
+func validateRemotes(info *PortMappingInfo) error {
+	remotes := info.GetRemotes()
+	if len(remotes) == 0 && info.GetType() == PortMappingTypeTCP {
+		return errors.New("remote address is required")
+	}
+	for _, addr := range remotes {
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid remote address: %v", err)
+		}
+	}
+
+	switch info.Balance {
+	case "", BalanceRoundRobin, BalanceRandom, BalanceLeastConn, BalanceFailover:
+	default:
+		return fmt.Errorf("unknown balance policy: %s", info.Balance)
+	}
+
+	hc := info.HealthCheck
+	if hc != nil && (hc.Interval < 0 || hc.Timeout < 0 || hc.Fall < 0 || hc.Rise < 0) {
+		return errors.New("invalid health check")
+	}
+
+	_, err := dialer.New(info.Upstream, dialer.Direct)
+	if err != nil {
+		return fmt.Errorf("invalid upstream: %v", err)
+	}
+	return nil
+}
+
+type remote struct {
+	// addr is the configured host:port
+	addr        string
+	activeConns int64
+
+	mu       sync.Mutex
+	resolved string
+	healthy  bool
+	fails    int
+	passes   int
+	lastErr  error
+}
+
+func (r *remote) resolve() error {
+	a, err := net.ResolveTCPAddr("tcp4", r.addr)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.resolved != "" && r.resolved != a.String() {
+		log.Infof("remote %s resolved to %v, was %s", r.addr, a, r.resolved)
+	}
+	r.resolved = a.String()
+	return nil
+}
+
+func (r *remote) dialAddr() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.resolved
+}
+
+func (r *remote) isHealthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.healthy
+}
+
+// report records the result of a health check or a dial. The health state
+// only changes if health checks are enabled.
+func (r *remote) report(err error, hc *HealthCheckConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastErr = err
+	if hc == nil {
+		return
+	}
+
+	if err != nil {
+		r.passes = 0
+		r.fails++
+		if r.healthy && r.fails >= hc.fall() {
+			r.healthy = false
+			log.Warnf("remote %s is down: %v", r.addr, err)
+		}
+	} else {
+		r.fails = 0
+		r.passes++
+		if !r.healthy && r.passes >= hc.rise() {
+			r.healthy = true
+			log.Infof("remote %s is up", r.addr)
+		}
+	}
+}
+
+func (r *remote) status() *RemoteStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &RemoteStatus{
+		Addr:         r.addr,
+		ResolvedAddr: r.resolved,
+		Healthy:      r.healthy,
+		ActiveConns:  atomic.LoadInt64(&r.activeConns),
+	}
+	if r.lastErr != nil {
+		s.LastError = r.lastErr.Error()
+	}
+	return s
+}
+
+// remotePool balances new connections of a port mapping over its remotes.
+type remotePool struct {
+	balance string
+	hc      *HealthCheckConfig
+	remotes []*remote
+	next    uint64
+
+	// dialer connects through the upstream proxies, if proxied remotes
+	// are resolved by the last proxy rather than locally
+	dialer  dialer.Dialer
+	proxied bool
+}
+
+// newRemotePool resolves all remotes of info, it fails if any of them can't
+// be resolved. Remotes reached through upstream proxies aren't resolved.
+func newRemotePool(info *PortMappingInfo, d dialer.Dialer) (*remotePool, error) {
+	p := &remotePool{
+		balance: info.Balance,
+		hc:      info.HealthCheck,
+		dialer:  d,
+		proxied: len(info.Upstream) > 0,
+	}
+	for _, addr := range info.GetRemotes() {
+		r := &remote{addr: addr, healthy: true}
+		if p.proxied {
+			r.resolved = addr
+		} else {
+			err := r.resolve()
+			if err != nil {
+				return nil, err
+			}
+		}
+		p.remotes = append(p.remotes, r)
+	}
+	return p, nil
+}
+
+func (p *remotePool) String() string {
+	addrs := make([]string, 0, len(p.remotes))
+	for _, r := range p.remotes {
+		addrs = append(addrs, r.addr)
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (p *remotePool) empty() bool {
+	return len(p.remotes) == 0
+}
+
+// candidates returns the remotes to try for a new connection, in order.
+// Unhealthy remotes are only tried if no remote is healthy.
+func (p *remotePool) candidates() []*remote {
+	result := make([]*remote, 0, len(p.remotes))
+	for _, r := range p.remotes {
+		if r.isHealthy() {
+			result = append(result, r)
+		}
+	}
+	if len(result) == 0 {
+		result = append(result, p.remotes...)
+	}
+	if len(result) == 0 {
+		return result
+	}
+
+	switch p.balance {
+	case BalanceFailover:
+	case BalanceRandom:
+		rand.Shuffle(len(result), func(i, j int) {
+			result[i], result[j] = result[j], result[i]
+		})
+	case BalanceLeastConn:
+		sort.SliceStable(result, func(i, j int) bool {
+			return atomic.LoadInt64(&result[i].activeConns) <
+				atomic.LoadInt64(&result[j].activeConns)
+		})
+	default:
+		n := int((atomic.AddUint64(&p.next, 1) - 1) % uint64(len(result)))
+		result = append(result[n:], result[:n]...)
+	}
+	return result
+}
+
+// pick returns the address of the remote a new connection would go to
+// first.
+func (p *remotePool) pick() (string, bool) {
+	candidates := p.candidates()
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return candidates[0].dialAddr(), true
+}
+
+// dial connects to the candidates in order until one succeeds, offset is
+// added to their ports. Each failed dial is counted in stats.
+func (p *remotePool) dial(stats *mappingStats, offset int) (net.Conn, *remote, error) {
+	lastErr := ErrNoRemote
+	for _, r := range p.candidates() {
+		c, err := dialer.DialTimeout(p.dialer, "tcp4",
+			offsetAddr(r.dialAddr(), offset), remoteDialTimeout)
+		r.report(err, p.hc)
+		if err != nil {
+			stats.dialFailed()
+			log.Warnf("failed to connect %s: %v", r.addr, err)
+			lastErr = err
+			continue
+		}
+		return c, r, nil
+	}
+	return nil, nil, lastErr
+}
+
+func (p *remotePool) status() []*RemoteStatus {
+	result := make([]*RemoteStatus, 0, len(p.remotes))
+	for _, r := range p.remotes {
+		result = append(result, r.status())
+	}
+	return result
+}
+
+// run re-resolves the remotes and runs health checks until stopCh is
+// closed. A remote keeps its last address if it can't be resolved.
+func (p *remotePool) run(stopCh chan int) {
+	resolveTicker := time.NewTicker(remoteResolveInterval)
+	defer resolveTicker.Stop()
+
+	var checkCh <-chan time.Time
+	if p.hc != nil {
+		checkTicker := time.NewTicker(p.hc.interval())
+		defer checkTicker.Stop()
+		checkCh = checkTicker.C
+	}
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-resolveTicker.C:
+			if p.proxied {
+				continue
+			}
+			for _, r := range p.remotes {
+				err := r.resolve()
+				if err != nil {
+					log.Infof("failed to resolve remote %s: %v", r.addr, err)
+				}
+			}
+		case <-checkCh:
+			p.check()
+		}
+	}
+}
+
+func (p *remotePool) check() {
+	var wg sync.WaitGroup
+	for _, r := range p.remotes {
+		wg.Add(1)
+		go func(r *remote) {
+			defer wg.Done()
+			c, err := dialer.DialTimeout(p.dialer, "tcp4", r.dialAddr(), p.hc.timeout())
+			if err == nil {
+				c.Close()
+			}
+			r.report(err, p.hc)
+		}(r)
+	}
+	wg.Wait()
+}
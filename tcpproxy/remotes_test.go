@@ -0,0 +1,222 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/MoZhonghua/mytools/util/dialer"
+	"github.com/MoZhonghua/mytools/util/relay"
+)
+
+// startNamedServer accepts connections and writes name to them.
+func startNamedServer(t *testing.T, name string) net.Listener {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte(name))
+			c.Close()
+		}
+	}()
+	return l
+}
+
+func readFrom(t *testing.T, port int) string {
+	c, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// deadAddr returns an address nobody listens on.
+func deadAddr(t *testing.T) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+}
+
+func TestRemotesRoundRobin(t *testing.T) {
+	a := startNamedServer(t, "a")
+	defer a.Close()
+	b := startNamedServer(t, "b")
+	defer b.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+
+	port := freePort(t)
+	err := p.AddPortMapping(&PortMappingInfo{
+		LocalPort: port,
+		Remotes:   []string{a.Addr().String(), b.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]int{}
+	for i := 0; i < 4; i++ {
+		got[readFrom(t, port)]++
+	}
+	if got["a"] != 2 || got["b"] != 2 {
+		t.Errorf("unbalanced connections: %v", got)
+	}
+}
+
+func TestRemotesFailover(t *testing.T) {
+	b := startNamedServer(t, "b")
+	defer b.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+
+	port := freePort(t)
+	err := p.AddPortMapping(&PortMappingInfo{
+		LocalPort:   port,
+		Remotes:     []string{deadAddr(t), b.Addr().String()},
+		Balance:     BalanceFailover,
+		HealthCheck: &HealthCheckConfig{Interval: 60, Fall: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFrom(t, port); got != "b" {
+		t.Fatalf("connection routed to %q", got)
+	}
+
+	list := p.ListPortMapping()
+	if list[0].Stats.DialFailures != 1 {
+		t.Errorf("dial failures: %d", list[0].Stats.DialFailures)
+	}
+	status := list[0].RemoteStatus
+	if len(status) != 2 || status[0].Healthy || !status[1].Healthy {
+		t.Fatalf("unexpected remote status: %+v %+v", status[0], status[1])
+	}
+
+	// the dead remote is skipped once marked down
+	if got := readFrom(t, port); got != "b" {
+		t.Fatalf("connection routed to %q", got)
+	}
+	if n := p.ListPortMapping()[0].Stats.DialFailures; n != 1 {
+		t.Errorf("dial failures: %d", n)
+	}
+}
+
+func TestRemotesHealthCheck(t *testing.T) {
+	a := startNamedServer(t, "a")
+	addr := a.Addr().String()
+
+	pool, err := newRemotePool(&PortMappingInfo{
+		Remotes:     []string{addr},
+		HealthCheck: &HealthCheckConfig{Fall: 2, Rise: 1},
+	}, dialer.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := pool.remotes[0]
+	pool.check()
+	if !r.isHealthy() {
+		t.Fatal("remote down while listening")
+	}
+
+	a.Close()
+	pool.check()
+	if !r.isHealthy() {
+		t.Fatal("remote down after one failure")
+	}
+	pool.check()
+	if r.isHealthy() {
+		t.Fatal("remote still up after two failures")
+	}
+
+	a, err = net.Listen("tcp4", addr)
+	if err != nil {
+		t.Skipf("can't listen on %s again: %v", addr, err)
+	}
+	defer a.Close()
+	pool.check()
+	if !r.isHealthy() {
+		t.Fatal("remote not up again")
+	}
+}
+
+// startConnectProxy is a HTTP CONNECT proxy sending the requested
+// addresses to targets.
+func startConnectProxy(t *testing.T, targets chan string) net.Listener {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				targets <- req.Host
+				r, err := net.Dial("tcp4", req.Host)
+				if err != nil {
+					c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer r.Close()
+				c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+				relay.Relay(c, r)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestRemotesUpstream(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	targets := make(chan string, 10)
+	proxy := startConnectProxy(t, targets)
+	defer proxy.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := freePort(t)
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+	err := p.AddPortMapping(&PortMappingInfo{
+		LocalPort: port,
+		// resolved by the proxy
+		RemoteAddr: "localhost:" + echoPort,
+		Upstream:   []string{"http://" + proxy.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialAndEcho(t, port).Close()
+	if target := <-targets; target != "localhost:"+echoPort {
+		t.Errorf("proxy connected to %s", target)
+	}
+}
@@ -0,0 +1,76 @@
+package tcpproxy
+
+import (
+	"fmt"
+	"time"
+)
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %s", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w *TimeWindow) validate() error {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return err
+	}
+
+	end, err := parseClock(w.End)
+	if err != nil {
+		return err
+	}
+
+	if start == end {
+		return fmt.Errorf("empty time window: %s-%s", w.Start, w.End)
+	}
+	return nil
+}
+
+// contains reports whether t falls in the window. A window whose end is
+// before its start spans midnight, e.g. 22:00-06:00.
+func (w *TimeWindow) contains(t time.Time) bool {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return false
+	}
+
+	end, err := parseClock(w.End)
+	if err != nil {
+		return false
+	}
+
+	now := t.Hour()*60 + t.Minute()
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+func validateSchedule(windows []*TimeWindow) error {
+	for _, w := range windows {
+		err := w.validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inSchedule reports whether t falls in any of the windows. An empty
+// schedule means always.
+func inSchedule(windows []*TimeWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
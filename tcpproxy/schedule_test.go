@@ -0,0 +1,163 @@
+package tcpproxy
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func clock(hour, min int) time.Time {
+	return time.Date(2017, 3, 1, hour, min, 0, 0, time.Local)
+}
+
+func TestParseClock(t *testing.T) {
+	for _, test := range []struct {
+		s       string
+		minutes int
+		ok      bool
+	}{
+		{"00:00", 0, true},
+		{"07:05", 7*60 + 5, true},
+		{"7:05", 7*60 + 5, true},
+		{"23:59", 23*60 + 59, true},
+		{"24:00", 0, false},
+		{"12:60", 0, false},
+		{"7:5", 0, false},
+		{"0700", 0, false},
+		{"", 0, false},
+	} {
+		minutes, err := parseClock(test.s)
+		if (err == nil) != test.ok || minutes != test.minutes {
+			t.Errorf("parseClock(%q) = %d %v", test.s, minutes, err)
+		}
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	for _, test := range []struct {
+		start, end string
+		t          time.Time
+		want       bool
+	}{
+		{"09:00", "17:00", clock(9, 0), true},
+		{"09:00", "17:00", clock(16, 59), true},
+		{"09:00", "17:00", clock(17, 0), false},
+		{"09:00", "17:00", clock(8, 59), false},
+		// spans midnight
+		{"22:00", "06:00", clock(23, 30), true},
+		{"22:00", "06:00", clock(0, 0), true},
+		{"22:00", "06:00", clock(5, 59), true},
+		{"22:00", "06:00", clock(6, 0), false},
+		{"22:00", "06:00", clock(12, 0), false},
+		{"22:00", "00:00", clock(23, 59), true},
+		{"22:00", "00:00", clock(0, 0), false},
+		// start == end never validates, contains takes it as all day
+		{"08:00", "08:00", clock(8, 0), true},
+		{"08:00", "08:00", clock(7, 59), true},
+		{"24:00", "06:00", clock(1, 0), false},
+		{"22:00", "7:5", clock(1, 0), false},
+	} {
+		w := &TimeWindow{Start: test.start, End: test.end}
+		if got := w.contains(test.t); got != test.want {
+			t.Errorf("%s-%s contains %s: %v", test.start, test.end, test.t.Format("15:04"), got)
+		}
+	}
+}
+
+func TestInSchedule(t *testing.T) {
+	schedule := []*TimeWindow{
+		{Start: "08:00", End: "12:00"},
+		{Start: "22:00", End: "02:00"},
+	}
+	for _, test := range []struct {
+		windows []*TimeWindow
+		t       time.Time
+		want    bool
+	}{
+		{nil, clock(3, 0), true},
+		{schedule, clock(9, 0), true},
+		{schedule, clock(1, 0), true},
+		{schedule, clock(12, 0), false},
+		{schedule, clock(2, 0), false},
+		{schedule, clock(21, 59), false},
+	} {
+		if got := inSchedule(test.windows, test.t); got != test.want {
+			t.Errorf("%d windows at %s: %v", len(test.windows), test.t.Format("15:04"), got)
+		}
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	for _, test := range []struct {
+		windows []*TimeWindow
+		ok      bool
+	}{
+		{nil, true},
+		{[]*TimeWindow{{Start: "09:00", End: "17:00"}}, true},
+		{[]*TimeWindow{{Start: "22:00", End: "06:00"}}, true},
+		{[]*TimeWindow{{Start: "08:00", End: "08:00"}}, false},
+		{[]*TimeWindow{{Start: "22:00", End: "24:00"}}, false},
+		{[]*TimeWindow{{Start: "7:5", End: "09:00"}}, false},
+		{[]*TimeWindow{{Start: "09:00", End: "17:00"}, {Start: "", End: "06:00"}}, false},
+	} {
+		err := validateSchedule(test.windows)
+		if (err == nil) != test.ok {
+			t.Errorf("validateSchedule(%v): %v", test.windows, err)
+		}
+	}
+}
+
+func TestUpdateRunning(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+
+	port := freePort(t)
+	err := p.AddPortMapping(&PortMappingInfo{
+		LocalPort:  port,
+		RemoteAddr: echo.Addr().String(),
+		Schedule:   []*TimeWindow{{Start: "22:00", End: "06:00"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listening := func() bool {
+		c, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+	for _, test := range []struct {
+		now     time.Time
+		enabled bool
+		running bool
+	}{
+		{clock(23, 0), true, true},
+		{clock(5, 59), true, true},
+		{clock(6, 0), true, false},
+		{clock(12, 0), true, false},
+		{clock(22, 0), true, true},
+		{clock(1, 0), false, false},
+	} {
+		p.mu.Lock()
+		m := p.mappings[port]
+		m.info.SetEnabled(test.enabled)
+		err := p.updateRunning(m, test.now)
+		running := m.running
+		p.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if running != test.running || listening() != test.running {
+			t.Errorf("at %s enabled %v: running %v, want %v", test.now.Format("15:04"),
+				test.enabled, running, test.running)
+		}
+	}
+}
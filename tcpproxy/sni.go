@@ -0,0 +1,191 @@
+package tcpproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MoZhonghua/mytools/util/relay"
+)
+
+const sniPeekTimeout = 10 * time.Second
+
+// DefaultSNIRoute matches connections without a server name or without a
+// more specific route. It is also the default host of http routes.
+const DefaultSNIRoute = "*"
+
+var (
+	ErrNotSNIPortMapping = errors.New("not a sni port mapping")
+	ErrSNIRouteNotFound  = errors.New("sni route not found")
+	ErrNoSNIRoute        = errors.New("no route for server name")
+
+	errClientHelloRead = errors.New("client hello read")
+)
+
+func normalizeHostname(hostname string) string {
+	return strings.TrimSuffix(strings.ToLower(hostname), ".")
+}
+
+func validateSNIHostname(hostname string) error {
+	if hostname == "" {
+		return errors.New("empty hostname")
+	}
+	if hostname == DefaultSNIRoute {
+		return nil
+	}
+
+	rest := strings.TrimPrefix(hostname, "*.")
+	if rest == "" || strings.Contains(rest, "*") {
+		return fmt.Errorf("invalid hostname: %s", hostname)
+	}
+	return nil
+}
+
+// sniRouter maps TLS server names to remote addresses. Lookup tries an
+// exact match, then wildcards from the most specific ("*.b.example.com"
+// before "*.example.com"), then DefaultSNIRoute.
+type sniRouter struct {
+	mu     sync.RWMutex
+	routes map[string]string
+}
+
+func newSNIRouter() *sniRouter {
+	return &sniRouter{
+		routes: make(map[string]string),
+	}
+}
+
+func (r *sniRouter) add(hostname, remoteAddr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[hostname] = remoteAddr
+}
+
+func (r *sniRouter) delete(hostname string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, found := r.routes[hostname]
+	if !found {
+		return ErrSNIRouteNotFound
+	}
+	delete(r.routes, hostname)
+	return nil
+}
+
+func (r *sniRouter) list(localPort int) []*SNIRoute {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make([]*SNIRoute, 0, len(r.routes))
+	for hostname, remoteAddr := range r.routes {
+		result = append(result, &SNIRoute{
+			LocalPort:  localPort,
+			Hostname:   hostname,
+			RemoteAddr: remoteAddr,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Hostname < result[j].Hostname
+	})
+	return result
+}
+
+// matchHostname returns the first key accepted by has among hostname, its
+// wildcards from the most specific and DefaultSNIRoute.
+func matchHostname(hostname string, has func(string) bool) (string, bool) {
+	name := normalizeHostname(hostname)
+	if name != "" {
+		if has(name) {
+			return name, true
+		}
+
+		for {
+			i := strings.Index(name, ".")
+			if i < 0 {
+				break
+			}
+			name = name[i+1:]
+			if has("*." + name) {
+				return "*." + name, true
+			}
+		}
+	}
+
+	if has(DefaultSNIRoute) {
+		return DefaultSNIRoute, true
+	}
+	return "", false
+}
+
+func (r *sniRouter) lookup(serverName string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, found := matchHostname(serverName, func(name string) bool {
+		_, found := r.routes[name]
+		return found
+	})
+	if !found {
+		return "", false
+	}
+	return r.routes[key], true
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello without answering it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                { return nil }
+
+// peekedConn replays the bytes consumed while peeking before reading from
+// the underlying connection.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	return relay.CloseWrite(c.Conn)
+}
+
+// peekServerName reads the TLS ClientHello from c and returns the server
+// name it asks for, along with a connection that replays the ClientHello.
+// The server name is empty if the client sent none.
+func peekServerName(c net.Conn) (string, net.Conn, error) {
+	var serverName string
+	var peeked bytes.Buffer
+
+	c.SetReadDeadline(time.Now().Add(sniPeekTimeout))
+	err := tls.Server(&readOnlyConn{Conn: c, r: io.TeeReader(c, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	c.SetReadDeadline(time.Time{})
+
+	if err != errClientHelloRead {
+		return "", nil, fmt.Errorf("failed to read tls client hello: %v", err)
+	}
+
+	return serverName, &peekedConn{
+		Conn: c,
+		r:    io.MultiReader(&peeked, c),
+	}, nil
+}
@@ -0,0 +1,139 @@
+package tcpproxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSNIRouterLookup(t *testing.T) {
+	r := newSNIRouter()
+	r.add("a.example.com", "a:1")
+	r.add("*.example.com", "wild:1")
+	r.add("*.b.example.com", "wildb:1")
+
+	cases := []struct {
+		serverName string
+		remoteAddr string
+		found      bool
+	}{
+		{"a.example.com", "a:1", true},
+		{"A.Example.com.", "a:1", true},
+		{"c.example.com", "wild:1", true},
+		{"x.b.example.com", "wildb:1", true},
+		{"x.y.example.com", "wild:1", true},
+		{"example.com", "", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		addr, found := r.lookup(c.serverName)
+		if addr != c.remoteAddr || found != c.found {
+			t.Errorf("lookup(%q) = %q, %v, want %q, %v",
+				c.serverName, addr, found, c.remoteAddr, c.found)
+		}
+	}
+
+	r.add(DefaultSNIRoute, "default:1")
+	addr, _ := r.lookup("other.org")
+	if addr != "default:1" {
+		t.Errorf("lookup(other.org) = %q, want default route", addr)
+	}
+}
+
+// startNamedTLSServer accepts TLS connections and writes name to them.
+func startNamedTLSServer(t *testing.T, certFile, keyFile, name string) net.Listener {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte(name))
+			c.Close()
+		}
+	}()
+	return l
+}
+
+func readFromSNI(t *testing.T, port int, serverName string) string {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	c, err := tls.Dial("tcp4", addr, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSNIPortMapping(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), 1)
+	a := startNamedTLSServer(t, certFile, keyFile, "a")
+	defer a.Close()
+	b := startNamedTLSServer(t, certFile, keyFile, "b")
+	defer b.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+
+	port := freePort(t)
+	info := &PortMappingInfo{
+		LocalPort: port,
+		Type:      PortMappingTypeSNI,
+	}
+	err := p.AddPortMapping(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := []*SNIRoute{
+		{LocalPort: port, Hostname: "a.example.com", RemoteAddr: a.Addr().String()},
+		{LocalPort: port, Hostname: "*.example.com", RemoteAddr: b.Addr().String()},
+	}
+	for _, route := range routes {
+		if err := p.AddSNIRoute(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := readFromSNI(t, port, "a.example.com"); got != "a" {
+		t.Errorf("a.example.com routed to %q", got)
+	}
+	if got := readFromSNI(t, port, "x.example.com"); got != "b" {
+		t.Errorf("x.example.com routed to %q", got)
+	}
+
+	err = p.DeleteSNIRoute(port, "*.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := p.ListSNIRoutes(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Hostname != "a.example.com" {
+		t.Errorf("unexpected routes: %v", list)
+	}
+}
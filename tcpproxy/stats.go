@@ -0,0 +1,126 @@
+package tcpproxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type connStats struct {
+	bytesUp    int64
+	bytesDown  int64
+	id         uint64
+	clientAddr string
+	remoteAddr string
+	startTime  time.Time
+}
+
+func (c *connStats) info() *ConnectionInfo {
+	return &ConnectionInfo{
+		ClientAddr: c.clientAddr,
+		RemoteAddr: c.remoteAddr,
+		StartTime:  c.startTime,
+		Age:        int64(time.Since(c.startTime) / time.Second),
+		BytesUp:    atomic.LoadInt64(&c.bytesUp),
+		BytesDown:  atomic.LoadInt64(&c.bytesDown),
+	}
+}
+
+// mappingStats keeps the counters of one port mapping. Bytes of live
+// connections are counted in connStats and folded into the mapping totals
+// when the connection is closed.
+type mappingStats struct {
+	totalConns    int64
+	dialFailures  int64
+	rejected      int64
+	mirrorBytes   int64
+	mirrorDropped int64
+
+	mu        sync.Mutex
+	nextId    uint64
+	bytesUp   int64
+	bytesDown int64
+	conns     map[uint64]*connStats
+}
+
+func newMappingStats() *mappingStats {
+	return &mappingStats{
+		conns: make(map[uint64]*connStats),
+	}
+}
+
+func (s *mappingStats) connAccepted() {
+	atomic.AddInt64(&s.totalConns, 1)
+}
+
+func (s *mappingStats) dialFailed() {
+	atomic.AddInt64(&s.dialFailures, 1)
+}
+
+func (s *mappingStats) connRejected() {
+	atomic.AddInt64(&s.rejected, 1)
+}
+
+func (s *mappingStats) addConn(clientAddr, remoteAddr string) *connStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextId++
+	c := &connStats{
+		id:         s.nextId,
+		clientAddr: clientAddr,
+		remoteAddr: remoteAddr,
+		startTime:  time.Now(),
+	}
+	s.conns[c.id] = c
+	return c
+}
+
+func (s *mappingStats) removeConn(c *connStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, c.id)
+	s.bytesUp += atomic.LoadInt64(&c.bytesUp)
+	s.bytesDown += atomic.LoadInt64(&c.bytesDown)
+}
+
+func (s *mappingStats) snapshot() *PortMappingStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := &PortMappingStats{
+		ActiveConns:  int64(len(s.conns)),
+		TotalConns:   atomic.LoadInt64(&s.totalConns),
+		DialFailures: atomic.LoadInt64(&s.dialFailures),
+		Rejected:     atomic.LoadInt64(&s.rejected),
+		BytesUp:      s.bytesUp,
+		BytesDown:    s.bytesDown,
+
+		MirrorBytes:   atomic.LoadInt64(&s.mirrorBytes),
+		MirrorDropped: atomic.LoadInt64(&s.mirrorDropped),
+	}
+	for _, c := range s.conns {
+		result.BytesUp += atomic.LoadInt64(&c.bytesUp)
+		result.BytesDown += atomic.LoadInt64(&c.bytesDown)
+	}
+	return result
+}
+
+func (s *mappingStats) listConns() []*ConnectionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]uint64, 0, len(s.conns))
+	for id := range s.conns {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	result := make([]*ConnectionInfo, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, s.conns[id].info())
+	}
+	return result
+}
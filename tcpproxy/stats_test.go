@@ -0,0 +1,110 @@
+package tcpproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/MoZhonghua/mytools/util/relay"
+)
+
+// waitStats waits until the stats of the mapping and its connections match
+// want and wantConns, the splice path counts bytes once a chunk is copied.
+func waitStats(t *testing.T, p *Proxy, port int, want PortMappingStats, wantConns int) (*PortMappingStats, []*ConnectionInfo) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := p.GetPortMapping(port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns, err := p.ListConnections(port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *info.Stats == want && len(conns) == wantConns {
+			return info.Stats, conns
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stats: %+v with %d connections, want %+v with %d", info.Stats,
+				len(conns), want, wantConns)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// echo sends n bytes through c and reads them back.
+func echo(t *testing.T, c net.Conn, n int) {
+	msg := bytes.Repeat([]byte("x"), n)
+	go c.Write(msg)
+	buf := make([]byte, n)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Time{})
+}
+
+func TestStatsSplice(t *testing.T) {
+	testStats(t, PortMappingLimits{})
+}
+
+// an idle timeout reads every chunk, see proxyConn.direct
+func TestStatsCopy(t *testing.T) {
+	testStats(t, PortMappingLimits{IdleTimeout: 60})
+}
+
+func testStats(t *testing.T, limits PortMappingLimits) {
+	echoServer := startEchoServer(t)
+	defer echoServer.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+
+	port := freePort(t)
+	err := p.AddPortMapping(&PortMappingInfo{
+		LocalPort:         port,
+		RemoteAddr:        echoServer.Addr().String(),
+		PortMappingLimits: limits,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	c1, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	// whole chunks, which the splice path counts while the connection is
+	// open
+	n := int64(2 * relay.ChunkSize)
+	echo(t, c1, int(n))
+	_, conns := waitStats(t, p, port, PortMappingStats{
+		ActiveConns: 1,
+		TotalConns:  1,
+		BytesUp:     n,
+		BytesDown:   n,
+	}, 1)
+	c := conns[0]
+	if c.ClientAddr != c1.LocalAddr().String() || c.RemoteAddr != echoServer.Addr().String() ||
+		c.BytesUp != n || c.BytesDown != n {
+		t.Errorf("connection: %+v", c)
+	}
+
+	// bytes of closed connections stay in the totals
+	c1.Close()
+	waitStats(t, p, port, PortMappingStats{TotalConns: 1, BytesUp: n, BytesDown: n}, 0)
+
+	c2, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c2, 10)
+	c2.Close()
+	waitStats(t, p, port, PortMappingStats{TotalConns: 2, BytesUp: n + 10, BytesDown: n + 10}, 0)
+}
@@ -1,6 +1,7 @@
 package tcpproxy
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -8,13 +9,29 @@ import (
 	"github.com/boltdb/bolt"
 )
 
-var kBucket = []byte("portmapping")
+var (
+	kBucket          = []byte("portmapping")
+	kSNIRouteBucket  = []byte("sniroute")
+	kHTTPRouteBucket = []byte("httproute")
+)
 
 func portToId(port int) []byte {
 	id := fmt.Sprintf("%d", port)
 	return []byte(id)
 }
 
+func routePrefix(port int) []byte {
+	return []byte(fmt.Sprintf("%d/", port))
+}
+
+func sniRouteToId(port int, hostname string) []byte {
+	return []byte(fmt.Sprintf("%d/%s", port, hostname))
+}
+
+func httpRouteToId(port int, host string, pathPrefix string) []byte {
+	return []byte(fmt.Sprintf("%d/%s%s", port, host, pathPrefix))
+}
+
 type Store struct {
 	lock sync.Mutex
 	db   *bolt.DB
@@ -31,6 +48,16 @@ func NewStore(path string) (*Store, error) {
 		if err != nil {
 			return err
 		}
+
+		_, err = tx.CreateBucketIfNotExists(kSNIRouteBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(kHTTPRouteBucket)
+		if err != nil {
+			return err
+		}
 		return nil
 	})
 
@@ -41,6 +68,8 @@ func NewStore(path string) (*Store, error) {
 	return &Store{db: db}, nil
 }
 
+// CleanAndUpdate replaces all port mappings with pms. Routes of port
+// mappings not in pms are deleted.
 func (s *Store) CleanAndUpdate(pms []*PortMappingInfo) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -51,6 +80,17 @@ func (s *Store) CleanAndUpdate(pms []*PortMappingInfo) error {
 			return err
 		}
 
+		keep := make(map[string]bool)
+		for _, pm := range pms {
+			keep[string(routePrefix(pm.LocalPort))] = true
+		}
+		for _, name := range [][]byte{kSNIRouteBucket, kHTTPRouteBucket} {
+			err = deleteRoutesExcept(tx.Bucket(name), keep)
+			if err != nil {
+				return err
+			}
+		}
+
 		b, err := tx.CreateBucketIfNotExists(kBucket)
 		if err != nil {
 			return err
@@ -88,15 +128,111 @@ func (s *Store) AddPortMapping(pm *PortMappingInfo) error {
 	})
 }
 
+// DeletePortMapping deletes a port mapping along with its sni and http routes.
 func (s *Store) DeletePortMapping(localPort int) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	return s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(kBucket)
-		return b.Delete(portToId(localPort))
+		err := b.Delete(portToId(localPort))
+		if err != nil {
+			return err
+		}
+
+		err = deleteWithPrefix(tx.Bucket(kSNIRouteBucket), routePrefix(localPort))
+		if err != nil {
+			return err
+		}
+
+		return deleteWithPrefix(tx.Bucket(kHTTPRouteBucket), routePrefix(localPort))
 	})
 }
 
+func deleteWithPrefix(b *bolt.Bucket, prefix []byte) error {
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+
+	for _, k := range keys {
+		err := b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRoutesExcept deletes routes whose port prefix is not in keep.
+func deleteRoutesExcept(b *bolt.Bucket, keep map[string]bool) error {
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		i := bytes.IndexByte(k, '/')
+		if i < 0 || !keep[string(k[:i+1])] {
+			keys = append(keys, k)
+		}
+	}
+
+	for _, k := range keys {
+		err := b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) AddSNIRoute(route *SNIRoute) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, err := json.Marshal(route)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(kSNIRouteBucket)
+		return b.Put(sniRouteToId(route.LocalPort, route.Hostname), data)
+	})
+}
+
+func (s *Store) DeleteSNIRoute(localPort int, hostname string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(kSNIRouteBucket)
+		return b.Delete(sniRouteToId(localPort, hostname))
+	})
+}
+
+func (s *Store) GetAllSNIRoute() ([]*SNIRoute, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make([]*SNIRoute, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(kSNIRouteBucket)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			route := &SNIRoute{}
+			err := json.Unmarshal(v, route)
+			if err != nil {
+				return err
+			}
+			result = append(result, route)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func (s *Store) GetAllPortMapping() ([]*PortMappingInfo, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -122,3 +258,52 @@ func (s *Store) GetAllPortMapping() ([]*PortMappingInfo, error) {
 
 	return result, nil
 }
+
+func (s *Store) AddHTTPRoute(route *HTTPRoute) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, err := json.Marshal(route)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(kHTTPRouteBucket)
+		return b.Put(httpRouteToId(route.LocalPort, route.Host, route.PathPrefix), data)
+	})
+}
+
+func (s *Store) DeleteHTTPRoute(localPort int, host string, pathPrefix string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(kHTTPRouteBucket)
+		return b.Delete(httpRouteToId(localPort, host, pathPrefix))
+	})
+}
+
+func (s *Store) GetAllHTTPRoute() ([]*HTTPRoute, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make([]*HTTPRoute, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(kHTTPRouteBucket)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			route := &HTTPRoute{}
+			err := json.Unmarshal(v, route)
+			if err != nil {
+				return err
+			}
+			result = append(result, route)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,227 @@
+package tcpproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	tlsHandshakeTimeout = 10 * time.Second
+	tlsReloadInterval   = time.Second
+)
+
+// reloadableFiles calls load whenever one of the files is modified. Files
+// are checked at most once per tlsReloadInterval, when the content is used.
+type reloadableFiles struct {
+	mu      sync.Mutex
+	files   []string
+	modTime time.Time
+	checked time.Time
+	load    func() error
+}
+
+func latestModTime(files []string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// init loads the files for the first time, errors are returned instead of
+// being logged.
+func (r *reloadableFiles) init() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := latestModTime(r.files)
+	if err != nil {
+		return err
+	}
+
+	err = r.load()
+	if err != nil {
+		return err
+	}
+
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+// check reloads the files if they changed. On failure the previously loaded
+// content is kept.
+func (r *reloadableFiles) check() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) < tlsReloadInterval {
+		return
+	}
+	r.checked = time.Now()
+
+	modTime, err := latestModTime(r.files)
+	if err != nil {
+		log.Errorf("failed to check %v: %v", r.files, err)
+		return
+	}
+	if !modTime.After(r.modTime) {
+		return
+	}
+
+	err = r.load()
+	if err != nil {
+		log.Errorf("failed to reload %v: %v", r.files, err)
+		return
+	}
+	r.modTime = modTime
+	log.Infof("reloaded %v", r.files)
+}
+
+type certReloader struct {
+	reloadableFiles
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{}
+	r.files = []string{certFile, keyFile}
+	r.load = func() error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		r.cert = &cert
+		return nil
+	}
+
+	err := r.init()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.check()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+type caReloader struct {
+	reloadableFiles
+	pool *x509.CertPool
+}
+
+func newCAReloader(caFile string) (*caReloader, error) {
+	r := &caReloader{}
+	r.files = []string{caFile}
+	r.load = func() error {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in %s", caFile)
+		}
+		r.pool = pool
+		return nil
+	}
+
+	err := r.init()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *caReloader) CertPool() *x509.CertPool {
+	r.check()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pool
+}
+
+// newServerTLSConfig returns the config used to terminate TLS on the local
+// listener.
+func newServerTLSConfig(c *TLSServerConfig) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("tls: certFile and keyFile are required")
+	}
+
+	r, err := newCertReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+	}, nil
+}
+
+// remoteTLS originates TLS connections to the remote address.
+type remoteTLS struct {
+	serverName string
+	insecure   bool
+	ca         *caReloader
+}
+
+func newRemoteTLS(c *TLSClientConfig) (*remoteTLS, error) {
+	t := &remoteTLS{
+		serverName: c.ServerName,
+		insecure:   c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		ca, err := newCAReloader(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		t.ca = ca
+	}
+	return t, nil
+}
+
+// clientConfig returns the config to connect remoteAddr, the server name
+// defaults to its host.
+func (t *remoteTLS) clientConfig(remoteAddr string) *tls.Config {
+	serverName := t.serverName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(remoteAddr)
+	}
+
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: t.insecure,
+	}
+	if t.ca != nil {
+		cfg.RootCAs = t.ca.CertPool()
+	}
+	return cfg
+}
+
+func tlsHandshake(c *tls.Conn) error {
+	c.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := c.Handshake()
+	if err != nil {
+		return err
+	}
+	return c.SetDeadline(time.Time{})
+}
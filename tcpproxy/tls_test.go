@@ -0,0 +1,173 @@
+package tcpproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for localhost and returns
+// the certificate and key file paths.
+func writeTestCert(t *testing.T, dir string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func tlsDialAndEcho(t *testing.T, port int, caFile string) *tls.Conn {
+	ca, err := newCAReloader(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	c, err := tls.Dial("tcp4", addr, &tls.Config{
+		ServerName: "localhost",
+		RootCAs:    ca.CertPool(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("hello")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTLSTermination(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, 1)
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+
+	port := freePort(t)
+	info := &PortMappingInfo{
+		LocalPort:  port,
+		RemoteAddr: echo.Addr().String(),
+		TLS:        &TLSServerConfig{CertFile: certFile, KeyFile: keyFile},
+	}
+	err := p.AddPortMapping(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := tlsDialAndEcho(t, port, certFile)
+	c.Close()
+
+	// replace the certificate and check the next handshake picks it up
+	certFile, _ = writeTestCert(t, dir, 2)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	time.Sleep(tlsReloadInterval + 100*time.Millisecond)
+
+	c = tlsDialAndEcho(t, port, certFile)
+	defer c.Close()
+	serial := c.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	if serial != 2 {
+		t.Fatalf("certificate not reloaded, serial: %d", serial)
+	}
+}
+
+func TestTLSOrigination(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, 1)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	p := NewProxy()
+	defer p.Close(nil)
+
+	port := freePort(t)
+	info := &PortMappingInfo{
+		LocalPort:  port,
+		RemoteAddr: l.Addr().String(),
+		RemoteTLS:  &TLSClientConfig{ServerName: "localhost", CAFile: certFile},
+	}
+	err = p.AddPortMapping(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialAndEcho(t, port)
+	c.Close()
+}
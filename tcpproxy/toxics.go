@@ -0,0 +1,332 @@
+package tcpproxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrToxicExists       = errors.New("toxic already exists")
+	ErrToxicNotFound     = errors.New("toxic not found")
+	ErrToxicNotSupported = errors.New("toxics not supported for http port mapping")
+
+	errToxicClosed = errors.New("connection closed by toxic")
+)
+
+// bandwidth toxics write at most this much data at once
+const toxicBandwidthInterval = 100 * time.Millisecond
+
+// validateToxic checks t and names it after its type and stream if it has
+// no name.
+func validateToxic(t *ToxicInfo) error {
+	switch t.Stream {
+	case "", ToxicUpstream, ToxicDownstream:
+	default:
+		return fmt.Errorf("invalid stream: %s", t.Stream)
+	}
+
+	if t.Toxicity < 0 || t.Toxicity > 1 {
+		return fmt.Errorf("invalid toxicity: %v", t.Toxicity)
+	}
+	if t.Latency < 0 || t.Jitter < 0 || t.Rate < 0 || t.Timeout < 0 ||
+		t.Size < 0 || t.SizeVariation < 0 || t.Delay < 0 || t.Bytes < 0 {
+		return errors.New("negative toxic attribute")
+	}
+
+	switch t.Type {
+	case ToxicLatency:
+		if t.Latency == 0 && t.Jitter == 0 {
+			return errors.New("latency or jitter is required")
+		}
+	case ToxicBandwidth:
+		if t.Rate == 0 {
+			return errors.New("rate is required")
+		}
+	case ToxicSlicer:
+		if t.Size == 0 {
+			return errors.New("size is required")
+		}
+		if t.SizeVariation >= t.Size {
+			return errors.New("size variation must be less than size")
+		}
+	case ToxicLimitData:
+		if t.Bytes == 0 {
+			return errors.New("bytes is required")
+		}
+	case ToxicReset, ToxicStall:
+	default:
+		return fmt.Errorf("unknown toxic type: %s", t.Type)
+	}
+
+	if t.Name == "" {
+		t.Name = t.Type
+		if t.Stream != "" {
+			t.Name += "_" + t.Stream
+		}
+	}
+	return nil
+}
+
+func (t *ToxicInfo) affects(up bool) bool {
+	return t.Stream == "" || (t.Stream == ToxicUpstream) == up
+}
+
+func (t *ToxicInfo) latency() time.Duration {
+	d := t.Latency
+	if t.Jitter > 0 {
+		d += rand.Intn(2*t.Jitter+1) - t.Jitter
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d) * time.Millisecond
+}
+
+func (t *ToxicInfo) sliceSize() int {
+	if t.SizeVariation == 0 {
+		return t.Size
+	}
+	return t.Size + rand.Intn(2*t.SizeVariation+1) - t.SizeVariation
+}
+
+// getToxics returns the toxics of the port mapping, the list is replaced
+// rather than modified when toxics are added or deleted.
+func (m *portMapping) getToxics() []*ToxicInfo {
+	list, _ := m.toxics.Load().([]*ToxicInfo)
+	return list
+}
+
+func (m *portMapping) addToxic(t *ToxicInfo) error {
+	if m.http != nil {
+		return ErrToxicNotSupported
+	}
+
+	m.toxicsMu.Lock()
+	defer m.toxicsMu.Unlock()
+
+	old := m.getToxics()
+	for _, x := range old {
+		if x.Name == t.Name {
+			return ErrToxicExists
+		}
+	}
+
+	list := make([]*ToxicInfo, 0, len(old)+1)
+	list = append(list, old...)
+	m.toxics.Store(append(list, t))
+
+	// connections without toxics may be blocked in a splice
+	m.interruptConns()
+	return nil
+}
+
+func (m *portMapping) deleteToxic(name string) error {
+	m.toxicsMu.Lock()
+	defer m.toxicsMu.Unlock()
+
+	old := m.getToxics()
+	for i, x := range old {
+		if x.Name != name {
+			continue
+		}
+
+		list := make([]*ToxicInfo, 0, len(old)-1)
+		list = append(list, old[:i]...)
+		m.toxics.Store(append(list, old[i+1:]...))
+		return nil
+	}
+	return ErrToxicNotFound
+}
+
+type toxicTimerKey struct {
+	toxic *ToxicInfo
+	up    bool
+}
+
+// connToxics applies the toxics of a port mapping to one connection.
+// Toxics added or deleted later also apply to established connections.
+// Its methods accept a nil receiver, which applies no toxic.
+type connToxics struct {
+	m      *portMapping
+	client net.Conn
+	remote net.Conn
+
+	// bytes written upstream and downstream, each only used by the pipe
+	// of its direction
+	written [2]int64
+
+	mu       sync.Mutex
+	affected map[*ToxicInfo]bool
+	armed    map[toxicTimerKey]bool
+	timers   []*time.Timer
+	finished bool
+}
+
+func newConnToxics(m *portMapping, client, remote net.Conn) *connToxics {
+	return &connToxics{
+		m:        m,
+		client:   client,
+		remote:   remote,
+		affected: make(map[*ToxicInfo]bool),
+		armed:    make(map[toxicTimerKey]bool),
+	}
+}
+
+// isAffected decides once per connection whether x applies to it.
+func (t *connToxics) isAffected(x *ToxicInfo) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	affected, found := t.affected[x]
+	if !found {
+		affected = x.Toxicity == 0 || rand.Float64() < x.Toxicity
+		t.affected[x] = affected
+	}
+	return affected
+}
+
+// active reports whether the port mapping has any toxic.
+func (t *connToxics) active() bool {
+	return t != nil && len(t.m.getToxics()) > 0
+}
+
+// after runs fn d after it's first called for x and the direction.
+func (t *connToxics) after(x *ToxicInfo, up bool, d time.Duration, fn func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := toxicTimerKey{toxic: x, up: up}
+	if t.finished || t.armed[key] {
+		return
+	}
+	t.armed[key] = true
+	t.timers = append(t.timers, time.AfterFunc(d, fn))
+}
+
+// finish stops pending timers once the connection is closed.
+func (t *connToxics) finish() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.finished = true
+	for _, timer := range t.timers {
+		timer.Stop()
+	}
+}
+
+func tcpConnOf(c net.Conn) *net.TCPConn {
+	switch c := c.(type) {
+	case *net.TCPConn:
+		return c
+	case *peekedConn:
+		return tcpConnOf(c.Conn)
+	}
+	return nil
+}
+
+// close closes both sides of the connection, with a RST if reset is true.
+func (t *connToxics) close(reset bool) {
+	for _, c := range []net.Conn{t.client, t.remote} {
+		if tc := tcpConnOf(c); tc != nil && reset {
+			tc.SetLinger(0)
+		}
+		c.Close()
+	}
+}
+
+// write writes p to w through the toxics of the direction, up is from the
+// client to the remote. It returns an error once the connection must end.
+func (t *connToxics) write(up bool, w net.Conn, p []byte, counter *int64) error {
+	if t == nil {
+		return writeAll(w, p, counter)
+	}
+
+	dir := 0
+	if !up {
+		dir = 1
+	}
+
+	var rate int
+	var slicer *ToxicInfo
+	limited := false
+	for _, x := range t.m.getToxics() {
+		if !x.affects(up) || !t.isAffected(x) {
+			continue
+		}
+
+		switch x.Type {
+		case ToxicLatency:
+			time.Sleep(x.latency())
+		case ToxicBandwidth:
+			rate = x.Rate
+		case ToxicSlicer:
+			slicer = x
+		case ToxicReset:
+			t.after(x, up, time.Duration(x.Timeout)*time.Millisecond, func() {
+				t.close(true)
+			})
+		case ToxicStall:
+			if x.Timeout > 0 {
+				t.after(x, up, time.Duration(x.Timeout)*time.Millisecond, func() {
+					t.close(false)
+				})
+			}
+			return nil
+		case ToxicLimitData:
+			remain := x.Bytes - t.written[dir]
+			if remain < 0 {
+				remain = 0
+			}
+			if int64(len(p)) >= remain {
+				p = p[:remain]
+				limited = true
+			}
+		}
+	}
+
+	for len(p) > 0 {
+		n := len(p)
+		if slicer != nil {
+			if size := slicer.sliceSize(); size < n {
+				n = size
+			}
+		}
+		if rate > 0 {
+			max := rate * 1024 * int(toxicBandwidthInterval/time.Millisecond) / 1000
+			if max < 1 {
+				max = 1
+			}
+			if max < n {
+				n = max
+			}
+		}
+
+		err := writeAll(w, p[:n], counter)
+		if err != nil {
+			return err
+		}
+		t.written[dir] += int64(n)
+		p = p[n:]
+
+		if rate > 0 {
+			time.Sleep(time.Duration(n) * time.Second / time.Duration(rate*1024))
+		}
+		if slicer != nil && slicer.Delay > 0 && len(p) > 0 {
+			time.Sleep(time.Duration(slicer.Delay) * time.Microsecond)
+		}
+	}
+
+	if limited {
+		t.close(false)
+		return errToxicClosed
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package tcpproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func addTestToxic(t *testing.T, p *Proxy, toxic *ToxicInfo) {
+	err := p.AddToxic(toxic)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestToxicLatency(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTestPortMapping(t, p, echo)
+
+	addTestToxic(t, p, &ToxicInfo{
+		LocalPort: port,
+		Type:      ToxicLatency,
+		Stream:    ToxicDownstream,
+		Latency:   200,
+	})
+
+	start := time.Now()
+	c := dialAndEcho(t, port)
+	defer c.Close()
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("echo took %v", d)
+	}
+
+	// deleting the toxic applies to the established connection
+	err := p.DeleteToxic(port, "latency_downstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start = time.Now()
+	c.Write([]byte("hello"))
+	io.ReadFull(c, make([]byte, 5))
+	if d := time.Since(start); d >= 200*time.Millisecond {
+		t.Errorf("echo still delayed: %v", d)
+	}
+}
+
+func TestToxicAddedToEstablishedConn(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTestPortMapping(t, p, echo)
+
+	// the connection starts on the splice path without toxics
+	c := dialAndEcho(t, port)
+	defer c.Close()
+
+	addTestToxic(t, p, &ToxicInfo{
+		LocalPort: port,
+		Type:      ToxicLatency,
+		Stream:    ToxicDownstream,
+		Latency:   200,
+	})
+
+	start := time.Now()
+	c.Write([]byte("hello"))
+	io.ReadFull(c, make([]byte, 5))
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("echo took %v", d)
+	}
+}
+
+func TestToxicBandwidthAndSlicer(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTestPortMapping(t, p, echo)
+
+	addTestToxic(t, p, &ToxicInfo{
+		LocalPort: port,
+		Type:      ToxicBandwidth,
+		Stream:    ToxicUpstream,
+		Rate:      100,
+	})
+	addTestToxic(t, p, &ToxicInfo{
+		LocalPort:     port,
+		Type:          ToxicSlicer,
+		Size:          100,
+		SizeVariation: 50,
+		Delay:         10,
+	})
+
+	c := dialAndEcho(t, port)
+	defer c.Close()
+
+	// 20KB at 100KB/s
+	msg := bytes.Repeat([]byte("0123456789"), 2048)
+	start := time.Now()
+	go c.Write(msg)
+	buf := make([]byte, len(msg))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.ReadFull(c, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("data corrupted")
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("20KB sent in %v", d)
+	}
+}
+
+func TestToxicLimitData(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTestPortMapping(t, p, echo)
+
+	addTestToxic(t, p, &ToxicInfo{
+		LocalPort: port,
+		Type:      ToxicLimitData,
+		Stream:    ToxicDownstream,
+		Bytes:     8,
+	})
+
+	c := dialAndEcho(t, port)
+	defer c.Close()
+	c.Write([]byte("hello"))
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hel" {
+		t.Errorf("read %q after limit", data)
+	}
+}
+
+func TestToxicReset(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTestPortMapping(t, p, echo)
+
+	addTestToxic(t, p, &ToxicInfo{
+		LocalPort: port,
+		Type:      ToxicReset,
+		Stream:    ToxicUpstream,
+	})
+
+	c := dialAndEchoNoCheck(t, port)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := ioutil.ReadAll(c)
+	if err == nil || !strings.Contains(err.Error(), syscall.ECONNRESET.Error()) {
+		t.Errorf("connection not reset: %v", err)
+	}
+}
+
+func TestToxicStall(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTestPortMapping(t, p, echo)
+
+	addTestToxic(t, p, &ToxicInfo{
+		LocalPort: port,
+		Type:      ToxicStall,
+		Stream:    ToxicDownstream,
+		Timeout:   300,
+	})
+
+	c := dialAndEchoNoCheck(t, port)
+	defer c.Close()
+
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Errorf("read %q from stalled connection", data)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("closed after %v", d)
+	}
+}
+
+func TestToxicToxicity(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTestPortMapping(t, p, echo)
+
+	addTestToxic(t, p, &ToxicInfo{
+		LocalPort: port,
+		Type:      ToxicStall,
+		Toxicity:  0.000001,
+	})
+
+	// almost never applies
+	c := dialAndEcho(t, port)
+	c.Close()
+
+	err := p.AddToxic(&ToxicInfo{LocalPort: port, Type: ToxicStall})
+	if err != ErrToxicExists {
+		t.Errorf("duplicated toxic: %v", err)
+	}
+}
+
+// dialAndEchoNoCheck sends "hello" without waiting for the echo.
+func dialAndEchoNoCheck(t *testing.T, port int) net.Conn {
+	c, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
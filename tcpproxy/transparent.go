@@ -0,0 +1,113 @@
+package tcpproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+var (
+	ErrTransparentNotSupported = errors.New("transparent proxy is only supported on linux")
+	ErrDestinationNotAllowed   = errors.New("destination not allowed")
+)
+
+// transparent recovers the original destination of connections to a
+// transparent port mapping.
+type transparent struct {
+	tproxy       bool
+	destinations []*net.IPNet
+}
+
+func newTransparent(c *TransparentConfig) (*transparent, error) {
+	if !transparentSupported {
+		return nil, ErrTransparentNotSupported
+	}
+	if c == nil {
+		c = &TransparentConfig{}
+	}
+
+	destinations, err := parseCIDRs(c.Destinations)
+	if err != nil {
+		return nil, err
+	}
+	return &transparent{tproxy: c.TProxy, destinations: destinations}, nil
+}
+
+// validateTransparent checks the fields a transparent port mapping can't
+// have, and that only transparent port mappings have a TransparentConfig.
+func validateTransparent(info *PortMappingInfo) error {
+	if info.GetType() != PortMappingTypeTransparent {
+		if info.Transparent != nil {
+			return fmt.Errorf("%s port mapping can't be transparent", info.GetType())
+		}
+		return nil
+	}
+
+	if len(info.GetRemotes()) > 0 {
+		return errors.New("transparent port mapping can't have remote address")
+	}
+	if info.TLS != nil || info.RemoteTLS != nil {
+		return errors.New("transparent port mapping can't terminate or originate tls")
+	}
+	if info.Transparent != nil {
+		_, err := parseCIDRs(info.Transparent.Destinations)
+		return err
+	}
+	return nil
+}
+
+// listen listens on port for redirected connections.
+func (t *transparent) listen(port int) (net.Listener, error) {
+	addr := fmt.Sprintf(":%d", port)
+	if t.tproxy {
+		return listenTransparent(addr)
+	}
+	return net.Listen("tcp4", addr)
+}
+
+// destination returns the original destination of c accepted on port,
+// along with ErrDestinationNotAllowed if it's filtered out. A connection
+// made to the port directly rather than redirected would be forwarded to
+// the proxy itself, so it's refused.
+func (t *transparent) destination(c net.Conn, port int) (string, error) {
+	var dst *net.TCPAddr
+	if t.tproxy {
+		dst, _ = c.LocalAddr().(*net.TCPAddr)
+	} else {
+		var err error
+		dst, err = originalDst(c)
+		if err != nil {
+			return "", fmt.Errorf("original destination: %v", err)
+		}
+	}
+	if dst == nil {
+		return "", errors.New("no original destination")
+	}
+
+	if dst.Port == port && isLocalIP(dst.IP) {
+		return "", fmt.Errorf("connection to %v wasn't redirected", dst)
+	}
+
+	addr := net.JoinHostPort(dst.IP.String(), strconv.Itoa(dst.Port))
+	if len(t.destinations) > 0 && !matchCIDRs(t.destinations, dst.IP) {
+		return addr, ErrDestinationNotAllowed
+	}
+	return addr, nil
+}
+
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package tcpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+const transparentSupported = true
+
+// SO_ORIGINAL_DST of linux/netfilter_ipv4.h
+const soOriginalDst = 80
+
+// originalDst reads the destination of a connection before the REDIRECT
+// target rewrote it.
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	tc := tcpConnOf(c)
+	if tc == nil {
+		return nil, errors.New("not a tcp connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	cerr := raw.Control(func(fd uintptr) {
+		// the sockaddr_in fits in the 16 bytes of an ipv6_mreq
+		mreq, e := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if e != nil {
+			err = os.NewSyscallError("getsockopt", e)
+			return
+		}
+		b := mreq.Multiaddr
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+			Port: int(b[2])<<8 | int(b[3]),
+		}
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	return addr, err
+}
+
+// listenTransparent listens with IP_TRANSPARENT so connections sent by the
+// TPROXY target to any address are accepted.
+func listenTransparent(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return os.NewSyscallError("setsockopt", err)
+		},
+	}
+	return lc.Listen(context.Background(), "tcp4", addr)
+}
@@ -0,0 +1,121 @@
+package tcpproxy
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+func addTransparentPortMapping(t *testing.T, p *Proxy, c *TransparentConfig) int {
+	port := freePort(t)
+	err := p.AddPortMapping(&PortMappingInfo{
+		LocalPort:   port,
+		Type:        PortMappingTypeTransparent,
+		Transparent: c,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func TestTransparentNotRedirected(t *testing.T) {
+	p := NewProxy()
+	defer p.Close(nil)
+	sink := &memorySink{}
+	p.SetAccessLog(sink)
+
+	port := addTransparentPortMapping(t, p, nil)
+	c := dialAndEchoNoCheck(t, port)
+	waitClosed(t, c)
+	c.Close()
+
+	e := sink.wait(t, 1)[0]
+	if e.Reason != CloseReasonError || e.Error == "" {
+		t.Errorf("entry: %+v", e)
+	}
+}
+
+func TestTransparentTProxyListen(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("IP_TRANSPARENT needs CAP_NET_ADMIN")
+	}
+
+	p := NewProxy()
+	defer p.Close(nil)
+	port := addTransparentPortMapping(t, p, &TransparentConfig{TProxy: true})
+	c := dialAndEchoNoCheck(t, port)
+	waitClosed(t, c)
+	c.Close()
+}
+
+func runCommand(t *testing.T, name string, args ...string) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %v: %v\n%s", name, args, err, out)
+	}
+}
+
+// TestTransparentRedirect runs itself again in a new network namespace,
+// where connections from one source port are redirected to the proxy.
+func TestTransparentRedirect(t *testing.T) {
+	if os.Getenv("TCPPROXY_TEST_NETNS") == "" {
+		if os.Geteuid() != 0 {
+			t.Skip("needs root to create a network namespace")
+		}
+		for _, name := range []string{"unshare", "ip", "iptables"} {
+			if _, err := exec.LookPath(name); err != nil {
+				t.Skipf("%s not found", name)
+			}
+		}
+
+		cmd := exec.Command("unshare", "-n", os.Args[0],
+			"-test.run=^TestTransparentRedirect$", "-test.v")
+		cmd.Env = append(os.Environ(), "TCPPROXY_TEST_NETNS=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+
+	runCommand(t, "ip", "link", "set", "lo", "up")
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	p := NewProxy()
+	defer p.Close(nil)
+	sink := &memorySink{}
+	p.SetAccessLog(sink)
+	port := addTransparentPortMapping(t, p, &TransparentConfig{
+		Destinations: []string{"127.0.0.0/8"},
+	})
+
+	// only the client is redirected, not the connection of the proxy to
+	// the original destination
+	sport := freePort(t)
+	runCommand(t, "iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp",
+		"--sport", strconv.Itoa(sport), "-j", "REDIRECT",
+		"--to-ports", strconv.Itoa(port))
+
+	d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: sport}}
+	c, err := d.Dial("tcp4", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("echo %q %v", buf, err)
+	}
+	c.Close()
+
+	e := sink.wait(t, 1)[0]
+	if e.LocalPort != port || e.RemoteAddr != echo.Addr().String() {
+		t.Errorf("entry: %+v", e)
+	}
+}
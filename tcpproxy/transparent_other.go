@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package tcpproxy
+
+import (
+	"net"
+)
+
+const transparentSupported = false
+
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentNotSupported
+}
+
+func listenTransparent(addr string) (net.Listener, error) {
+	return nil, ErrTransparentNotSupported
+}
@@ -0,0 +1,57 @@
+package tcpproxy
+
+import (
+	"net"
+	"testing"
+)
+
+// addrConn is a connection with fixed addresses.
+type addrConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func TestTransparentDestination(t *testing.T) {
+	destinations, _ := parseCIDRs([]string{"10.0.0.0/8"})
+	tp := &transparent{tproxy: true, destinations: destinations}
+
+	for _, test := range []struct {
+		dst  string
+		want string
+		err  error
+	}{
+		{dst: "10.1.2.3:80", want: "10.1.2.3:80"},
+		{dst: "192.168.1.1:80", want: "192.168.1.1:80", err: ErrDestinationNotAllowed},
+	} {
+		dst, _ := net.ResolveTCPAddr("tcp4", test.dst)
+		addr, err := tp.destination(&addrConn{local: dst}, 3000)
+		if addr != test.want || err != test.err {
+			t.Errorf("destination of %s: %s %v", test.dst, addr, err)
+		}
+	}
+
+	// not redirected, it would loop back to the proxy
+	local, _ := net.ResolveTCPAddr("tcp4", "127.0.0.1:3000")
+	_, err := tp.destination(&addrConn{local: local}, 3000)
+	if err == nil {
+		t.Error("connection to the proxy port accepted")
+	}
+}
+
+func TestValidateTransparent(t *testing.T) {
+	for _, info := range []*PortMappingInfo{
+		{LocalPort: 1, Type: PortMappingTypeTransparent, RemoteAddr: "127.0.0.1:80"},
+		{LocalPort: 1, Type: PortMappingTypeTransparent, TLS: &TLSServerConfig{}},
+		{LocalPort: 1, RemoteAddr: "127.0.0.1:80", Transparent: &TransparentConfig{}},
+		{LocalPort: 1, Type: PortMappingTypeTransparent,
+			Transparent: &TransparentConfig{Destinations: []string{"bad"}}},
+	} {
+		if validateTransparent(info) == nil {
+			t.Errorf("%+v accepted", info)
+		}
+	}
+}
@@ -35,9 +35,36 @@ func marshalData(v interface{}) string {
 	return string(b)
 }
 
+const igdDescription = "<igd> is the URL of the IGD description, its uuid, the router IP, " +
+	"or auto to discover it"
+
 var debug bool
 var proxy string
 
+var protocolFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "udp",
+		Usage: "map UDP instead of TCP",
+	},
+}
+
+func protocol(c *cli.Context) string {
+	if c.Bool("udp") {
+		return upnp.ProtocolUDP
+	}
+	return upnp.ProtocolTCP
+}
+
+// igdArg returns the IGD given as the first argument: the URL of its
+// description, its uuid, the router IP, or "auto" to discover it.
+func igdArg(c *cli.Context) string {
+	igd := c.Args()[0]
+	if igd == "auto" {
+		return ""
+	}
+	return igd
+}
+
 func fail(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, args...)
 	fmt.Fprintln(os.Stderr, "")
@@ -87,16 +114,38 @@ func main() {
 			Action:    cmdSSDPSearch,
 		},
 		{
-			Name:      "addportmap",
-			Usage:     "add port mapping",
-			ArgsUsage: "<igdDeviceIP> <localIP:localPort> <externalPort>",
-			Action:    cmdAddPortMapping,
+			Name:      "discover",
+			Usage:     "discover IGDs on all interfaces",
+			ArgsUsage: "",
+			Action:    cmdDiscover,
 		},
 		{
-			Name:      "deleteportmap",
-			Usage:     "delete port mapping",
-			ArgsUsage: "<igdDeviceIP> <externalPort>",
-			Action:    cmdDelPortMapping,
+			Name:        "addportmap",
+			Usage:       "add port mapping",
+			ArgsUsage:   "<igd> <localIP:localPort> <externalPort>",
+			Description: igdDescription,
+			Action:      cmdAddPortMapping,
+			Flags: append([]cli.Flag{
+				&cli.BoolFlag{
+					Name:  "check",
+					Usage: "fail if the external port is mapped to another address",
+				},
+			}, protocolFlags...),
+		},
+		{
+			Name:        "deleteportmap",
+			Usage:       "delete port mapping",
+			ArgsUsage:   "<igd> <externalPort>",
+			Description: igdDescription,
+			Action:      cmdDelPortMapping,
+			Flags:       protocolFlags,
+		},
+		{
+			Name:        "listportmap",
+			Usage:       "list port mappings of the igd",
+			ArgsUsage:   "<igd>",
+			Description: igdDescription,
+			Action:      cmdListPortMapping,
 		},
 	}
 
@@ -172,6 +221,14 @@ func cmdSSDPSearch(c *cli.Context) error {
 	return nil
 }
 
+func cmdDiscover(c *cli.Context) error {
+	setupDebug()
+	for _, igd := range upnp.DiscoverIGDs() {
+		fmt.Printf("%s %s %s\n", igd.UUID, igd.FriendlyName, igd.DescriptionURL)
+	}
+	return nil
+}
+
 func parseIPPort(s string) (net.IP, int, error) {
 	f := strings.Split(s, ":")
 	if len(f) != 2 {
@@ -194,7 +251,7 @@ func cmdAddPortMapping(c *cli.Context) error {
 		os.Exit(1)
 	}
 
-	igdDeviceIP := c.Args()[0]
+	igd := igdArg(c)
 	localIP, localPort, err := parseIPPort(c.Args()[1])
 	if err != nil {
 		fail("error: %v", err)
@@ -204,14 +261,14 @@ func cmdAddPortMapping(c *cli.Context) error {
 		fail("error: %v", err)
 	}
 
-	externalIP, err := upnp.AddUpnpTcpPortMapping(igdDeviceIP, externalPort,
-		localIP.String(), localPort)
+	externalIP, err := upnp.AddUpnpPortMapping(igd, protocol(c),
+		externalPort, localIP.String(), localPort, c.Bool("check"))
 	if err != nil {
 		fail("error: %v", err)
 	}
 
-	fmt.Printf("Port mapping %s:%d -> %s:%d OK!\n",
-		externalIP, externalPort,
+	fmt.Printf("%s port mapping %s:%d -> %s:%d OK!\n",
+		protocol(c), externalIP, externalPort,
 		localIP.String(), localPort)
 
 	return nil
@@ -224,14 +281,47 @@ func cmdDelPortMapping(c *cli.Context) error {
 		os.Exit(1)
 	}
 
-	igdDeviceIP := c.Args()[0]
+	igd := igdArg(c)
 	externalPort, err := parseInt(c.Args()[1])
 	if err != nil {
 		fail("error: %v", err)
 	}
-	err = upnp.DeleteUpnpTcpPortMapping(igdDeviceIP, externalPort)
+	err = upnp.DeleteUpnpPortMapping(igd, protocol(c), externalPort)
+	if err != nil {
+		fail("error: %v", err)
+	}
+	return nil
+}
+
+func cmdListPortMapping(c *cli.Context) error {
+	setupDebug()
+	if len(c.Args()) < 1 {
+		cli.ShowSubcommandHelp(c)
+		os.Exit(1)
+	}
+
+	igd, err := upnp.GetIGD(igdArg(c), "")
 	if err != nil {
 		fail("error: %v", err)
 	}
+
+	fmt.Printf("%-5s %6s    %-21s %-7s %-10s %s\n",
+		"PROTO", "PORT", "INTERNAL", "ENABLED", "LEASE", "DESCRIPTION")
+	for _, s := range igd.Services {
+		entries, err := s.ListPortMappings()
+		if err != nil {
+			fail("error: %v", err)
+		}
+
+		for _, e := range entries {
+			lease := "permanent"
+			if e.LeaseDuration > 0 {
+				lease = e.LeaseDuration.String()
+			}
+			internal := fmt.Sprintf("%s:%d", e.InternalClient, e.InternalPort)
+			fmt.Printf("%-5s %6d -> %-21s %-7v %-10s %s\n", e.Protocol, e.ExternalPort,
+				internal, e.Enabled, lease, e.Description)
+		}
+	}
 	return nil
 }
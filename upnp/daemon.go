@@ -2,7 +2,11 @@ package upnp
 
 import (
 	"errors"
+	"net"
+	"strings"
 	"sync"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 var (
@@ -12,51 +16,215 @@ var (
 
 type Daemon struct {
 	mu       sync.Mutex
+	methods  []string
 	mappings map[string]*portMapping
+
+	// NAT-PMP and PCP clients by method and gateway, shared by the mappings
+	// on the gateway to follow its epoch
+	clientsMu sync.Mutex
+	clients   map[string]PortMapper
 }
 
 func NewDaemon() *Daemon {
 	p := &Daemon{
+		methods:  DefaultMethods,
 		mappings: make(map[string]*portMapping),
+		clients:  make(map[string]PortMapper),
 	}
 	return p
 }
 
-func (p *Daemon) AddPortMapping(igdServer string, externalPort int,
-	internalIP string, internalPort int) error {
+// SetMethods sets the methods AddPortMapping tries in order, DefaultMethods
+// initially.
+func (p *Daemon) SetMethods(methods ...string) error {
+	if len(methods) == 0 {
+		return ErrInvalidMethod
+	}
+	for _, method := range methods {
+		err := validateMethod(method)
+		if err != nil {
+			return err
+		}
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.methods = append([]string(nil), methods...)
+	return nil
+}
 
-	info := &PortMappingInfo{
-		IGDServer:    igdServer,
-		ExternalPort: externalPort,
-		InternalIP:   internalIP,
-		InternalPort: internalPort,
+// AddPortMapping maps externalPort of protocol, TCP or UDP, on the gateway
+// and keeps refreshing it. The methods are tried in order until one
+// succeeds. For UPnP the IGD is found by GetIGD and then identified by its
+// UUID, for NAT-PMP and PCP igdServer is the IP of the gateway, or empty for
+// the default gateway. The same external port may be mapped once for each
+// protocol.
+func (p *Daemon) AddPortMapping(igdServer string, protocol string, externalPort int,
+	internalIP string, internalPort int) error {
+	protocol, err := ParseProtocol(protocol)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	methods := p.methods
+	p.mu.Unlock()
+
+	var errs []string
+	for _, method := range methods {
+		err = p.addPortMapping(method, igdServer, &PortMappingInfo{
+			Method:       method,
+			Protocol:     protocol,
+			ExternalPort: externalPort,
+			InternalIP:   internalIP,
+			InternalPort: internalPort,
+		})
+		if err == nil || err == ErrLocalPortUsed {
+			return err
+		}
+		log.Infof("failed to map %s port %d with %s: %v", protocol, externalPort, method, err)
+		errs = append(errs, method+": "+err.Error())
 	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// LoadPortMappings adds the mappings saved in s, after rekeying those
+// saved with the IP of their IGD by its UUID, see Store.UpgradeIGDServers.
+// Each mapping is added again with the method it was saved with, mappings
+// which fail are logged and skipped.
+func (p *Daemon) LoadPortMappings(s *Store) error {
+	err := s.UpgradeIGDServers()
+	if err != nil {
+		return err
+	}
+
+	list, err := s.GetAllPortMapping()
+	if err != nil {
+		return err
+	}
+	for _, pm := range list {
+		err = p.addPortMapping(pm.GetMethod(), pm.IGDServer, pm)
+		if err != nil {
+			log.Warnf("failed to restore %s port mapping %d of %s: %v",
+				pm.GetProtocol(), pm.ExternalPort, pm.IGDServer, err)
+		}
+	}
+	return nil
+}
+
+func (p *Daemon) addPortMapping(method string, igdServer string, info *PortMappingInfo) error {
+	if method == MethodUPnP {
+		igd, err := GetIGD(igdServer, info.InternalIP)
+		if err != nil {
+			return err
+		}
+		info.IGDServer = igd.UUID
+	} else {
+		gateway, err := gatewayIP(igdServer)
+		if err != nil {
+			return err
+		}
+		info.IGDServer = gateway.String()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	id := genId(info.IGDServer, info.ExternalPort)
+	id := genId(info.IGDServer, info.GetProtocol(), info.ExternalPort)
 	_, found := p.mappings[id]
 	if found {
 		return ErrLocalPortUsed
 	}
 
-	m := newPortMapping(info)
+	m := newPortMapping(info, p.portMapper)
 	err := m.start()
 	if err != nil {
 		return err
 	}
 
 	p.mappings[id] = m
-	return err
+	return nil
+}
+
+// portMapper returns the PortMapper of the gateway of info.
+func (p *Daemon) portMapper(info *PortMappingInfo) (PortMapper, error) {
+	if info.GetMethod() == MethodUPnP {
+		s, _, err := finder.connectedService(info.IGDServer, info.InternalIP)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	p.clientsMu.Lock()
+	defer p.clientsMu.Unlock()
+
+	key := info.Method + "/" + info.IGDServer
+	c, found := p.clients[key]
+	if found {
+		return c, nil
+	}
+
+	method, gateway := info.Method, info.IGDServer
+	onReboot := func() { p.refresh(method, gateway) }
+	if method == MethodPCP {
+		pc := NewPCPClient(net.ParseIP(gateway))
+		pc.OnReboot = onReboot
+		c = pc
+	} else {
+		nc := NewNATPMPClient(net.ParseIP(gateway))
+		nc.OnReboot = onReboot
+		c = nc
+	}
+	p.clients[key] = c
+	return c, nil
 }
 
-func (p *Daemon) DeletePortMapping(igdServer string, externalPort int) error {
+// refresh adds the mappings on the gateway again at once, after it lost
+// them.
+func (p *Daemon) refresh(method string, gateway string) {
+	log.Infof("%s gateway %s lost its port mappings", method, gateway)
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	id := genId(igdServer, externalPort)
-	m, found := p.mappings[id]
-	if !found {
+	for _, m := range p.mappings {
+		if m.info.GetMethod() == method && m.info.IGDServer == gateway {
+			m.refresh()
+		}
+	}
+}
+
+// DeletePortMapping deletes a mapping added by AddPortMapping, igdServer is
+// the UUID of the IGD, the IP of the gateway, or anything GetIGD accepts.
+func (p *Daemon) DeletePortMapping(igdServer string, protocol string, externalPort int) error {
+	protocol, err := ParseProtocol(protocol)
+	if err != nil {
+		return err
+	}
+
+	m, id := p.findPortMapping(igdServer, protocol, externalPort)
+	if m == nil {
+		gateway, err := gatewayIP(igdServer)
+		if err == nil {
+			m, id = p.findPortMapping(gateway.String(), protocol, externalPort)
+		}
+	}
+	if m == nil {
+		igd, err := GetIGD(igdServer, "")
+		if err != nil {
+			return ErrPortMappingNotFound
+		}
+		m, id = p.findPortMapping(igd.UUID, protocol, externalPort)
+		if m == nil {
+			return ErrPortMappingNotFound
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.mappings[id] != m {
 		return ErrPortMappingNotFound
 	}
 
@@ -65,6 +233,14 @@ func (p *Daemon) DeletePortMapping(igdServer string, externalPort int) error {
 	return nil
 }
 
+func (p *Daemon) findPortMapping(igdServer string, protocol string, externalPort int) (*portMapping, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	id := genId(strings.TrimPrefix(igdServer, "uuid:"), protocol, externalPort)
+	return p.mappings[id], id
+}
+
 func (p *Daemon) ListPortMapping() []*PortMappingInfo {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -0,0 +1,303 @@
+package upnp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var ErrIGDNotFound = errors.New("InternetGatewayDevice not found")
+
+const (
+	// how long a discovered IGD is used before searching again, unless it
+	// announced a max-age
+	defaultIGDMaxAge = 30 * time.Minute
+	igdSearchTimeout = 3 * time.Second
+	// least time between searches for an IGD on a closer subnet than the
+	// cached ones
+	igdSearchInterval = time.Minute
+)
+
+// description URL of an IGD given by IP which doesn't answer SSDP, where
+// IGDs were looked up before discovery, changed by tests
+var igdFallbackLocation = "http://%s:1900/igd.xml"
+
+var igdDeviceTypes = []string{urnInternetGatewayDevice1, urnInternetGatewayDevice2}
+
+type cachedIGD struct {
+	igd     *IGD
+	expires time.Time
+}
+
+// igdFinder discovers IGDs with SSDP and caches them by UUID.
+type igdFinder struct {
+	search         func(timeout time.Duration) []*SSDPNotify
+	searchInterval time.Duration
+
+	mu       sync.Mutex
+	igds     map[string]*cachedIGD
+	searched time.Time
+}
+
+var finder = newIGDFinder(searchAllInterfaces)
+
+func newIGDFinder(search func(timeout time.Duration) []*SSDPNotify) *igdFinder {
+	return &igdFinder{
+		search:         search,
+		searchInterval: igdSearchInterval,
+		igds:           make(map[string]*cachedIGD),
+	}
+}
+
+// GetIGD returns the IGD identified by igd, which is the URL of its device
+// description, its UUID, the IP of its description URL, or empty for any
+// IGD. IGDs are discovered with SSDP and cached by UUID, an IP that SSDP
+// doesn't find is looked up at http://ip:1900/igd.xml. Of several IGDs the
+// one on the same subnet as internalIP, which may be empty, is preferred,
+// and searched for again if none of the cached ones is.
+func GetIGD(igd string, internalIP string) (*IGD, error) {
+	return finder.find(igd, internalIP)
+}
+
+// DiscoverIGDs searches IGDs on all interfaces.
+func DiscoverIGDs() []*IGD {
+	return finder.discover()
+}
+
+// searchAllInterfaces searches IGDs on the interfaces that are up and
+// support multicast.
+func searchAllInterfaces(timeout time.Duration) []*SSDPNotify {
+	intfs, err := net.Interfaces()
+	if err != nil {
+		log.Warnf("failed to list interfaces: %v", err)
+		return nil
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var result []*SSDPNotify
+	for i := range intfs {
+		intf := &intfs[i]
+		if intf.Flags&net.FlagUp == 0 || intf.Flags&net.FlagMulticast == 0 ||
+			intf.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		for _, deviceType := range igdDeviceTypes {
+			notifies, err := SSDPSearch(intf, deviceType, SSDPMulticastAddr, timeout)
+			if err != nil {
+				log.Debugf("failed to SSDP search on %s: %v", intf.Name, err)
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for n := range notifies {
+					mu.Lock()
+					result = append(result, n)
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	return result
+}
+
+// discover searches IGDs and caches those found.
+func (f *igdFinder) discover() []*IGD {
+	f.mu.Lock()
+	f.searched = time.Now()
+	f.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var result []*IGD
+	for _, n := range f.search(igdSearchTimeout) {
+		if seen[n.DeviceUUID] {
+			continue
+		}
+		seen[n.DeviceUUID] = true
+
+		igd, err := f.fetch(n.DeviceDescriptionLocation, time.Duration(n.MaxAge)*time.Second)
+		if err != nil {
+			log.Infof("failed to get igd %s: %v", n.DeviceDescriptionLocation, err)
+			continue
+		}
+		result = append(result, igd)
+	}
+	return result
+}
+
+// fetch reads the device description at location and caches the IGD for
+// maxAge, defaultIGDMaxAge if zero.
+func (f *igdFinder) fetch(location string, maxAge time.Duration) (*IGD, error) {
+	root, err := GetUPnPData(location)
+	if err != nil {
+		return nil, err
+	}
+	igd, err := GetIGDDevice(root, location)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxAge <= 0 {
+		maxAge = defaultIGDMaxAge
+	}
+	f.mu.Lock()
+	f.igds[igd.UUID] = &cachedIGD{igd: igd, expires: time.Now().Add(maxAge)}
+	f.mu.Unlock()
+	return igd, nil
+}
+
+// cached returns the cached IGDs which haven't expired, sorted by UUID.
+func (f *igdFinder) cached() []*IGD {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	var result []*IGD
+	for uuid, c := range f.igds {
+		if now.After(c.expires) {
+			delete(f.igds, uuid)
+			continue
+		}
+		result = append(result, c.igd)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UUID < result[j].UUID
+	})
+	return result
+}
+
+func (f *igdFinder) find(igd string, internalIP string) (*IGD, error) {
+	if strings.HasPrefix(igd, "http://") || strings.HasPrefix(igd, "https://") {
+		return f.fetch(igd, 0)
+	}
+
+	match := func(d *IGD) bool { return true }
+	ip := net.ParseIP(igd)
+	if ip != nil {
+		match = func(d *IGD) bool { return ip.Equal(d.host()) }
+	} else if igd != "" {
+		uuid := strings.TrimPrefix(igd, "uuid:")
+		match = func(d *IGD) bool { return d.UUID == uuid }
+	}
+
+	local := net.ParseIP(internalIP)
+	candidates := filterIGDs(f.cached(), match)
+	if len(candidates) == 0 || (local != nil && !anyOnSubnet(candidates, local) && f.maySearch()) {
+		f.discover()
+		candidates = filterIGDs(f.cached(), match)
+	}
+	if len(candidates) == 0 && ip != nil {
+		return f.fetch(fmt.Sprintf(igdFallbackLocation, ip), 0)
+	}
+	if len(candidates) == 0 {
+		return nil, ErrIGDNotFound
+	}
+	return preferredIGD(candidates, local), nil
+}
+
+// maySearch reports whether the last search is older than searchInterval.
+func (f *igdFinder) maySearch() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Since(f.searched) >= f.searchInterval
+}
+
+// forget drops the IGD from the cache.
+func (f *igdFinder) forget(uuid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.igds, uuid)
+}
+
+// connectedService returns the connected service of the IGD found by find.
+// If a cached IGD doesn't answer it is searched again, it may have
+// rebooted at another location.
+func (f *igdFinder) connectedService(igd string, internalIP string) (*IGDService, net.IP, error) {
+	d, err := f.find(igd, internalIP)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, ip, err := d.ConnectedService()
+	if _, ok := err.(*UPnPError); err == nil || ok || err == ErrNoConnectedService {
+		return s, ip, err
+	}
+
+	log.Infof("igd %s at %s: %v, search it again", d.UUID, d.DescriptionURL, err)
+	f.forget(d.UUID)
+	d, err = f.find(igd, internalIP)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.ConnectedService()
+}
+
+func anyOnSubnet(igds []*IGD, internalIP net.IP) bool {
+	for _, d := range igds {
+		if sameSubnet(internalIP, d.host()) {
+			return true
+		}
+	}
+	return false
+}
+
+func filterIGDs(igds []*IGD, match func(d *IGD) bool) []*IGD {
+	var result []*IGD
+	for _, d := range igds {
+		if match(d) {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+// preferredIGD returns the first IGD on the same subnet as internalIP, or
+// the first IGD.
+func preferredIGD(igds []*IGD, internalIP net.IP) *IGD {
+	if internalIP != nil {
+		for _, d := range igds {
+			if sameSubnet(internalIP, d.host()) {
+				return d
+			}
+		}
+	}
+	return igds[0]
+}
+
+// host returns the IP of the description URL, nil for a hostname.
+func (d *IGD) host() net.IP {
+	u, err := url.Parse(d.DescriptionURL)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(u.Hostname())
+}
+
+// sameSubnet reports whether a and b are on the network of a local
+// interface.
+func sameSubnet(a, b net.IP) bool {
+	if b == nil {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if ok && n.Contains(a) && n.Contains(b) {
+			return true
+		}
+	}
+	return false
+}
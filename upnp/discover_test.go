@@ -0,0 +1,207 @@
+package upnp
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	igdv1UUID = "11111111-1111-1111-1111-111111111111"
+	igdv2UUID = "22222222-2222-2222-2222-222222222222"
+)
+
+func TestParseSSDPNotify(t *testing.T) {
+	data := "HTTP/1.1 200 OK\r\n" +
+		"CACHE-CONTROL: max-age=1800\r\n" +
+		"LOCATION: http://192.168.1.1:5000/rootDesc.xml\r\n" +
+		"ST: " + urnInternetGatewayDevice1 + "\r\n" +
+		"USN: uuid:" + igdv1UUID + "::" + urnInternetGatewayDevice1 + "\r\n" +
+		"\r\n"
+	n, err := ParseSSDPNotify(urnInternetGatewayDevice1, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.DeviceUUID != igdv1UUID || n.MaxAge != 1800 ||
+		n.DeviceDescriptionLocation != "http://192.168.1.1:5000/rootDesc.xml" {
+		t.Errorf("notify: %+v", n)
+	}
+
+	for _, s := range []string{"no-cache", "max-age=x", "public, MAX-AGE = 60"} {
+		want := 0
+		if strings.Contains(s, "60") {
+			want = 60
+		}
+		if got := parseMaxAge(s); got != want {
+			t.Errorf("parseMaxAge(%q) = %d", s, got)
+		}
+	}
+}
+
+func TestIGDFinder(t *testing.T) {
+	igd1 := startFakeIGD(igdv1Description)
+	defer igd1.Close()
+	igd2 := startFakeIGD(igdv2Description)
+	defer igd2.Close()
+
+	// the description URL of igd1 has a hostname, so only igd2 is on a
+	// known subnet
+	location1 := strings.Replace(igd1.URL, "127.0.0.1", "localhost", 1) + "/desc.xml"
+	location2 := igd2.URL + "/desc.xml"
+	var searches int32
+	f := newIGDFinder(func(timeout time.Duration) []*SSDPNotify {
+		atomic.AddInt32(&searches, 1)
+		return []*SSDPNotify{
+			{DeviceUUID: igdv1UUID, DeviceDescriptionLocation: location1},
+			{DeviceUUID: igdv1UUID, DeviceDescriptionLocation: location1},
+			{DeviceUUID: igdv2UUID, DeviceDescriptionLocation: location2, MaxAge: 1},
+		}
+	})
+
+	for _, test := range []struct {
+		igd        string
+		internalIP string
+		want       string
+	}{
+		{"uuid:" + igdv2UUID, "", igdv2UUID},
+		{igdv1UUID, "", igdv1UUID},
+		{"", "", igdv1UUID},
+		{"", "127.0.0.2", igdv2UUID},
+		{"127.0.0.1", "", igdv2UUID},
+	} {
+		d, err := f.find(test.igd, test.internalIP)
+		if err != nil {
+			t.Errorf("find(%q, %q): %v", test.igd, test.internalIP, err)
+			continue
+		}
+		if d.UUID != test.want {
+			t.Errorf("find(%q, %q) = %s, want %s", test.igd, test.internalIP, d.UUID, test.want)
+		}
+	}
+	if n := atomic.LoadInt32(&searches); n != 1 {
+		t.Errorf("searched %d times, want once", n)
+	}
+
+	_, err := f.find("33333333-3333-3333-3333-333333333333", "")
+	if err != ErrIGDNotFound {
+		t.Errorf("unknown uuid: %v", err)
+	}
+	if n := atomic.LoadInt32(&searches); n != 2 {
+		t.Errorf("searched %d times, want twice", n)
+	}
+
+	// igd2 expires after its max-age
+	time.Sleep(1100 * time.Millisecond)
+	if n := len(f.cached()); n != 1 {
+		t.Errorf("%d cached IGDs after max-age", n)
+	}
+	if _, err := f.find(igdv2UUID, ""); err != nil {
+		t.Errorf("expired igd: %v", err)
+	}
+	if n := atomic.LoadInt32(&searches); n != 3 {
+		t.Errorf("expired igd not searched again")
+	}
+}
+
+func TestIGDFinderURL(t *testing.T) {
+	igd := startFakeIGD(igdv2Description)
+	defer igd.Close()
+
+	f := newIGDFinder(func(timeout time.Duration) []*SSDPNotify {
+		t.Error("searched for a description URL")
+		return nil
+	})
+	d, err := f.find(igd.URL+"/desc.xml", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.UUID != igdv2UUID {
+		t.Errorf("uuid: %s", d.UUID)
+	}
+	if _, err := f.find(igdv2UUID, ""); err != nil {
+		t.Errorf("fetched igd not cached: %v", err)
+	}
+}
+
+func TestIGDFinderRediscover(t *testing.T) {
+	igd1 := startFakeIGD(igdv1Description)
+	defer igd1.Close()
+	igd2 := startFakeIGD(igdv2Description)
+	defer igd2.Close()
+
+	location1 := strings.Replace(igd1.URL, "127.0.0.1", "localhost", 1) + "/desc.xml"
+	var searches int32
+	f := newIGDFinder(func(timeout time.Duration) []*SSDPNotify {
+		notifies := []*SSDPNotify{{DeviceUUID: igdv1UUID, DeviceDescriptionLocation: location1}}
+		// igd2 only answers from the second search on
+		if atomic.AddInt32(&searches, 1) > 1 {
+			notifies = append(notifies, &SSDPNotify{DeviceUUID: igdv2UUID,
+				DeviceDescriptionLocation: igd2.URL + "/desc.xml"})
+		}
+		return notifies
+	})
+
+	for i, want := range []string{igdv1UUID, igdv1UUID, igdv2UUID} {
+		// none of the cached IGDs is on the subnet, search again once the
+		// interval passed
+		if i == 2 {
+			f.searchInterval = 0
+		}
+		d, err := f.find("", "127.0.0.2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.UUID != want {
+			t.Errorf("%d: found %s, want %s", i, d.UUID, want)
+		}
+	}
+	if n := atomic.LoadInt32(&searches); n != 2 {
+		t.Errorf("searched %d times, want twice", n)
+	}
+}
+
+func TestIGDFinderFallback(t *testing.T) {
+	igd := startFakeIGD(igdv2Description)
+	defer igd.Close()
+
+	defer func(location string) { igdFallbackLocation = location }(igdFallbackLocation)
+	igdFallbackLocation = "http://%s:" + igd.URL[strings.LastIndex(igd.URL, ":")+1:] + "/desc.xml"
+
+	f := newIGDFinder(func(timeout time.Duration) []*SSDPNotify { return nil })
+	d, err := f.find("127.0.0.1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.UUID != igdv2UUID {
+		t.Errorf("uuid: %s", d.UUID)
+	}
+}
+
+func TestIGDFinderMovedIGD(t *testing.T) {
+	old := startFakeIGD(igdv2Description)
+	moved := startFakeIGD(igdv2Description)
+	defer moved.Close()
+
+	f := newIGDFinder(func(timeout time.Duration) []*SSDPNotify {
+		return []*SSDPNotify{{DeviceUUID: igdv2UUID, DeviceDescriptionLocation: moved.URL + "/desc.xml"}}
+	})
+	_, err := f.find(old.URL+"/desc.xml", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the IGD rebooted at another location
+	old.Close()
+
+	_, ip, err := f.connectedService(igdv2UUID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip == nil {
+		t.Error("no external ip")
+	}
+	d, err := f.find(igdv2UUID, "")
+	if err != nil || !strings.HasPrefix(d.DescriptionURL, moved.URL) {
+		t.Errorf("cached igd: %v %v", d, err)
+	}
+}
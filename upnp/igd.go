@@ -8,7 +8,6 @@ import (
 	"net/url"
 	"strings"
 	"time"
-	log "github.com/Sirupsen/logrus"
 )
 
 type IGDService struct {
@@ -27,16 +26,17 @@ type IGD struct {
 
 var (
 	urnInternetGatewayDevice1 = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
-	urnWANDevice1             = "urn:schemas-upnp-org:device:WANDevice:1"
-	urnWanConnectionDevice1   = "urn:schemas-upnp-org:device:WANConnectionDevice:1"
 	urnWANIPConnection1       = "urn:schemas-upnp-org:service:WANIPConnection:1"
 	urnWANPPPConnection1      = "urn:schemas-upnp-org:service:WANPPPConnection:1"
 
+	// IGDv2 has no WANPPPConnection:2
 	urnInternetGatewayDevice2 = "urn:schemas-upnp-org:device:InternetGatewayDevice:2"
-	urnWANDevice2             = "urn:schemas-upnp-org:device:WANDevice:2"
-	urnWanConnectionDevice2   = "urn:schemas-upnp-org:device:WANConnectionDevice:2"
 	urnWANIPConnection2       = "urn:schemas-upnp-org:service:WANIPConnection:2"
-	urnWANPPPConnection2      = "urn:schemas-upnp-org:service:WANPPPConnection:2"
+)
+
+var (
+	ErrIGDv2Required      = errors.New("action requires a WANIPConnection:2 service")
+	ErrNoConnectedService = errors.New("no WAN connection service of the IGD has an external IP")
 )
 
 func GetIGDDevice(root *UPnPRoot, rootURL string) (*IGD, error) {
@@ -55,7 +55,7 @@ func GetIGDDevice(root *UPnPRoot, rootURL string) (*IGD, error) {
 	}
 
 	return &IGD{
-		UUID:           root.Device.UDN,
+		UUID:           strings.TrimPrefix(root.Device.UDN, "uuid:"),
 		FriendlyName:   root.Device.FriendlyName,
 		Services:       services,
 		internalIP:     internalIP,
@@ -63,59 +63,70 @@ func GetIGDDevice(root *UPnPRoot, rootURL string) (*IGD, error) {
 	}, nil
 }
 
-func GetIGDServices(device *UPnpDevice, rootURL string) ([]IGDService, error) {
-	var result []IGDService
+// ConnectedService returns the first service which answers
+// GetExternalIPAddress with an IP, and that IP. An IGD may list inactive
+// WAN or PPP connections before the one in use.
+func (igd *IGD) ConnectedService() (*IGDService, net.IP, error) {
+	err := ErrNoConnectedService
+	for i := range igd.Services {
+		s := &igd.Services[i]
+		ip, e := s.GetExternalIPAddress()
+		if e != nil {
+			err = e
+			continue
+		}
+		if ip == nil || ip.IsUnspecified() {
+			continue
+		}
+		return s, ip, nil
+	}
+	return nil, nil, err
+}
 
-	if device.DeviceType == urnInternetGatewayDevice1 {
-		descriptions := getServices(device, rootURL,
-			urnWANDevice1, urnWanConnectionDevice1,
-			[]string{urnWANIPConnection1, urnWANPPPConnection1})
-
-		result = append(result, descriptions...)
-	} else if device.DeviceType == urnInternetGatewayDevice1 {
-		descriptions := getServices(device, rootURL,
-			urnWANDevice2, urnWanConnectionDevice2,
-			[]string{urnWANIPConnection2, urnWANPPPConnection2})
-		result = append(result, descriptions...)
-	} else {
-		return result, errors.New("not an InternetGatewayDevice")
+// GetIGDServices returns the WAN connection services found anywhere in the
+// device tree of an InternetGatewayDevice of version 1 or 2, WANIPConnection:2
+// services first.
+func GetIGDServices(device *UPnpDevice, rootURL string) ([]IGDService, error) {
+	var urns []string
+	switch device.DeviceType {
+	case urnInternetGatewayDevice1:
+		urns = []string{urnWANIPConnection1, urnWANPPPConnection1}
+	case urnInternetGatewayDevice2:
+		// an IGDv2 may still have v1 connection services
+		urns = []string{urnWANIPConnection2, urnWANIPConnection1, urnWANPPPConnection1}
+	default:
+		return nil, errors.New("not an InternetGatewayDevice")
 	}
 
+	var result []IGDService
+	for _, urn := range urns {
+		result = findServices(device, rootURL, urn, result)
+	}
 	if len(result) < 1 {
-		return result, errors.New("no compatible service descriptions found.")
+		return result, errors.New("no compatible service descriptions found")
 	}
 	return result, nil
 }
 
-func getServices(device *UPnpDevice, rootURL string, wanDeviceURN string, wanConnectionURN string, URNs []string) []IGDService {
-	var result []IGDService
-	log.Infof("-----------------")
-
-	devices := device.GetChildDevices(wanDeviceURN)
-	if len(devices) < 1 {
-		return result
-	}
-
-	for _, device := range devices {
-		connections := device.GetChildDevices(wanConnectionURN)
-		for _, connection := range connections {
-			for _, URN := range URNs {
-				services := connection.GetChildServices(URN)
-				for _, service := range services {
-					if len(service.ControlURL) == 0 {
-						continue
-					}
-					u, _ := url.Parse(rootURL)
-					replaceRawPath(u, service.ControlURL)
-					service := IGDService{ID: service.ID,
-						URL: u.String(),
-						URN: service.Type}
-					result = append(result, service)
-				}
-			}
+// findServices appends the services of type urn of device and all its
+// descendants to result.
+func findServices(device *UPnpDevice, rootURL string, urn string, result []IGDService) []IGDService {
+	for _, service := range device.GetChildServices(urn) {
+		if len(service.ControlURL) == 0 {
+			continue
 		}
+		u, _ := url.Parse(rootURL)
+		replaceRawPath(u, service.ControlURL)
+		result = append(result, IGDService{
+			ID:  service.ID,
+			URL: u.String(),
+			URN: service.Type,
+		})
 	}
 
+	for i := range device.Devices {
+		result = findServices(&device.Devices[i], rootURL, urn, result)
+	}
 	return result
 }
 
@@ -213,3 +224,195 @@ func (s *IGDService) GetExternalIPAddress() (net.IP, error) {
 
 	return result, nil
 }
+
+// IsV2 reports whether the service is a WANIPConnection:2, which supports
+// the IGDv2 only actions.
+func (s *IGDService) IsV2() bool {
+	return s.URN == urnWANIPConnection2
+}
+
+// AddAnyPortMapping is like AddPortMapping, but the IGD may pick another
+// external port if externalPort is taken. It returns the external port
+// reserved. IGDv2 only.
+func (s *IGDService) AddAnyPortMapping(
+	protocol string, externalPort int,
+	internalIP string, internalPort int, duration time.Duration,
+	description string) (int, error) {
+	if !s.IsV2() {
+		return 0, ErrIGDv2Required
+	}
+
+	tpl := `<u:AddAnyPortMapping xmlns:u="%s">
+	<NewRemoteHost></NewRemoteHost>
+	<NewExternalPort>%d</NewExternalPort>
+	<NewProtocol>%s</NewProtocol>
+	<NewInternalPort>%d</NewInternalPort>
+	<NewInternalClient>%s</NewInternalClient>
+	<NewEnabled>1</NewEnabled>
+	<NewPortMappingDescription>%s</NewPortMappingDescription>
+	<NewLeaseDuration>%d</NewLeaseDuration>
+	</u:AddAnyPortMapping>`
+	body := fmt.Sprintf(tpl, s.URN, externalPort, protocol, internalPort, internalIP, description, duration/time.Second)
+
+	response, err := soapRequest(s.URL, s.URN, "AddAnyPortMapping", body)
+	if err != nil {
+		return 0, err
+	}
+
+	envelope := &soapAddAnyPortMappingResponse{}
+	err = xml.Unmarshal(response, envelope)
+	if err != nil {
+		return 0, err
+	}
+	return envelope.NewReservedPort, nil
+}
+
+// DeletePortMappingRange deletes the port mappings of protocol with
+// external ports from startPort to endPort. Unless manage is set the IGD
+// only deletes those added by this host. IGDv2 only.
+func (s *IGDService) DeletePortMappingRange(protocol string, startPort, endPort int, manage bool) error {
+	if !s.IsV2() {
+		return ErrIGDv2Required
+	}
+
+	tpl := `<u:DeletePortMappingRange xmlns:u="%s">
+	<NewStartPort>%d</NewStartPort>
+	<NewEndPort>%d</NewEndPort>
+	<NewProtocol>%s</NewProtocol>
+	<NewManage>%d</NewManage>
+	</u:DeletePortMappingRange>`
+	m := 0
+	if manage {
+		m = 1
+	}
+	body := fmt.Sprintf(tpl, s.URN, startPort, endPort, protocol, m)
+
+	_, err := soapRequest(s.URL, s.URN, "DeletePortMappingRange", body)
+	return err
+}
+
+// maxPortMappingEntries bounds ListPortMappings for IGDs that never report
+// the end of the array
+const maxPortMappingEntries = 4096
+
+// PortMappingEntry is a port mapping of the IGD. LeaseDuration is the
+// lease remaining, zero for a permanent mapping.
+type PortMappingEntry struct {
+	RemoteHost     string        `json:"remoteHost,omitempty"`
+	Protocol       string        `json:"protocol"`
+	ExternalPort   int           `json:"externalPort"`
+	InternalClient string        `json:"internalClient"`
+	InternalPort   int           `json:"internalPort"`
+	Enabled        bool          `json:"enabled"`
+	Description    string        `json:"description"`
+	LeaseDuration  time.Duration `json:"leaseDuration"`
+}
+
+func newPortMappingEntry(e *portMappingEntry) *PortMappingEntry {
+	return &PortMappingEntry{
+		RemoteHost:     e.RemoteHost,
+		Protocol:       e.Protocol,
+		ExternalPort:   e.ExternalPort,
+		InternalClient: e.InternalClient,
+		InternalPort:   e.InternalPort,
+		Enabled:        e.Enabled == "1" || strings.EqualFold(e.Enabled, "true"),
+		Description:    e.Description,
+		LeaseDuration:  time.Duration(e.LeaseDuration) * time.Second,
+	}
+}
+
+// GetGenericPortMappingEntry returns the port mapping at index of the
+// IGD's array, ErrPortMappingNotFound past its end.
+func (s *IGDService) GetGenericPortMappingEntry(index int) (*PortMappingEntry, error) {
+	tpl := `<u:GetGenericPortMappingEntry xmlns:u="%s">
+	<NewPortMappingIndex>%d</NewPortMappingIndex>
+	</u:GetGenericPortMappingEntry>`
+	body := fmt.Sprintf(tpl, s.URN, index)
+
+	response, err := soapRequest(s.URL, s.URN, "GetGenericPortMappingEntry", body)
+	if isUPnPError(err, errCodeSpecifiedArrayIndexInvalid, errCodeNoSuchEntryInArray) {
+		return nil, ErrPortMappingNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	envelope := &soapPortMappingEntryResponse{}
+	err = xml.Unmarshal(response, envelope)
+	if err != nil {
+		return nil, err
+	}
+	return newPortMappingEntry(&envelope.Body.Entry), nil
+}
+
+// GetSpecificPortMappingEntry returns the port mapping of externalPort and
+// protocol, or ErrPortMappingNotFound.
+func (s *IGDService) GetSpecificPortMappingEntry(protocol string, externalPort int) (*PortMappingEntry, error) {
+	tpl := `<u:GetSpecificPortMappingEntry xmlns:u="%s">
+	<NewRemoteHost></NewRemoteHost>
+	<NewExternalPort>%d</NewExternalPort>
+	<NewProtocol>%s</NewProtocol>
+	</u:GetSpecificPortMappingEntry>`
+	body := fmt.Sprintf(tpl, s.URN, externalPort, protocol)
+
+	response, err := soapRequest(s.URL, s.URN, "GetSpecificPortMappingEntry", body)
+	if isUPnPError(err, errCodeNoSuchEntryInArray) {
+		return nil, ErrPortMappingNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	envelope := &soapPortMappingEntryResponse{}
+	err = xml.Unmarshal(response, envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the mapping is returned, not its key
+	e := &envelope.Body.Entry
+	e.ExternalPort = externalPort
+	e.Protocol = protocol
+	return newPortMappingEntry(e), nil
+}
+
+// ListPortMappings returns all port mappings of the IGD.
+func (s *IGDService) ListPortMappings() ([]*PortMappingEntry, error) {
+	var result []*PortMappingEntry
+	for i := 0; i < maxPortMappingEntries; i++ {
+		e, err := s.GetGenericPortMappingEntry(i)
+		if err == ErrPortMappingNotFound {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// PortMappingConflictError is returned when an external port is already
+// mapped to another address.
+type PortMappingConflictError struct {
+	Entry *PortMappingEntry
+}
+
+func (e *PortMappingConflictError) Error() string {
+	return fmt.Sprintf("%s port %d already mapped to %s:%d (%s)", e.Entry.Protocol,
+		e.Entry.ExternalPort, e.Entry.InternalClient, e.Entry.InternalPort, e.Entry.Description)
+}
+
+// CheckPortMapping returns a *PortMappingConflictError if externalPort is
+// mapped to another address than internalIP:internalPort.
+func (s *IGDService) CheckPortMapping(protocol string, externalPort int,
+	internalIP string, internalPort int) error {
+	e, err := s.GetSpecificPortMappingEntry(protocol, externalPort)
+	if err == ErrPortMappingNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if e.InternalClient != internalIP || e.InternalPort != internalPort {
+		return &PortMappingConflictError{Entry: e}
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+package upnp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// igdv1Description has the usual WANDevice/WANConnectionDevice layout.
+const igdv1Description = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+  <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+  <friendlyName>fake igd v1</friendlyName>
+  <UDN>uuid:11111111-1111-1111-1111-111111111111</UDN>
+  <deviceList><device>
+    <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+    <deviceList><device>
+      <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+      <serviceList><service>
+        <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+        <serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+        <controlURL>/ctl/ip1</controlURL>
+      </service></serviceList>
+    </device></deviceList>
+  </device></deviceList>
+</device>
+</root>`
+
+// igdv2Description nests the connection service one level deeper and
+// also has a v1 service.
+const igdv2Description = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+  <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:2</deviceType>
+  <friendlyName>fake igd v2</friendlyName>
+  <UDN>uuid:22222222-2222-2222-2222-222222222222</UDN>
+  <deviceList><device>
+    <deviceType>urn:schemas-upnp-org:device:WANDevice:2</deviceType>
+    <deviceList><device>
+      <deviceType>urn:example-com:device:Bridge:1</deviceType>
+      <deviceList><device>
+        <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:2</deviceType>
+        <serviceList>
+          <service>
+            <serviceType>urn:schemas-upnp-org:service:WANPPPConnection:1</serviceType>
+            <serviceId>urn:upnp-org:serviceId:WANPPPConn1</serviceId>
+            <controlURL>/ctl/ppp1</controlURL>
+          </service>
+          <service>
+            <serviceType>urn:schemas-upnp-org:service:WANIPConnection:2</serviceType>
+            <serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+            <controlURL>/ctl/ip2</controlURL>
+          </service>
+        </serviceList>
+      </device></deviceList>
+    </device></deviceList>
+  </device></deviceList>
+</device>
+</root>`
+
+const soapResponseTpl = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body>%s</s:Body>
+</s:Envelope>`
+
+// fakeIGD serves a device description and answers SOAP actions.
+type fakeIGD struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests map[string]string
+	// control path of the last request of an action
+	paths   map[string]string
+	entries []*PortMappingEntry
+	// control paths of inactive connections, which fail every action
+	down map[string]bool
+}
+
+var soapArgRe = regexp.MustCompile(`<(New[A-Za-z]+)>([^<]*)</`)
+
+func soapArgs(body []byte) map[string]string {
+	args := make(map[string]string)
+	for _, m := range soapArgRe.FindAllStringSubmatch(string(body), -1) {
+		args[m[1]] = m[2]
+	}
+	return args
+}
+
+func writeSOAPFault(w http.ResponseWriter, code int, description string) {
+	w.WriteHeader(500)
+	fmt.Fprintf(w, soapResponseTpl, fmt.Sprintf(`<s:Fault>
+<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+<errorCode>%d</errorCode><errorDescription>%s</errorDescription>
+</UPnPError></detail></s:Fault>`, code, description))
+}
+
+func entryResponse(action string, e *PortMappingEntry) string {
+	enabled := 0
+	if e.Enabled {
+		enabled = 1
+	}
+	return fmt.Sprintf(`<u:%sResponse xmlns:u="x">
+<NewRemoteHost></NewRemoteHost><NewExternalPort>%d</NewExternalPort><NewProtocol>%s</NewProtocol>
+<NewInternalPort>%d</NewInternalPort><NewInternalClient>%s</NewInternalClient>
+<NewEnabled>%d</NewEnabled><NewPortMappingDescription>%s</NewPortMappingDescription>
+<NewLeaseDuration>%d</NewLeaseDuration>
+</u:%sResponse>`, action, e.ExternalPort, e.Protocol, e.InternalPort, e.InternalClient,
+		enabled, e.Description, e.LeaseDuration/time.Second, action)
+}
+
+// entry returns the response to a GetGenericPortMappingEntry or
+// GetSpecificPortMappingEntry request, or nil.
+func (igd *fakeIGD) entry(action string, args map[string]string) *PortMappingEntry {
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+
+	if action == "GetGenericPortMappingEntry" {
+		i, _ := strconv.Atoi(args["NewPortMappingIndex"])
+		if i < len(igd.entries) {
+			return igd.entries[i]
+		}
+		return nil
+	}
+	for _, e := range igd.entries {
+		if strconv.Itoa(e.ExternalPort) == args["NewExternalPort"] &&
+			e.Protocol == args["NewProtocol"] {
+			return e
+		}
+	}
+	return nil
+}
+
+func startFakeIGD(description string) *fakeIGD {
+	igd := &fakeIGD{
+		requests: make(map[string]string),
+		paths:    make(map[string]string),
+		down:     make(map[string]bool),
+	}
+	igd.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(description))
+			return
+		}
+
+		soapAction := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+		action := soapAction[strings.Index(soapAction, "#")+1:]
+		body, _ := ioutil.ReadAll(r.Body)
+		igd.mu.Lock()
+		igd.requests[action] = string(body)
+		igd.paths[action] = r.URL.Path
+		down := igd.down[r.URL.Path]
+		igd.mu.Unlock()
+
+		if down {
+			writeSOAPFault(w, 501, "ActionFailed")
+			return
+		}
+
+		var resp string
+		switch action {
+		case "GetGenericPortMappingEntry", "GetSpecificPortMappingEntry":
+			e := igd.entry(action, soapArgs(body))
+			if e == nil && action == "GetGenericPortMappingEntry" {
+				writeSOAPFault(w, 713, "SpecifiedArrayIndexInvalid")
+				return
+			} else if e == nil {
+				writeSOAPFault(w, 714, "NoSuchEntryInArray")
+				return
+			}
+			resp = entryResponse(action, e)
+		case "GetExternalIPAddress":
+			resp = `<u:GetExternalIPAddressResponse xmlns:u="x">
+<NewExternalIPAddress>203.0.113.1</NewExternalIPAddress>
+</u:GetExternalIPAddressResponse>`
+		case "AddAnyPortMapping":
+			resp = `<u:AddAnyPortMappingResponse xmlns:u="x">
+<NewReservedPort>40001</NewReservedPort>
+</u:AddAnyPortMappingResponse>`
+		default:
+			resp = fmt.Sprintf(`<u:%sResponse xmlns:u="x"/>`, action)
+		}
+		fmt.Fprintf(w, soapResponseTpl, resp)
+	}))
+	return igd
+}
+
+// request returns the body of the last request of action.
+func (igd *fakeIGD) request(action string) string {
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+	return igd.requests[action]
+}
+
+func (igd *fakeIGD) path(action string) string {
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+	return igd.paths[action]
+}
+
+func (igd *fakeIGD) setDown(path string) {
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+	igd.down[path] = true
+}
+
+func getFakeIGD(t *testing.T, igd *fakeIGD) *IGD {
+	url := igd.URL + "/desc.xml"
+	root, err := GetUPnPData(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := GetIGDDevice(root, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dev
+}
+
+func TestGetIGDDevice(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		urns        []string
+		urls        []string
+	}{
+		{igdv1Description, []string{urnWANIPConnection1}, []string{"/ctl/ip1"}},
+		{igdv2Description, []string{urnWANIPConnection2, urnWANPPPConnection1},
+			[]string{"/ctl/ip2", "/ctl/ppp1"}},
+	} {
+		igd := startFakeIGD(test.description)
+		dev := getFakeIGD(t, igd)
+		igd.Close()
+
+		if len(dev.Services) != len(test.urns) {
+			t.Errorf("%s: services %+v", dev.FriendlyName, dev.Services)
+			continue
+		}
+		for i, s := range dev.Services {
+			if s.URN != test.urns[i] || s.URL != igd.URL+test.urls[i] {
+				t.Errorf("%s: service %d %+v", dev.FriendlyName, i, s)
+			}
+		}
+	}
+
+	_, err := GetIGDServices(&UPnpDevice{DeviceType: "urn:schemas-upnp-org:device:MediaServer:1"}, "")
+	if err == nil {
+		t.Error("MediaServer accepted as IGD")
+	}
+}
+
+func TestIGDv2Actions(t *testing.T) {
+	igd := startFakeIGD(igdv2Description)
+	defer igd.Close()
+	s := getFakeIGD(t, igd).Services[0]
+
+	ip, err := s.GetExternalIPAddress()
+	if err != nil || ip.String() != "203.0.113.1" {
+		t.Errorf("external ip: %v %v", ip, err)
+	}
+
+	port, err := s.AddAnyPortMapping("TCP", 40000, "192.168.1.2", 8080, 0, "test")
+	if err != nil || port != 40001 {
+		t.Errorf("AddAnyPortMapping: %d %v", port, err)
+	}
+	req := igd.request("AddAnyPortMapping")
+	if !strings.Contains(req, "<NewExternalPort>40000</NewExternalPort>") ||
+		!strings.Contains(req, "<NewInternalClient>192.168.1.2</NewInternalClient>") {
+		t.Errorf("AddAnyPortMapping request: %s", req)
+	}
+
+	err = s.DeletePortMappingRange("UDP", 40000, 40010, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = igd.request("DeletePortMappingRange")
+	if !strings.Contains(req, "<NewStartPort>40000</NewStartPort>") ||
+		!strings.Contains(req, "<NewEndPort>40010</NewEndPort>") ||
+		!strings.Contains(req, "<NewManage>1</NewManage>") {
+		t.Errorf("DeletePortMappingRange request: %s", req)
+	}
+}
+
+func TestIGDv1RejectsV2Actions(t *testing.T) {
+	igd := startFakeIGD(igdv1Description)
+	defer igd.Close()
+	s := getFakeIGD(t, igd).Services[0]
+
+	_, err := s.AddAnyPortMapping("TCP", 40000, "192.168.1.2", 8080, 0, "")
+	if err != ErrIGDv2Required {
+		t.Errorf("AddAnyPortMapping: %v", err)
+	}
+	err = s.DeletePortMappingRange("TCP", 40000, 40010, false)
+	if err != ErrIGDv2Required {
+		t.Errorf("DeletePortMappingRange: %v", err)
+	}
+
+	err = s.AddPortMapping("TCP", 40000, "192.168.1.2", 8080, 0, "")
+	if err != nil || igd.request("AddPortMapping") == "" {
+		t.Errorf("AddPortMapping: %v", err)
+	}
+}
+
+func TestListPortMappings(t *testing.T) {
+	igd := startFakeIGD(igdv1Description)
+	defer igd.Close()
+	s := getFakeIGD(t, igd).Services[0]
+
+	entries, err := s.ListPortMappings()
+	if err != nil || len(entries) != 0 {
+		t.Errorf("empty list: %v %v", entries, err)
+	}
+
+	igd.entries = []*PortMappingEntry{
+		{Protocol: "TCP", ExternalPort: 8080, InternalClient: "192.168.1.2",
+			InternalPort: 80, Enabled: true, Description: "web"},
+		{Protocol: "UDP", ExternalPort: 5060, InternalClient: "192.168.1.3",
+			InternalPort: 5060, Description: "sip", LeaseDuration: time.Hour},
+	}
+	entries, err = s.ListPortMappings()
+	if err != nil || !reflect.DeepEqual(entries, igd.entries) {
+		t.Errorf("list: %v %v", entries, err)
+	}
+
+	e, err := s.GetSpecificPortMappingEntry("UDP", 5060)
+	if err != nil || !reflect.DeepEqual(e, igd.entries[1]) {
+		t.Errorf("specific entry: %+v %v", e, err)
+	}
+	_, err = s.GetSpecificPortMappingEntry("TCP", 5060)
+	if err != ErrPortMappingNotFound {
+		t.Errorf("missing entry: %v", err)
+	}
+
+	err = s.CheckPortMapping("TCP", 8080, "192.168.1.2", 80)
+	if err != nil {
+		t.Errorf("own mapping: %v", err)
+	}
+	err = s.CheckPortMapping("TCP", 8080, "192.168.1.9", 80)
+	if _, ok := err.(*PortMappingConflictError); !ok {
+		t.Errorf("conflict: %v", err)
+	}
+	err = s.CheckPortMapping("TCP", 9090, "192.168.1.9", 80)
+	if err != nil {
+		t.Errorf("free port: %v", err)
+	}
+}
+
+func TestConnectedService(t *testing.T) {
+	igd := startFakeIGD(igdv2Description)
+	defer igd.Close()
+	igd.setDown("/ctl/ip2")
+
+	_, err := AddUpnpPortMapping(igd.URL+"/desc.xml", ProtocolTCP, 8080, "192.168.1.10", 80, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := igd.path("AddPortMapping"); path != "/ctl/ppp1" {
+		t.Errorf("mapped on %s", path)
+	}
+
+	igd.setDown("/ctl/ppp1")
+	_, _, err = getFakeIGD(t, igd).ConnectedService()
+	if !isUPnPError(err, 501) {
+		t.Errorf("all connections down: %v", err)
+	}
+}
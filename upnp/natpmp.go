@@ -0,0 +1,178 @@
+package upnp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	natpmpVersion           = 0
+	natpmpOpExternalAddress = 0
+	natpmpOpMapUDP          = 1
+	natpmpOpMapTCP          = 2
+	natpmpResponse          = 128
+
+	natpmpUnsuppVersion = 1
+)
+
+// NATPMPClient maps ports with NAT-PMP, RFC 6886.
+type NATPMPClient struct {
+	Gateway net.IP
+	// OnReboot is called in its own goroutine when the gateway lost its
+	// mappings, which have to be added again.
+	OnReboot func()
+
+	mu    sync.Mutex
+	epoch epochTracker
+	// internal ports by mapping key, a deletion names the internal port
+	internalPorts map[string]int
+}
+
+func NewNATPMPClient(gateway net.IP) *NATPMPClient {
+	return &NATPMPClient{
+		Gateway:       gateway,
+		internalPorts: make(map[string]int),
+	}
+}
+
+func natpmpOpcode(protocol string) (byte, error) {
+	switch protocol {
+	case ProtocolTCP:
+		return natpmpOpMapTCP, nil
+	case ProtocolUDP:
+		return natpmpOpMapUDP, nil
+	}
+	return 0, ErrInvalidProtocol
+}
+
+func mappingKey(protocol string, externalPort int) string {
+	return fmt.Sprintf("%s/%d", protocol, externalPort)
+}
+
+// request sends req and returns the successful response of at least size
+// bytes.
+func (c *NATPMPClient) request(req []byte, size int) ([]byte, error) {
+	conn, _, err := natDial(c.Gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := natExchange(conn, req, func(resp []byte) bool {
+		// a PCP server rejects the version with a response of its own
+		return len(resp) >= 4 && (resp[0] != natpmpVersion || resp[1] == natpmpResponse+req[1])
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != natpmpVersion {
+		return nil, &NATResultError{Protocol: "NAT-PMP", Code: natpmpUnsuppVersion}
+	}
+
+	if len(resp) >= 8 {
+		c.updateEpoch(binary.BigEndian.Uint32(resp[4:]))
+	}
+	if code := binary.BigEndian.Uint16(resp[2:]); code != 0 {
+		return nil, &NATResultError{Protocol: "NAT-PMP", Code: int(code)}
+	}
+	if len(resp) < size {
+		return nil, ErrInvalidNATResponse
+	}
+	return resp, nil
+}
+
+func (c *NATPMPClient) updateEpoch(epoch uint32) {
+	c.mu.Lock()
+	lost := c.epoch.update(epoch, time.Now())
+	c.mu.Unlock()
+	if lost && c.OnReboot != nil {
+		go c.OnReboot()
+	}
+}
+
+// GetExternalIPAddress asks the gateway for its external IP.
+func (c *NATPMPClient) GetExternalIPAddress() (net.IP, error) {
+	resp, err := c.request([]byte{natpmpVersion, natpmpOpExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+// MapPort asks the gateway to map externalPort, zero for any, of protocol
+// to internalPort of this host for lifetime. It returns the external port
+// and lifetime granted, which may differ from those asked for. Zero
+// lifetime deletes the mappings of internalPort.
+func (c *NATPMPClient) MapPort(protocol string, internalPort int, externalPort int,
+	lifetime time.Duration) (int, time.Duration, error) {
+	op, err := natpmpOpcode(protocol)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	resp, err := c.request(req, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	mappedPort := int(binary.BigEndian.Uint16(resp[10:]))
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, port := range c.internalPorts {
+		if port == internalPort && strings.HasPrefix(key, protocol+"/") {
+			delete(c.internalPorts, key)
+		}
+	}
+	if lifetime > 0 {
+		c.internalPorts[mappingKey(protocol, mappedPort)] = internalPort
+	}
+	return mappedPort, granted, nil
+}
+
+// AddPortMapping maps externalPort to internalPort for duration, or two
+// hours if zero. internalIP must be empty or the address used to reach the
+// gateway, and description is ignored. It fails with
+// ErrExternalPortChanged if the gateway can't map externalPort.
+func (c *NATPMPClient) AddPortMapping(protocol string, externalPort int,
+	internalIP string, internalPort int, duration time.Duration,
+	description string) error {
+	err := checkLocalAddress(c.Gateway, internalIP)
+	if err != nil {
+		return err
+	}
+
+	port, _, err := c.MapPort(protocol, internalPort, externalPort, natDuration(duration))
+	if err != nil {
+		return err
+	}
+	if port != externalPort {
+		c.MapPort(protocol, internalPort, 0, 0)
+		return ErrExternalPortChanged
+	}
+	return nil
+}
+
+// DeletePortMapping deletes a mapping added by this client.
+func (c *NATPMPClient) DeletePortMapping(protocol string, externalPort int) error {
+	c.mu.Lock()
+	internalPort, found := c.internalPorts[mappingKey(protocol, externalPort)]
+	c.mu.Unlock()
+	if !found {
+		return ErrPortMappingNotFound
+	}
+
+	_, _, err := c.MapPort(protocol, internalPort, 0, 0)
+	return err
+}
@@ -0,0 +1,203 @@
+package upnp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pcpVersion     = 2
+	pcpOpMap       = 1
+	pcpResponseBit = 0x80
+	pcpMapSize     = 60
+
+	pcpUnsuppVersion = 1
+)
+
+// PCPClient maps ports with the MAP opcode of PCP, RFC 6887.
+type PCPClient struct {
+	Gateway net.IP
+	// OnReboot is called in its own goroutine when the gateway lost its
+	// mappings, which have to be added again.
+	OnReboot func()
+
+	mu         sync.Mutex
+	epoch      epochTracker
+	externalIP net.IP
+	mappings   map[string]pcpMapping
+}
+
+// pcpMapping is what refreshing or deleting a mapping has to repeat.
+type pcpMapping struct {
+	nonce        [12]byte
+	internalPort int
+}
+
+func NewPCPClient(gateway net.IP) *PCPClient {
+	return &PCPClient{
+		Gateway:  gateway,
+		mappings: make(map[string]pcpMapping),
+	}
+}
+
+func pcpProtocol(protocol string) (byte, error) {
+	switch protocol {
+	case ProtocolTCP:
+		return 6, nil
+	case ProtocolUDP:
+		return 17, nil
+	}
+	return 0, ErrInvalidProtocol
+}
+
+func (c *PCPClient) updateEpoch(epoch uint32) {
+	c.mu.Lock()
+	lost := c.epoch.update(epoch, time.Now())
+	c.mu.Unlock()
+	if lost && c.OnReboot != nil {
+		go c.OnReboot()
+	}
+}
+
+// MapPort asks the gateway to map externalPort, zero for any, of protocol
+// to internalPort of this host for lifetime, nonce identifies the mapping.
+// It returns the external address and lifetime granted, which may differ
+// from those asked for. Zero lifetime deletes the mapping.
+func (c *PCPClient) MapPort(protocol string, internalPort int, externalPort int,
+	lifetime time.Duration, nonce [12]byte) (*net.UDPAddr, time.Duration, error) {
+	proto, err := pcpProtocol(protocol)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	conn, local, err := natDial(c.Gateway)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	req := make([]byte, pcpMapSize)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+	copy(req[8:24], local.To16())
+	copy(req[24:36], nonce[:])
+	req[36] = proto
+	binary.BigEndian.PutUint16(req[40:], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[42:], uint16(externalPort))
+	copy(req[44:60], net.IPv4zero.To16())
+
+	resp, err := natExchange(conn, req, func(resp []byte) bool {
+		if len(resp) >= 2 && resp[0] != pcpVersion {
+			// a NAT-PMP only server rejecting the version
+			return true
+		}
+		return len(resp) >= 24 && resp[1] == pcpResponseBit|pcpOpMap &&
+			(len(resp) < 36 || bytes.Equal(resp[24:36], nonce[:]))
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp[0] != pcpVersion {
+		return nil, 0, &NATResultError{Protocol: "PCP", Code: pcpUnsuppVersion}
+	}
+
+	c.updateEpoch(binary.BigEndian.Uint32(resp[8:]))
+	if resp[3] != 0 {
+		return nil, 0, &NATResultError{Protocol: "PCP", Code: int(resp[3])}
+	}
+	if len(resp) < pcpMapSize {
+		return nil, 0, ErrInvalidNATResponse
+	}
+
+	addr := &net.UDPAddr{
+		IP:   net.IP(append([]byte(nil), resp[44:60]...)),
+		Port: int(binary.BigEndian.Uint16(resp[42:])),
+	}
+	granted := time.Duration(binary.BigEndian.Uint32(resp[4:])) * time.Second
+	return addr, granted, nil
+}
+
+// nonce returns the nonce of the mapping of key, a new one unless mapped.
+func (c *PCPClient) nonce(key string) ([12]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m, found := c.mappings[key]
+	if found {
+		return m.nonce, nil
+	}
+	var nonce [12]byte
+	_, err := rand.Read(nonce[:])
+	return nonce, err
+}
+
+// GetExternalIPAddress returns the external IP of the last mapping, PCP
+// has no request for it.
+func (c *PCPClient) GetExternalIPAddress() (net.IP, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.externalIP == nil {
+		return nil, ErrExternalIPUnknown
+	}
+	return c.externalIP, nil
+}
+
+// AddPortMapping maps externalPort to internalPort for duration, or two
+// hours if zero. internalIP must be empty or the address used to reach the
+// gateway, and description is ignored. It fails with
+// ErrExternalPortChanged if the gateway can't map externalPort.
+func (c *PCPClient) AddPortMapping(protocol string, externalPort int,
+	internalIP string, internalPort int, duration time.Duration,
+	description string) error {
+	err := checkLocalAddress(c.Gateway, internalIP)
+	if err != nil {
+		return err
+	}
+
+	key := mappingKey(protocol, externalPort)
+	nonce, err := c.nonce(key)
+	if err != nil {
+		return err
+	}
+	addr, _, err := c.MapPort(protocol, internalPort, externalPort, natDuration(duration), nonce)
+	if err != nil {
+		return err
+	}
+	if addr.Port != externalPort {
+		c.MapPort(protocol, internalPort, addr.Port, 0, nonce)
+		return ErrExternalPortChanged
+	}
+
+	c.mu.Lock()
+	c.mappings[key] = pcpMapping{nonce: nonce, internalPort: internalPort}
+	c.externalIP = addr.IP
+	c.mu.Unlock()
+	return nil
+}
+
+// DeletePortMapping deletes a mapping added by this client.
+func (c *PCPClient) DeletePortMapping(protocol string, externalPort int) error {
+	key := mappingKey(protocol, externalPort)
+	c.mu.Lock()
+	m, found := c.mappings[key]
+	c.mu.Unlock()
+	if !found {
+		return ErrPortMappingNotFound
+	}
+
+	_, _, err := c.MapPort(protocol, m.internalPort, externalPort, 0, m.nonce)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	delete(c.mappings, key)
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,251 @@
+package upnp
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PortMapper maps ports on a NAT gateway. It is implemented by IGDService,
+// NATPMPClient and PCPClient.
+type PortMapper interface {
+	// GetExternalIPAddress returns the external IP of the gateway.
+	GetExternalIPAddress() (net.IP, error)
+	// AddPortMapping maps externalPort of protocol to
+	// internalIP:internalPort for duration. Zero duration is permanent for
+	// UPnP, and the longest lifetime the gateway grants otherwise.
+	AddPortMapping(protocol string, externalPort int, internalIP string, internalPort int,
+		duration time.Duration, description string) error
+	// DeletePortMapping deletes the mapping of externalPort of protocol.
+	DeletePortMapping(protocol string, externalPort int) error
+}
+
+// methods to map ports
+const (
+	MethodUPnP   = "upnp"
+	MethodNATPMP = "natpmp"
+	MethodPCP    = "pcp"
+)
+
+// DefaultMethods are tried in order by the daemon unless configured
+// otherwise.
+var DefaultMethods = []string{MethodUPnP, MethodPCP, MethodNATPMP}
+
+var (
+	ErrInvalidMethod       = errors.New("method must be upnp, natpmp or pcp")
+	ErrGatewayNotFound     = errors.New("gateway not found")
+	ErrGatewayNotIPv4      = errors.New("NAT-PMP and PCP gateway must be IPv4")
+	ErrNATTimeout          = errors.New("no response from gateway")
+	ErrNotLocalAddress     = errors.New("can only map ports to the address used to reach the gateway")
+	ErrExternalPortChanged = errors.New("gateway assigned another external port")
+	ErrExternalIPUnknown   = errors.New("external IP unknown before a port is mapped")
+	ErrInvalidNATResponse  = errors.New("invalid response from gateway")
+)
+
+const (
+	// lifetime asked for when the duration is zero, RFC 6886 section 3.3
+	defaultNATLifetime = 2 * time.Hour
+
+	natInitialTimeout = 250 * time.Millisecond
+	// RFC 6886 retries 9 times, which takes over a minute: give up sooner
+	// so the next method gets a chance
+	natRetries = 4
+)
+
+// port the NAT-PMP and PCP servers listen on, changed by tests
+var natServerPort = 5351
+
+func validateMethod(method string) error {
+	switch method {
+	case MethodUPnP, MethodNATPMP, MethodPCP:
+		return nil
+	}
+	return ErrInvalidMethod
+}
+
+// NATResultError is a result code other than success returned by a NAT-PMP
+// or PCP server.
+type NATResultError struct {
+	Protocol string
+	Code     int
+}
+
+var natResultNames = map[string][]string{
+	"NAT-PMP": {"SUCCESS", "UNSUPP_VERSION", "NOT_AUTHORIZED", "NETWORK_FAILURE",
+		"OUT_OF_RESOURCES", "UNSUPP_OPCODE"},
+	"PCP": {"SUCCESS", "UNSUPP_VERSION", "NOT_AUTHORIZED", "MALFORMED_REQUEST",
+		"UNSUPP_OPCODE", "UNSUPP_OPTION", "MALFORMED_OPTION", "NETWORK_FAILURE",
+		"NO_RESOURCES", "UNSUPP_PROTOCOL", "USER_EX_QUOTA", "CANNOT_PROVIDE_EXTERNAL",
+		"ADDRESS_MISMATCH", "EXCESSIVE_REMOTE_PEERS"},
+}
+
+func (e *NATResultError) Error() string {
+	name := "unknown"
+	if names := natResultNames[e.Protocol]; e.Code < len(names) {
+		name = names[e.Code]
+	}
+	return fmt.Sprintf("%s result code %d %s", e.Protocol, e.Code, name)
+}
+
+// epochTracker follows the epoch time of a NAT-PMP or PCP server to detect
+// it lost its mappings, RFC 6887 section 8.5, which refines RFC 6886
+// section 3.6.
+type epochTracker struct {
+	valid  bool
+	server uint32
+	client time.Time
+}
+
+// update records the epoch of a response received at now, it reports
+// whether the server lost its state since the previous response.
+func (e *epochTracker) update(server uint32, now time.Time) bool {
+	lost := false
+	if e.valid {
+		if server+1 < e.server {
+			lost = true
+		} else {
+			clientDelta := int64(now.Sub(e.client) / time.Second)
+			serverDelta := int64(server) - int64(e.server)
+			lost = clientDelta+2 < serverDelta-serverDelta/16 ||
+				serverDelta+2 < clientDelta-clientDelta/16
+		}
+	}
+
+	e.valid = true
+	e.server = server
+	e.client = now
+	return lost
+}
+
+// natDial connects to the NAT-PMP or PCP server of gateway, and returns the
+// local IP used to reach it.
+func natDial(gateway net.IP) (*net.UDPConn, net.IP, error) {
+	if gateway.To4() == nil {
+		return nil, nil, ErrGatewayNotIPv4
+	}
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: gateway, Port: natServerPort})
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// natExchange sends req until a response accepted by match arrives,
+// doubling the wait after each retry as RFC 6886 section 3.1.
+func natExchange(conn *net.UDPConn, req []byte, match func(resp []byte) bool) ([]byte, error) {
+	buf := make([]byte, 1100)
+	timeout := natInitialTimeout
+	for i := 0; i < natRetries; i++ {
+		_, err := conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(timeout)
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					break
+				}
+				// ICMP port unreachable: wait out the timeout, the server
+				// may be starting
+				time.Sleep(time.Until(deadline))
+				break
+			}
+			if match(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		timeout *= 2
+	}
+	return nil, ErrNATTimeout
+}
+
+// checkLocalAddress fails unless internalIP, which may be empty, is the
+// address used to reach gateway, as NAT-PMP and PCP map ports to the
+// address of the requester.
+func checkLocalAddress(gateway net.IP, internalIP string) error {
+	if internalIP == "" {
+		return nil
+	}
+	conn, local, err := natDial(gateway)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	ip := net.ParseIP(internalIP)
+	if ip == nil || !ip.Equal(local) {
+		return ErrNotLocalAddress
+	}
+	return nil
+}
+
+// natDuration returns the lifetime to ask for a mapping of duration.
+func natDuration(duration time.Duration) time.Duration {
+	if duration <= 0 {
+		return defaultNATLifetime
+	}
+	if duration < time.Second {
+		return time.Second
+	}
+	return duration
+}
+
+// gatewayIP returns the gateway for NAT-PMP and PCP identified by igd: its
+// IP, a URL on it, or empty for the default gateway.
+func gatewayIP(igd string) (net.IP, error) {
+	if ip := net.ParseIP(igd); ip != nil {
+		return ip, nil
+	}
+	if igd == "" {
+		return defaultGateway()
+	}
+
+	u, err := url.Parse(igd)
+	if err == nil && u.Host != "" {
+		if ip := net.ParseIP(u.Hostname()); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, ErrGatewayNotFound
+}
+
+// defaultGateway reads the IPv4 default gateway from /proc/net/route,
+// which only exists on Linux.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, ErrGatewayNotFound
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ..., addresses in little endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		// RTF_UP and RTF_GATEWAY
+		if err != nil || flags&0x3 != 0x3 {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		return net.IPv4(b[3], b[2], b[1], b[0]), nil
+	}
+	return nil, ErrGatewayNotFound
+}
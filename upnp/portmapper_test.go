@@ -0,0 +1,394 @@
+package upnp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fakeExternalIP = net.IPv4(203, 0, 113, 1)
+
+// fakeNATGateway is a NAT-PMP and PCP server on loopback.
+type fakeNATGateway struct {
+	conn   *net.UDPConn
+	natpmp bool
+	pcp    bool
+
+	mu    sync.Mutex
+	start time.Time
+	// external ports by protocol and internal port
+	mappings map[string]int
+	// external ports the gateway won't map
+	taken  map[int]bool
+	nonces map[string][]byte
+}
+
+func startFakeNATGateway(t *testing.T, natpmp bool, pcp bool) *fakeNATGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &fakeNATGateway{
+		conn:     conn,
+		natpmp:   natpmp,
+		pcp:      pcp,
+		start:    time.Now().Add(-time.Hour),
+		mappings: make(map[string]int),
+		taken:    make(map[int]bool),
+		nonces:   make(map[string][]byte),
+	}
+	natServerPort = conn.LocalAddr().(*net.UDPAddr).Port
+	go g.serve()
+	return g
+}
+
+func (g *fakeNATGateway) Close() {
+	g.conn.Close()
+	natServerPort = 5351
+}
+
+// reboot loses the mappings and restarts the epoch.
+func (g *fakeNATGateway) reboot() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.start = time.Now()
+	g.mappings = make(map[string]int)
+}
+
+func (g *fakeNATGateway) mapping(protocol string, internalPort int) (int, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	port, found := g.mappings[fmt.Sprintf("%s/%d", protocol, internalPort)]
+	return port, found
+}
+
+func (g *fakeNATGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		g.mu.Lock()
+		resp := g.handle(buf[:n], addr)
+		g.mu.Unlock()
+		g.conn.WriteToUDP(resp, addr)
+	}
+}
+
+// mapPort applies a mapping request and returns the external port, zero
+// once deleted.
+func (g *fakeNATGateway) mapPort(protocol string, internalPort int, externalPort int, lifetime uint32) int {
+	key := fmt.Sprintf("%s/%d", protocol, internalPort)
+	if lifetime == 0 {
+		delete(g.mappings, key)
+		return 0
+	}
+	for externalPort == 0 || g.taken[externalPort] {
+		externalPort = 40000 + internalPort%1000
+	}
+	g.mappings[key] = externalPort
+	return externalPort
+}
+
+func (g *fakeNATGateway) handle(req []byte, addr *net.UDPAddr) []byte {
+	epoch := uint32(time.Since(g.start) / time.Second)
+	if req[0] == natpmpVersion {
+		if !g.natpmp {
+			resp := make([]byte, 24)
+			resp[0], resp[1], resp[3] = pcpVersion, pcpResponseBit|req[1], pcpUnsuppVersion
+			binary.BigEndian.PutUint32(resp[8:], epoch)
+			return resp
+		}
+		if req[1] == natpmpOpExternalAddress {
+			resp := make([]byte, 12)
+			resp[1] = natpmpResponse
+			binary.BigEndian.PutUint32(resp[4:], epoch)
+			copy(resp[8:], fakeExternalIP.To4())
+			return resp
+		}
+
+		protocol := ProtocolTCP
+		if req[1] == natpmpOpMapUDP {
+			protocol = ProtocolUDP
+		}
+		lifetime := binary.BigEndian.Uint32(req[8:])
+		port := g.mapPort(protocol, int(binary.BigEndian.Uint16(req[4:])),
+			int(binary.BigEndian.Uint16(req[6:])), lifetime)
+		resp := make([]byte, 16)
+		resp[1] = natpmpResponse + req[1]
+		binary.BigEndian.PutUint32(resp[4:], epoch)
+		copy(resp[8:10], req[4:6])
+		binary.BigEndian.PutUint16(resp[10:], uint16(port))
+		binary.BigEndian.PutUint32(resp[12:], lifetime)
+		return resp
+	}
+
+	if !g.pcp {
+		resp := make([]byte, 8)
+		resp[1], resp[3] = natpmpResponse+req[1], natpmpUnsuppVersion
+		binary.BigEndian.PutUint32(resp[4:], epoch)
+		return resp
+	}
+	resp := append([]byte(nil), req...)
+	resp[1] |= pcpResponseBit
+	binary.BigEndian.PutUint32(resp[8:], epoch)
+	if !net.IP(req[8:24]).Equal(addr.IP) {
+		resp[3] = 12 // ADDRESS_MISMATCH
+		return resp
+	}
+
+	protocol := ProtocolTCP
+	if req[36] == 17 {
+		protocol = ProtocolUDP
+	}
+	internalPort := int(binary.BigEndian.Uint16(req[40:]))
+	key := fmt.Sprintf("%s/%d", protocol, internalPort)
+	if nonce, found := g.nonces[key]; found && !bytes.Equal(nonce, req[24:36]) {
+		resp[3] = 2 // NOT_AUTHORIZED
+		return resp
+	}
+	g.nonces[key] = append([]byte(nil), req[24:36]...)
+
+	port := g.mapPort(protocol, internalPort, int(binary.BigEndian.Uint16(req[42:])),
+		binary.BigEndian.Uint32(req[4:]))
+	binary.BigEndian.PutUint16(resp[42:], uint16(port))
+	copy(resp[44:], fakeExternalIP.To16())
+	return resp
+}
+
+func TestEpochTracker(t *testing.T) {
+	start := time.Now()
+	var e epochTracker
+	tests := []struct {
+		server  uint32
+		elapsed time.Duration
+		lost    bool
+	}{
+		{1000, 0, false},
+		{1060, time.Minute, false},
+		// the server clock is a bit fast
+		{1125, 2 * time.Minute, false},
+		// went back
+		{5, 2*time.Minute + time.Second, true},
+		// advanced less than the client clock, rebooted meanwhile
+		{20, 3 * time.Minute, true},
+		{21, 3*time.Minute + time.Second, false},
+	}
+	for i, test := range tests {
+		if lost := e.update(test.server, start.Add(test.elapsed)); lost != test.lost {
+			t.Errorf("%d: epoch %d after %v: lost %v", i, test.server, test.elapsed, lost)
+		}
+	}
+}
+
+func TestNATPMPClient(t *testing.T) {
+	g := startFakeNATGateway(t, true, false)
+	defer g.Close()
+
+	rebooted := make(chan int, 1)
+	c := NewNATPMPClient(net.IPv4(127, 0, 0, 1))
+	c.OnReboot = func() { rebooted <- 1 }
+
+	ip, err := c.GetExternalIPAddress()
+	if err != nil || !ip.Equal(fakeExternalIP) {
+		t.Fatalf("external ip: %v %v", ip, err)
+	}
+
+	err = c.AddPortMapping(ProtocolUDP, 5060, "127.0.0.1", 5070, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := g.mapping(ProtocolUDP, 5070); port != 5060 {
+		t.Errorf("mapped to %d", port)
+	}
+
+	g.mu.Lock()
+	g.taken[8080] = true
+	g.mu.Unlock()
+	err = c.AddPortMapping(ProtocolTCP, 8080, "", 80, time.Minute, "")
+	if err != ErrExternalPortChanged {
+		t.Errorf("taken port: %v", err)
+	}
+	if _, found := g.mapping(ProtocolTCP, 80); found {
+		t.Error("mapping to another port not deleted")
+	}
+
+	err = c.AddPortMapping(ProtocolTCP, 8081, "192.0.2.10", 80, 0, "")
+	if err != ErrNotLocalAddress {
+		t.Errorf("mapping to another host: %v", err)
+	}
+
+	err = c.DeletePortMapping(ProtocolUDP, 5060)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := g.mapping(ProtocolUDP, 5070); found {
+		t.Error("mapping not deleted")
+	}
+	if err := c.DeletePortMapping(ProtocolUDP, 5060); err != ErrPortMappingNotFound {
+		t.Errorf("deleted twice: %v", err)
+	}
+
+	select {
+	case <-rebooted:
+		t.Fatal("reboot detected too early")
+	default:
+	}
+	g.reboot()
+	c.GetExternalIPAddress()
+	select {
+	case <-rebooted:
+	case <-time.After(time.Second):
+		t.Error("reboot not detected")
+	}
+}
+
+func TestPCPClient(t *testing.T) {
+	g := startFakeNATGateway(t, false, true)
+	defer g.Close()
+
+	c := NewPCPClient(net.IPv4(127, 0, 0, 1))
+	if _, err := c.GetExternalIPAddress(); err != ErrExternalIPUnknown {
+		t.Errorf("external ip before mapping: %v", err)
+	}
+
+	// refreshing repeats the nonce, or the gateway refuses it
+	for i := 0; i < 2; i++ {
+		err := c.AddPortMapping(ProtocolTCP, 8080, "127.0.0.1", 80, time.Minute, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if port, _ := g.mapping(ProtocolTCP, 80); port != 8080 {
+		t.Errorf("mapped to %d", port)
+	}
+	ip, err := c.GetExternalIPAddress()
+	if err != nil || !ip.Equal(fakeExternalIP) {
+		t.Errorf("external ip: %v %v", ip, err)
+	}
+
+	err = c.DeletePortMapping(ProtocolTCP, 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := g.mapping(ProtocolTCP, 80); found {
+		t.Error("mapping not deleted")
+	}
+
+	// a NAT-PMP only gateway rejects the version at once
+	g.mu.Lock()
+	g.pcp = false
+	g.mu.Unlock()
+	start := time.Now()
+	err = c.AddPortMapping(ProtocolTCP, 8080, "", 80, 0, "")
+	if e, ok := err.(*NATResultError); !ok || e.Code != pcpUnsuppVersion {
+		t.Errorf("NAT-PMP gateway: %v", err)
+	}
+	if time.Since(start) > natInitialTimeout {
+		t.Error("version rejection not handled before retrying")
+	}
+}
+
+func TestDaemonMethods(t *testing.T) {
+	g := startFakeNATGateway(t, true, false)
+	defer g.Close()
+
+	d := NewDaemon()
+	if err := d.SetMethods(MethodPCP, "bonjour"); err != ErrInvalidMethod {
+		t.Errorf("invalid method: %v", err)
+	}
+	err := d.SetMethods(MethodPCP, MethodNATPMP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.AddPortMapping("127.0.0.1", ProtocolTCP, 8080, "127.0.0.1", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := d.ListPortMapping()
+	if len(list) != 1 || list[0].Method != MethodNATPMP || list[0].IGDServer != "127.0.0.1" ||
+		list[0].ExternalIP != fakeExternalIP.String() {
+		t.Fatalf("mappings: %+v", list[0])
+	}
+
+	// the mapping is added again once a response shows the gateway rebooted
+	g.reboot()
+	mapper, _ := d.portMapper(list[0])
+	mapper.GetExternalIPAddress()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, found := g.mapping(ProtocolTCP, 80); found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("mapping not added after reboot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = d.DeletePortMapping("127.0.0.1", ProtocolTCP, 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := g.mapping(ProtocolTCP, 80); found {
+		t.Error("mapping not deleted")
+	}
+}
+
+func TestDaemonLoadPortMappings(t *testing.T) {
+	g := startFakeNATGateway(t, true, false)
+	defer g.Close()
+
+	// no IGD answers
+	defer func(f *igdFinder) { finder = f }(finder)
+	finder = newIGDFinder(func(timeout time.Duration) []*SSDPNotify { return nil })
+
+	dir, err := ioutil.TempDir("", "upnp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStore(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pm := range []*PortMappingInfo{
+		{IGDServer: "127.0.0.1", Method: MethodNATPMP, ExternalPort: 8080,
+			InternalIP: "127.0.0.1", InternalPort: 80},
+		{IGDServer: "127.0.0.1", ExternalPort: 8081, InternalIP: "127.0.0.1", InternalPort: 81},
+	} {
+		err = s.AddPortMapping(pm)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewDaemon()
+	err = d.LoadPortMappings(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeletePortMapping("127.0.0.1", ProtocolTCP, 8080)
+
+	if port, _ := g.mapping(ProtocolTCP, 80); port != 8080 {
+		t.Errorf("mapped to %d", port)
+	}
+	list := d.ListPortMapping()
+	if len(list) != 1 || list[0].Method != MethodNATPMP {
+		t.Errorf("mappings: %+v", list)
+	}
+	// the UPnP mapping whose IGD isn't found is kept for the next load
+	saved, err := s.GetAllPortMapping()
+	if err != nil || len(saved) != 2 {
+		t.Errorf("saved: %+v %v", saved, err)
+	}
+}
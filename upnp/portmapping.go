@@ -9,14 +9,19 @@ import (
 
 type portMapping struct {
 	info        *PortMappingInfo
+	mapper      func(info *PortMappingInfo) (PortMapper, error)
 	stopCh      chan int
+	refreshCh   chan int
 	waitStopped sync.WaitGroup
 }
 
-func newPortMapping(info *PortMappingInfo) *portMapping {
+func newPortMapping(info *PortMappingInfo,
+	mapper func(info *PortMappingInfo) (PortMapper, error)) *portMapping {
 	m := &portMapping{
-		info:   info,
-		stopCh: make(chan int),
+		info:      info,
+		mapper:    mapper,
+		stopCh:    make(chan int),
+		refreshCh: make(chan int, 1),
 	}
 	return m
 }
@@ -24,8 +29,11 @@ func newPortMapping(info *PortMappingInfo) *portMapping {
 func (m *portMapping) stop() {
 	close(m.stopCh)
 	m.waitStopped.Wait()
-	DeleteUpnpTcpPortMapping(m.info.IGDServer, m.info.ExternalPort)
-	log.Infof("delete port mapping :%d -> %s",
+	mapper, err := m.mapper(m.info)
+	if err == nil {
+		mapper.DeletePortMapping(m.info.GetProtocol(), m.info.ExternalPort)
+	}
+	log.Infof("delete %s port mapping :%d -> %s", m.info.GetProtocol(),
 		m.info.ExternalPort, m.info.internalAddr())
 }
 
@@ -35,28 +43,54 @@ func (m *portMapping) servLoop() {
 	defer m.waitStopped.Done()
 
 	for {
-		m.ensureUpnpPortMapping()
+		_, err := m.ensurePortMapping()
+		if err != nil {
+			log.Warnf("failed to refresh %s port mapping :%d -> %s: %v", m.info.GetProtocol(),
+				m.info.ExternalPort, m.info.internalAddr(), err)
+		}
 		select {
 		case <-m.stopCh:
 			return
 		case <-ticker.C:
+		case <-m.refreshCh:
 		}
 	}
 }
 
-func (m *portMapping) ensureUpnpPortMapping() (string, error) {
-	return AddUpnpTcpPortMapping(m.info.IGDServer, m.info.ExternalPort,
-		m.info.InternalIP, m.info.InternalPort)
+// refresh adds the mapping again without waiting for the next tick.
+func (m *portMapping) refresh() {
+	select {
+	case m.refreshCh <- 1:
+	default:
+	}
+}
+
+func (m *portMapping) ensurePortMapping() (string, error) {
+	mapper, err := m.mapper(m.info)
+	if err != nil {
+		return "", err
+	}
+	err = mapper.AddPortMapping(m.info.GetProtocol(), m.info.ExternalPort,
+		m.info.InternalIP, m.info.InternalPort, 0, "")
+	if err != nil {
+		return "", err
+	}
+
+	externalIP, err := mapper.GetExternalIPAddress()
+	if err != nil {
+		return "", err
+	}
+	return externalIP.String(), nil
 }
 
 func (m *portMapping) start() error {
-	externalIP, err := m.ensureUpnpPortMapping()
+	externalIP, err := m.ensurePortMapping()
 	if err != nil {
 		return err
 	}
 
-	log.Infof("new port mapping %s:%d -> %s", externalIP,
-		m.info.ExternalPort,
+	log.Infof("new %s %s port mapping %s:%d -> %s", m.info.GetMethod(), m.info.GetProtocol(),
+		externalIP, m.info.ExternalPort,
 		m.info.internalAddr())
 
 	m.info.ExternalIP = externalIP
@@ -53,6 +53,14 @@ func soapRequest(url, service, function, message string) ([]byte, error) {
 	r.Body.Close()
 
 	if r.StatusCode >= 400 {
+		envelope := &soapErrorResponse{}
+		if xml.Unmarshal(resp, envelope) == nil && envelope.ErrorCode != 0 {
+			return resp, &UPnPError{
+				Action:      function,
+				Code:        envelope.ErrorCode,
+				Description: envelope.ErrorDescription,
+			}
+		}
 		return resp, errors.New(function + ": " + r.Status)
 	}
 
@@ -73,6 +81,59 @@ type getExternalIPAddressResponse struct {
 	NewExternalIPAddress string `xml:"NewExternalIPAddress"`
 }
 
+type soapAddAnyPortMappingResponse struct {
+	NewReservedPort int `xml:"Body>AddAnyPortMappingResponse>NewReservedPort"`
+}
+
+// portMappingEntry holds the out arguments of GetGenericPortMappingEntry
+// and GetSpecificPortMappingEntry.
+type portMappingEntry struct {
+	RemoteHost     string `xml:"NewRemoteHost"`
+	ExternalPort   int    `xml:"NewExternalPort"`
+	Protocol       string `xml:"NewProtocol"`
+	InternalPort   int    `xml:"NewInternalPort"`
+	InternalClient string `xml:"NewInternalClient"`
+	Enabled        string `xml:"NewEnabled"`
+	Description    string `xml:"NewPortMappingDescription"`
+	LeaseDuration  int    `xml:"NewLeaseDuration"`
+}
+
+type soapPortMappingEntryResponse struct {
+	Body struct {
+		Entry portMappingEntry `xml:",any"`
+	} `xml:"Body"`
+}
+
+// error codes of WANIPConnection actions
+const (
+	errCodeSpecifiedArrayIndexInvalid = 713
+	errCodeNoSuchEntryInArray         = 714
+)
+
+// UPnPError is the error an IGD returned for an action.
+type UPnPError struct {
+	Action      string
+	Code        int
+	Description string
+}
+
+func (e *UPnPError) Error() string {
+	return fmt.Sprintf("%s: upnp error %d %s", e.Action, e.Code, e.Description)
+}
+
+func isUPnPError(err error, codes ...int) bool {
+	e, ok := err.(*UPnPError)
+	if !ok {
+		return false
+	}
+	for _, code := range codes {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
 type soapErrorResponse struct {
 	ErrorCode        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
 	ErrorDescription string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
@@ -16,11 +16,14 @@ var (
 	SSDPMulticastAddr = []byte{239, 255, 255, 250}
 )
 
+// SSDPNotify is the response of a device to a search. MaxAge is how long
+// in seconds the response stays valid, zero if not given.
 type SSDPNotify struct {
 	DeviceUUID                string `json:"uuid"`
 	RespondingDeviceType      string `json:"deviceType"`
 	DeviceUSN                 string `json:"usn"`
 	DeviceDescriptionLocation string `json:"location"`
+	MaxAge                    int    `json:"maxAge,omitempty"`
 }
 
 func ParseSSDPNotify(deviceType string, data []byte) (*SSDPNotify, error) {
@@ -53,9 +56,25 @@ func ParseSSDPNotify(deviceType string, data []byte) (*SSDPNotify, error) {
 	r.RespondingDeviceType = respondingDeviceType
 	r.DeviceUUID = deviceUUID
 	r.DeviceDescriptionLocation = deviceDescriptionLocation
+	r.MaxAge = parseMaxAge(response.Header.Get("Cache-Control"))
 	return r, nil
 }
 
+// parseMaxAge returns the max-age directive of a Cache-Control header, or
+// zero.
+func parseMaxAge(cacheControl string) int {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		f := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+		if len(f) == 2 && strings.EqualFold(strings.TrimSpace(f[0]), "max-age") {
+			v, err := parseInt(strings.TrimSpace(f[1]))
+			if err == nil && v > 0 {
+				return v
+			}
+		}
+	}
+	return 0
+}
+
 func buildSSDPSearchPackage(deviceType string, timeout time.Duration) []byte {
 	var tpl = "M-SEARCH * HTTP/1.1 \r\n" +
 		"HOST: 239.255.255.250:1900\r\n" +
@@ -3,13 +3,19 @@ package upnp
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
 )
 
 type PortMappingInfo struct {
+	// UUID of the IGD for UPnP, IP of the gateway for NAT-PMP and PCP
 	IGDServer    string `json:"igdServer"`
+	Method       string `json:"method,omitempty"`
+	Protocol     string `json:"protocol,omitempty"`
 	ExternalPort int    `json:"externalPort"`
 	InternalIP   string `json:"internalIP"`
 	InternalPort int    `json:"internalPort"`
@@ -17,16 +23,37 @@ type PortMappingInfo struct {
 	ExternalIP string `json:"externalIP"`
 }
 
-func genId(igdServer string, externalPort int) string {
-	return fmt.Sprintf("%s:%d", igdServer, externalPort)
+// GetProtocol returns the protocol of the mapping, TCP if not set.
+func (p *PortMappingInfo) GetProtocol() string {
+	if p.Protocol == "" {
+		return ProtocolTCP
+	}
+	return p.Protocol
+}
+
+// GetMethod returns the method of the mapping, UPnP if not set.
+func (p *PortMappingInfo) GetMethod() string {
+	if p.Method == "" {
+		return MethodUPnP
+	}
+	return p.Method
+}
+
+// genId identifies a mapping on the IGD. TCP mappings keep the id they
+// had before UDP was supported.
+func genId(igdServer string, protocol string, externalPort int) string {
+	if protocol == ProtocolTCP {
+		return fmt.Sprintf("%s:%d", igdServer, externalPort)
+	}
+	return fmt.Sprintf("%s:%d/%s", igdServer, externalPort, strings.ToLower(protocol))
 }
 
-func binId(igdServer string, externalPort int) []byte {
-	return []byte(genId(igdServer, externalPort))
+func binId(igdServer string, protocol string, externalPort int) []byte {
+	return []byte(genId(igdServer, protocol, externalPort))
 }
 
 func (p *PortMappingInfo) binId() []byte {
-	return binId(p.IGDServer, p.ExternalPort)
+	return binId(p.IGDServer, p.GetProtocol(), p.ExternalPort)
 }
 
 func (p *PortMappingInfo) internalAddr() string {
@@ -108,12 +135,12 @@ func (s *Store) AddPortMapping(pm *PortMappingInfo) error {
 	})
 }
 
-func (s *Store) DeletePortMapping(igdServer string, externalPort int) error {
+func (s *Store) DeletePortMapping(igdServer string, protocol string, externalPort int) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	return s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(kBucket)
-		return b.Delete(binId(igdServer, externalPort))
+		return b.Delete(binId(igdServer, protocol, externalPort))
 	})
 }
 
@@ -142,3 +169,72 @@ func (s *Store) GetAllPortMapping() ([]*PortMappingInfo, error) {
 
 	return result, nil
 }
+
+// UpgradeIGDServers rekeys UPnP mappings saved with the IP of the IGD,
+// before IGDs were identified by UUID, by the UUID GetIGD finds. Mappings
+// whose IGD isn't found are kept as they are.
+func (s *Store) UpgradeIGDServers() error {
+	return s.upgradeIGDServers(func(pm *PortMappingInfo) (string, error) {
+		igd, err := GetIGD(pm.IGDServer, pm.InternalIP)
+		if err != nil {
+			return "", err
+		}
+		return igd.UUID, nil
+	})
+}
+
+func (s *Store) upgradeIGDServers(uuidOf func(pm *PortMappingInfo) (string, error)) error {
+	list, err := s.GetAllPortMapping()
+	if err != nil {
+		return err
+	}
+
+	// resolved before the transaction, finding an IGD takes seconds
+	var old, upgraded []*PortMappingInfo
+	for _, pm := range list {
+		if pm.GetMethod() != MethodUPnP || net.ParseIP(pm.IGDServer) == nil {
+			continue
+		}
+
+		uuid, err := uuidOf(pm)
+		if err != nil {
+			log.Warnf("failed to find igd %s of port mapping %d: %v",
+				pm.IGDServer, pm.ExternalPort, err)
+			continue
+		}
+		up := *pm
+		up.IGDServer = uuid
+		old = append(old, pm)
+		upgraded = append(upgraded, &up)
+	}
+	if len(upgraded) == 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(kBucket)
+		for i, pm := range old {
+			// deleted meanwhile
+			if b.Get(pm.binId()) == nil {
+				continue
+			}
+			err := b.Delete(pm.binId())
+			if err != nil {
+				return err
+			}
+
+			data, err := json.Marshal(upgraded[i])
+			if err != nil {
+				return err
+			}
+			err = b.Put(upgraded[i].binId(), data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,121 @@
+package upnp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreProtocols(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upnp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStore(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mapped before UDP was supported
+	tcp := &PortMappingInfo{IGDServer: "192.168.1.1", ExternalPort: 5060}
+	udp := &PortMappingInfo{IGDServer: "192.168.1.1", Protocol: ProtocolUDP, ExternalPort: 5060}
+	for _, pm := range []*PortMappingInfo{tcp, udp} {
+		err = s.AddPortMapping(pm)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := s.GetAllPortMapping()
+	if err != nil || len(list) != 2 {
+		t.Fatalf("list: %v %v", list, err)
+	}
+
+	err = s.DeletePortMapping("192.168.1.1", ProtocolTCP, 5060)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err = s.GetAllPortMapping()
+	if err != nil || len(list) != 1 || list[0].GetProtocol() != ProtocolUDP {
+		t.Errorf("list after delete: %+v %v", list, err)
+	}
+}
+
+func TestParseProtocol(t *testing.T) {
+	for in, want := range map[string]string{"": "TCP", "tcp": "TCP", "Udp": "UDP"} {
+		p, err := ParseProtocol(in)
+		if err != nil || p != want {
+			t.Errorf("ParseProtocol(%q): %s %v", in, p, err)
+		}
+	}
+	if _, err := ParseProtocol("sctp"); err != ErrInvalidProtocol {
+		t.Errorf("ParseProtocol(sctp): %v", err)
+	}
+}
+
+func TestStoreUpgradeIGDServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upnp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStore(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// saved before IGDs were identified by UUID
+	pms := []*PortMappingInfo{
+		{IGDServer: "192.168.1.1", ExternalPort: 8080},
+		{IGDServer: "192.168.2.1", ExternalPort: 8080},
+		{IGDServer: "192.168.1.1", Method: MethodNATPMP, ExternalPort: 8081},
+		{IGDServer: igdv1UUID, ExternalPort: 8082},
+		{IGDServer: "192.168.3.1", ExternalPort: 8083},
+	}
+	for _, pm := range pms {
+		err = s.AddPortMapping(pm)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = s.upgradeIGDServers(func(pm *PortMappingInfo) (string, error) {
+		switch pm.IGDServer {
+		case "192.168.1.1":
+			return igdv2UUID, nil
+		case "192.168.3.1":
+			// deleted while its IGD is searched, the store isn't locked
+			err := s.DeletePortMapping(pm.IGDServer, ProtocolTCP, pm.ExternalPort)
+			return igdv2UUID, err
+		}
+		return "", ErrIGDNotFound
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.GetAllPortMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, pm := range list {
+		got[genId(pm.IGDServer, pm.GetProtocol(), pm.ExternalPort)] = true
+	}
+	for _, id := range []string{
+		genId(igdv2UUID, ProtocolTCP, 8080),
+		// the IGD wasn't found
+		genId("192.168.2.1", ProtocolTCP, 8080),
+		genId("192.168.1.1", ProtocolTCP, 8081),
+		genId(igdv1UUID, ProtocolTCP, 8082),
+	} {
+		if !got[id] {
+			t.Errorf("%s missing from %v", id, got)
+		}
+	}
+	if len(list) != 4 {
+		t.Errorf("%d mappings", len(list))
+	}
+}
@@ -3,8 +3,8 @@ package upnp
 import (
 	"encoding/xml"
 	"errors"
-	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/MoZhonghua/mytools/util"
 )
@@ -71,56 +71,65 @@ func GetUPnPData(deviceDescriptionLocation string) (*UPnPRoot, error) {
 	return &upnpRoot, nil
 }
 
+const (
+	ProtocolTCP = "TCP"
+	ProtocolUDP = "UDP"
+)
+
+var ErrInvalidProtocol = errors.New("protocol must be TCP or UDP")
+
+// ParseProtocol returns TCP or UDP for s in any case, empty means TCP.
+func ParseProtocol(s string) (string, error) {
+	switch strings.ToUpper(s) {
+	case "", ProtocolTCP:
+		return ProtocolTCP, nil
+	case ProtocolUDP:
+		return ProtocolUDP, nil
+	}
+	return "", ErrInvalidProtocol
+}
+
 func AddUpnpTcpPortMapping(igdServer string, externalPort int,
 	internalIp string, internalPort int) (string, error) {
-	igdURL := fmt.Sprintf("http://%s:1900/igd.xml", igdServer)
-	root, err := GetUPnPData(igdURL)
-	if err != nil {
-		return "", err
-	}
+	return AddUpnpPortMapping(igdServer, ProtocolTCP, externalPort, internalIp, internalPort, false)
+}
 
-	igd, err := GetIGDDevice(root, igdURL)
+func DeleteUpnpTcpPortMapping(igdServer string, externalPort int) error {
+	return DeleteUpnpPortMapping(igdServer, ProtocolTCP, externalPort)
+}
+
+// AddUpnpPortMapping maps externalPort of protocol on the IGD to
+// internalIp:internalPort, and returns the external IP of the IGD. The IGD
+// is found by GetIGD, and the mapping added on its connected service. If
+// checkConflict is set it fails with *PortMappingConflictError rather than
+// replace a mapping to another address.
+func AddUpnpPortMapping(igdServer string, protocol string, externalPort int,
+	internalIp string, internalPort int, checkConflict bool) (string, error) {
+	s, externalIP, err := finder.connectedService(igdServer, internalIp)
 	if err != nil {
 		return "", err
 	}
 
-	for _, s := range igd.Services {
-		externalIP, err := s.GetExternalIPAddress()
-		if err != nil {
-			return "", err
-		}
-
-		err = s.AddPortMapping("TCP", externalPort, internalIp, internalPort, 0, "")
+	if checkConflict {
+		err = s.CheckPortMapping(protocol, externalPort, internalIp, internalPort)
 		if err != nil {
 			return "", err
 		}
-
-		return externalIP.String(), nil
 	}
 
-	return "", errors.New("can't create port mapping")
-}
-
-func DeleteUpnpTcpPortMapping(igdServer string, externalPort int) error {
-	igdURL := fmt.Sprintf("http://%s:1900/igd.xml", igdServer)
-	root, err := GetUPnPData(igdURL)
+	err = s.AddPortMapping(protocol, externalPort, internalIp, internalPort, 0, "")
 	if err != nil {
-		return err
+		return "", err
 	}
+	return externalIP.String(), nil
+}
 
-	igd, err := GetIGDDevice(root, igdURL)
+// DeleteUpnpPortMapping deletes the mapping of externalPort of protocol
+// from the connected service of the IGD.
+func DeleteUpnpPortMapping(igdServer string, protocol string, externalPort int) error {
+	s, _, err := finder.connectedService(igdServer, "")
 	if err != nil {
 		return err
 	}
-
-	for _, s := range igd.Services {
-		err = s.DeletePortMapping("TCP", externalPort)
-		if err != nil {
-			return err
-		}
-
-		return nil
-	}
-
-	return nil
+	return s.DeletePortMapping(protocol, externalPort)
 }
@@ -0,0 +1,105 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// httpConnect connects through a HTTP proxy with the CONNECT method, over
+// TLS if tls is set. user is sent with basic auth.
+type httpConnect struct {
+	addr    string
+	user    *url.Userinfo
+	tls     bool
+	forward Dialer
+}
+
+func (h *httpConnect) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	err := checkNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := h.forward.DialContext(ctx, "tcp", h.addr)
+	if err != nil {
+		return nil, err
+	}
+	if h.tls {
+		host, _, _ := net.SplitHostPort(h.addr)
+		c = tls.Client(c, &tls.Config{ServerName: host})
+	}
+
+	err = handshake(ctx, c, func() error {
+		var err error
+		c, err = h.connect(c, addr)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("http proxy %s: %v", h.addr, err)
+	}
+	return c, nil
+}
+
+// connect returns c, or c wrapped to replay data the proxy sent right
+// after its response.
+func (h *httpConnect) connect(c net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if h.user != nil {
+		passwd, _ := h.user.Password()
+		auth := h.user.Username() + ":" + passwd
+		req.Header.Set("Proxy-Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+
+	err := req.Write(c)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// bufferedConn reads what's left in r before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+const (
+	socks5Version    = 5
+	socks5NoAuth     = 0
+	socks5PasswdAuth = 2
+	socks5Connect    = 1
+
+	socks5IPv4   = 1
+	socks5Domain = 3
+	socks5IPv6   = 4
+)
+
+var socks5Replies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// socks5 connects through a SOCKS5 proxy (RFC 1928), with username and
+// password auth (RFC 1929) if user is set. Host names are resolved by the
+// proxy.
+type socks5 struct {
+	addr    string
+	user    *url.Userinfo
+	forward Dialer
+}
+
+func (s *socks5) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	err := checkNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := s.forward.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	err = handshake(ctx, c, func() error {
+		return s.connect(c, addr)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy %s: %v", s.addr, err)
+	}
+	return c, nil
+}
+
+func (s *socks5) connect(c net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port: %s", portStr)
+	}
+
+	method := byte(socks5NoAuth)
+	if s.user != nil {
+		method = socks5PasswdAuth
+	}
+	_, err = c.Write([]byte{socks5Version, 1, method})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c, buf[:2])
+	if err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("unexpected version %d", buf[0])
+	}
+	if buf[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+
+	if method == socks5PasswdAuth {
+		err = s.auth(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	_, err = c.Write(req)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		if int(buf[1]) < len(socks5Replies) {
+			return fmt.Errorf("connect %s: %s", addr, socks5Replies[buf[1]])
+		}
+		return fmt.Errorf("connect %s: unknown reply %d", addr, buf[1])
+	}
+
+	// skip the bound address
+	n := 0
+	switch buf[3] {
+	case socks5IPv4:
+		n = net.IPv4len
+	case socks5IPv6:
+		n = net.IPv6len
+	case socks5Domain:
+		_, err = io.ReadFull(c, buf[:1])
+		if err != nil {
+			return err
+		}
+		n = int(buf[0])
+	default:
+		return fmt.Errorf("unknown address type %d", buf[3])
+	}
+	_, err = io.ReadFull(c, make([]byte, n+2))
+	return err
+}
+
+func (s *socks5) auth(c net.Conn) error {
+	user := s.user.Username()
+	passwd, _ := s.user.Password()
+	if len(user) == 0 || len(user) > 255 || len(passwd) > 255 {
+		return errors.New("invalid username or password")
+	}
+
+	req := []byte{1, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(passwd)))
+	req = append(req, passwd...)
+	_, err := c.Write(req)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
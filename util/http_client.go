@@ -51,12 +51,15 @@ type HttpClientConfig struct {
 	NoFollowRedirect bool
 	NoTLSVerify      bool
 	DialTimeout      time.Duration
+	// Header is added to every request that doesn't set it already
+	Header http.Header
 }
 
 type HttpClient struct {
 	tr               *http.Transport
 	client           *http.Client
 	noFollowRedirect bool
+	header           http.Header
 	debug            bool
 	debugLock        sync.Mutex
 }
@@ -96,6 +99,7 @@ func NewHttpClient(cfg *HttpClientConfig) (*HttpClient, error) {
 		tr:               tr,
 		client:           httpClient,
 		noFollowRedirect: cfg.NoFollowRedirect,
+		header:           cfg.Header,
 	}
 
 	return c, nil
@@ -128,6 +132,15 @@ func (c *HttpClient) DoGetAndParseResult(url string, result interface{}) error {
 }
 
 func (c *HttpClient) Do(req *http.Request) (*http.Response, error) {
+	for k, v := range c.header {
+		if req.Header.Get(k) != "" {
+			continue
+		}
+		for _, x := range v {
+			req.Header.Add(k, x)
+		}
+	}
+
 	if c.debug || GetHttpClientDebugMode() {
 		c.DumpRequest(req, os.Stdout)
 	}
@@ -151,7 +164,20 @@ func (c *HttpClient) Do(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
+func (c *HttpClient) DoJsonRequestAndParseResult(method, url string,
+	data interface{}, result interface{}) error {
+	resp, err := c.DoJsonRequest(method, url, data)
+	if err != nil {
+		return err
+	}
+	return c.ParseJsonResp(resp, result)
+}
+
 func (c *HttpClient) DoJsonPost(url string, data interface{}) (*http.Response, error) {
+	return c.DoJsonRequest("POST", url, data)
+}
+
+func (c *HttpClient) DoJsonRequest(method, url string, data interface{}) (*http.Response, error) {
 	var r io.Reader
 	if data != nil {
 		rdata, err := json.Marshal(data)
@@ -160,7 +186,7 @@ func (c *HttpClient) DoJsonPost(url string, data interface{}) (*http.Response, e
 		}
 		r = bytes.NewReader(rdata)
 	}
-	req, err := http.NewRequest("POST", url, r)
+	req, err := http.NewRequest(method, url, r)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,151 @@
+// Package relay copies data between two connections. Between two
+// *net.TCPConn on linux the data is moved by splice(2) without passing
+// through user space, otherwise pooled buffers are used.
+package relay
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// BufferSize is the size of pooled buffers.
+	BufferSize = 32 * 1024
+
+	// ChunkSize is how much Copy moves between updates of its counter.
+	ChunkSize = 64 * 1024
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, BufferSize)
+		return &buf
+	},
+}
+
+// GetBuffer returns a buffer of BufferSize bytes, it should be returned by
+// PutBuffer once unused.
+func GetBuffer() []byte {
+	return *bufferPool.Get().(*[]byte)
+}
+
+func PutBuffer(buf []byte) {
+	if cap(buf) < BufferSize {
+		return
+	}
+	buf = buf[:BufferSize]
+	bufferPool.Put(&buf)
+}
+
+// writerOnly hides the ReaderFrom of a connection so io.CopyBuffer uses
+// the given buffer instead of allocating one.
+type writerOnly struct {
+	io.Writer
+}
+
+// canSplice reports whether net.TCPConn.ReadFrom would splice from src, on
+// other systems or sources it allocates a buffer per call.
+func canSplice(src net.Conn) bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	_, ok := src.(*net.TCPConn)
+	return ok
+}
+
+// CopyChunk copies at most max bytes from src to dst, using buf unless
+// the data can be spliced. It returns io.EOF once src has ended, and the
+// read error of src or write error of dst otherwise.
+func CopyChunk(dst, src net.Conn, max int64, buf []byte) (int64, error) {
+	lr := &io.LimitedReader{R: src, N: max}
+
+	var n int64
+	var err error
+	if tc, ok := dst.(*net.TCPConn); ok && canSplice(src) {
+		n, err = tc.ReadFrom(lr)
+	} else {
+		n, err = io.CopyBuffer(writerOnly{dst}, lr, buf)
+	}
+
+	if err == nil && n < max {
+		err = io.EOF
+	}
+	return n, err
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite shuts down the writing side of c if it supports half-close.
+func CloseWrite(c net.Conn) error {
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Copy copies src to dst until src ends, then shuts down the writing side
+// of dst so the peer of dst sees the end too. counter, if not nil, is
+// added the bytes written after every chunk. The normal end of src isn't
+// an error.
+func Copy(dst, src net.Conn, counter *int64) (int64, error) {
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+
+	var written int64
+	for {
+		n, err := CopyChunk(dst, src, ChunkSize, buf)
+		written += n
+		if counter != nil {
+			atomic.AddInt64(counter, n)
+		}
+
+		if err != nil {
+			CloseWrite(dst)
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+	}
+}
+
+// Relay copies between a and b in both directions until both have ended,
+// each direction is half-closed on its own. A failed direction closes both
+// connections at once. a and b are closed when Relay returns, err is the
+// error of the direction that failed first.
+func Relay(a, b net.Conn) (aToB, bToA int64, err error) {
+	var once sync.Once
+	fail := func(e error) {
+		once.Do(func() {
+			err = e
+			a.Close()
+			b.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var e error
+		bToA, e = Copy(a, b, nil)
+		if e != nil {
+			fail(e)
+		}
+	}()
+
+	aToB, e := Copy(b, a, nil)
+	if e != nil {
+		fail(e)
+	}
+	wg.Wait()
+
+	a.Close()
+	b.Close()
+	return aToB, bToA, err
+}
@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback tcp connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+// bufferedConn hides the *net.TCPConn so the data can't be spliced.
+type bufferedConn struct {
+	net.Conn
+}
+
+func (c bufferedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func testRelay(t *testing.T, wrap func(net.Conn) net.Conn) {
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	type result struct {
+		aToB, bToA int64
+		err        error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		r.aToB, r.bToA, r.err = Relay(wrap(a), wrap(b))
+		done <- r
+	}()
+
+	// each direction ends on its own
+	client.Write([]byte("ping"))
+	CloseWrite(client)
+	data, err := ioutil.ReadAll(server)
+	if err != nil || string(data) != "ping" {
+		t.Fatalf("server read %q %v", data, err)
+	}
+
+	server.Write([]byte("pong!"))
+	CloseWrite(server)
+	data, err = ioutil.ReadAll(client)
+	if err != nil || string(data) != "pong!" {
+		t.Fatalf("client read %q %v", data, err)
+	}
+
+	r := <-done
+	if r.aToB != 4 || r.bToA != 5 || r.err != nil {
+		t.Errorf("relay returned %+v", r)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	testRelay(t, func(c net.Conn) net.Conn { return c })
+}
+
+func TestRelayBuffered(t *testing.T) {
+	testRelay(t, func(c net.Conn) net.Conn { return bufferedConn{c} })
+}
+
+func TestCopyChunk(t *testing.T) {
+	client, src := tcpPair(t)
+	dst, server := tcpPair(t)
+	defer client.Close()
+	defer src.Close()
+	defer dst.Close()
+	defer server.Close()
+
+	client.Write(make([]byte, 100))
+	client.Close()
+
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+	var total int64
+	for {
+		n, err := CopyChunk(dst, src, 30, buf)
+		if n > 30 {
+			t.Fatalf("copied %d bytes, max 30", n)
+		}
+		total += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if total != 100 {
+		t.Errorf("copied %d bytes", total)
+	}
+}
+
+// copy4K is the loop tcpproxy used to copy one direction.
+func copy4K(dst, src net.Conn) error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			CloseWrite(dst)
+			return err
+		}
+	}
+}
+
+// copy1K is the loop tcpmux used to copy one direction.
+func copy1K(dst, src net.Conn) error {
+	buf := make([]byte, 1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			n2, err := dst.Write(buf[:n])
+			if n2 != n {
+				return err
+			}
+		}
+		if err != nil {
+			CloseWrite(dst)
+			return err
+		}
+	}
+}
+
+func copyRelay(dst, src net.Conn) error {
+	_, err := Copy(dst, src, nil)
+	return err
+}
+
+func copyBuffered(dst, src net.Conn) error {
+	_, err := Copy(bufferedConn{dst}, bufferedConn{src}, nil)
+	return err
+}
+
+const benchBlockSize = 64 * 1024
+
+// benchmarkCopy measures fn copying b.N blocks over loopback.
+func benchmarkCopy(b *testing.B, fn func(dst, src net.Conn) error) {
+	client, src := tcpPair(b)
+	dst, server := tcpPair(b)
+	defer src.Close()
+	defer dst.Close()
+
+	go func() {
+		defer client.Close()
+		block := make([]byte, benchBlockSize)
+		for i := 0; i < b.N; i++ {
+			if _, err := client.Write(block); err != nil {
+				return
+			}
+		}
+	}()
+	done := make(chan int64)
+	go func() {
+		defer server.Close()
+		n, _ := io.Copy(ioutil.Discard, server)
+		done <- n
+	}()
+
+	b.SetBytes(benchBlockSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	fn(dst, src)
+	if n := <-done; n != int64(b.N)*benchBlockSize {
+		b.Fatalf("copied %d bytes", n)
+	}
+}
+
+func BenchmarkCopy4K(b *testing.B)       { benchmarkCopy(b, copy4K) }
+func BenchmarkCopy1K(b *testing.B)       { benchmarkCopy(b, copy1K) }
+func BenchmarkCopy(b *testing.B)         { benchmarkCopy(b, copyRelay) }
+func BenchmarkCopyBuffered(b *testing.B) { benchmarkCopy(b, copyBuffered) }